@@ -29,6 +29,7 @@ package mgo
 import (
 	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -87,6 +88,15 @@ type saslResult struct {
 	ErrMsg         string
 }
 
+type saslMechsCmd struct {
+	IsMaster           int    `bson:"ismaster"`
+	SaslSupportedMechs string `bson:"saslSupportedMechs"`
+}
+
+type saslMechsResult struct {
+	SaslSupportedMechs []string `bson:"saslSupportedMechs"`
+}
+
 type saslStepper interface {
 	Step(serverData []byte) (clientData []byte, done bool, err error)
 	Close()
@@ -95,14 +105,14 @@ type saslStepper interface {
 func (socket *mongoSocket) getNonce() (nonce string, err error) {
 	socket.Lock()
 	for socket.cachedNonce == "" && socket.dead == nil {
-		debugf("Socket %p to %s: waiting for nonce", socket, socket.addr)
+		debugf(LogConnections, "Socket %p to %s: waiting for nonce", socket, socket.addr)
 		socket.gotNonce.Wait()
 	}
 	if socket.cachedNonce == "mongos" {
 		socket.Unlock()
 		return "", errors.New("Can't authenticate with mongos; see http://j.mp/mongos-auth")
 	}
-	debugf("Socket %p to %s: got nonce", socket, socket.addr)
+	debugf(LogConnections, "Socket %p to %s: got nonce", socket, socket.addr)
 	nonce, err = socket.cachedNonce, socket.dead
 	socket.cachedNonce = ""
 	socket.Unlock()
@@ -113,7 +123,7 @@ func (socket *mongoSocket) getNonce() (nonce string, err error) {
 }
 
 func (socket *mongoSocket) resetNonce() {
-	debugf("Socket %p to %s: requesting a new nonce", socket, socket.addr)
+	debugf(LogConnections, "Socket %p to %s: requesting a new nonce", socket, socket.addr)
 	op := &queryOp{}
 	op.query = &getNonceCmd{GetNonce: 1}
 	op.collection = "admin.$cmd"
@@ -129,7 +139,7 @@ func (socket *mongoSocket) resetNonce() {
 			socket.kill(errors.New("Failed to unmarshal nonce: "+err.Error()), true)
 			return
 		}
-		debugf("Socket %p to %s: nonce unmarshalled: %#v", socket, socket.addr, result)
+		debugf(LogConnections, "Socket %p to %s: nonce unmarshalled: %#v", socket, socket.addr, result)
 		if result.Code == 13390 {
 			// mongos doesn't yet support auth (see http://j.mp/mongos-auth)
 			result.Nonce = "mongos"
@@ -159,26 +169,26 @@ func (socket *mongoSocket) resetNonce() {
 }
 
 func (socket *mongoSocket) Login(cred Credential) error {
-	socket.Lock()
-	if cred.Mechanism == "" && socket.serverInfo.MaxWireVersion >= 3 {
-		cred.Mechanism = "SCRAM-SHA-1"
+	if cred.Mechanism == "" {
+		cred.Mechanism = socket.defaultMechanism(cred)
 	}
+	socket.Lock()
 	for _, sockCred := range socket.creds {
 		if sockCred == cred {
-			debugf("Socket %p to %s: login: db=%q user=%q (already logged in)", socket, socket.addr, cred.Source, cred.Username)
+			debugf(LogConnections, "Socket %p to %s: login: db=%q user=%q (already logged in)", socket, socket.addr, cred.Source, cred.Username)
 			socket.Unlock()
 			return nil
 		}
 	}
 	if socket.dropLogout(cred) {
-		debugf("Socket %p to %s: login: db=%q user=%q (cached)", socket, socket.addr, cred.Source, cred.Username)
+		debugf(LogConnections, "Socket %p to %s: login: db=%q user=%q (cached)", socket, socket.addr, cred.Source, cred.Username)
 		socket.creds = append(socket.creds, cred)
 		socket.Unlock()
 		return nil
 	}
 	socket.Unlock()
 
-	debugf("Socket %p to %s: login: db=%q user=%q", socket, socket.addr, cred.Source, cred.Username)
+	debugf(LogConnections, "Socket %p to %s: login: db=%q user=%q", socket, socket.addr, cred.Source, cred.Username)
 
 	var err error
 	switch cred.Mechanism {
@@ -194,13 +204,55 @@ func (socket *mongoSocket) Login(cred Credential) error {
 	}
 
 	if err != nil {
-		debugf("Socket %p to %s: login error: %s", socket, socket.addr, err)
+		debugf(LogConnections, "Socket %p to %s: login error: %s", socket, socket.addr, err)
 	} else {
-		debugf("Socket %p to %s: login successful", socket, socket.addr)
+		debugf(LogConnections, "Socket %p to %s: login successful", socket, socket.addr)
 	}
 	return err
 }
 
+// defaultMechanism returns the mechanism to authenticate cred with when
+// none was explicitly requested. Servers since MongoDB 4.0 are asked which
+// SCRAM mechanisms the user supports, and SCRAM-SHA-256 is preferred when
+// available. The outcome is cached in the socket to avoid asking again.
+func (socket *mongoSocket) defaultMechanism(cred Credential) string {
+	user := cred.Source + "." + cred.Username
+	socket.Lock()
+	wireVersion := socket.serverInfo.MaxWireVersion
+	mechanism, ok := socket.mechanisms[user]
+	socket.Unlock()
+	switch {
+	case ok:
+		return mechanism
+	case wireVersion < 3:
+		return ""
+	case wireVersion < 7:
+		return "SCRAM-SHA-1"
+	}
+
+	cmd := saslMechsCmd{IsMaster: 1, SaslSupportedMechs: user}
+	res := saslMechsResult{}
+	err := socket.loginRun("admin", &cmd, &res, func() error { return nil })
+	if err != nil {
+		debugf(LogConnections, "Socket %p to %s: cannot obtain SASL mechanisms: %v", socket, socket.addr, err)
+		return "SCRAM-SHA-1"
+	}
+	mechanism = "SCRAM-SHA-1"
+	for _, m := range res.SaslSupportedMechs {
+		if m == "SCRAM-SHA-256" {
+			mechanism = m
+			break
+		}
+	}
+	socket.Lock()
+	if socket.mechanisms == nil {
+		socket.mechanisms = make(map[string]string)
+	}
+	socket.mechanisms[user] = mechanism
+	socket.Unlock()
+	return mechanism
+}
+
 func (socket *mongoSocket) loginClassic(cred Credential) error {
 	// Note that this only works properly because this function is
 	// synchronous, which means the nonce won't get reset while we're
@@ -237,11 +289,21 @@ func (socket *mongoSocket) loginClassic(cred Credential) error {
 
 type authX509Cmd struct {
 	Authenticate int
-	User         string
+	User         string `bson:"user,omitempty"`
 	Mechanism    string
 }
 
 func (socket *mongoSocket) loginX509(cred Credential) error {
+	if cred.Username == "" {
+		// Servers since MongoDB 3.4 take the username from the subject
+		// of the client certificate presented in the TLS handshake.
+		socket.Lock()
+		wireVersion := socket.serverInfo.MaxWireVersion
+		socket.Unlock()
+		if wireVersion < 5 {
+			return errors.New("MONGODB-X509 authentication without a username requires MongoDB 3.4 or later")
+		}
+	}
 	cmd := authX509Cmd{Authenticate: 1, User: cred.Username, Mechanism: "MONGODB-X509"}
 	res := authResult{}
 	return socket.loginRun(cred.Source, &cmd, &res, func() error {
@@ -274,7 +336,7 @@ func (socket *mongoSocket) loginPlain(cred Credential) error {
 func (socket *mongoSocket) loginSASL(cred Credential) error {
 	var sasl saslStepper
 	var err error
-	if cred.Mechanism == "SCRAM-SHA-1" {
+	if cred.Mechanism == "SCRAM-SHA-1" || cred.Mechanism == "SCRAM-SHA-256" {
 		// SCRAM is handled without external libraries.
 		sasl = saslNewScram(cred)
 	} else if len(cred.ServiceHost) > 0 {
@@ -354,9 +416,16 @@ func (socket *mongoSocket) loginSASL(cred Credential) error {
 }
 
 func saslNewScram(cred Credential) *saslScram {
-	credsum := md5.New()
-	credsum.Write([]byte(cred.Username + ":mongo:" + cred.Password))
-	client := scram.NewClient(sha1.New, cred.Username, hex.EncodeToString(credsum.Sum(nil)))
+	var client *scram.Client
+	if cred.Mechanism == "SCRAM-SHA-256" {
+		// The password is salted as provided, rather than digested
+		// as for SCRAM-SHA-1. SASLprep normalization is not applied.
+		client = scram.NewClient(sha256.New, cred.Username, cred.Password)
+	} else {
+		credsum := md5.New()
+		credsum.Write([]byte(cred.Username + ":mongo:" + cred.Password))
+		client = scram.NewClient(sha1.New, cred.Username, hex.EncodeToString(credsum.Sum(nil)))
+	}
 	return &saslScram{cred: cred, client: client}
 }
 
@@ -411,7 +480,7 @@ func (socket *mongoSocket) Logout(db string) {
 	socket.Lock()
 	cred, found := socket.dropAuth(db)
 	if found {
-		debugf("Socket %p to %s: logout: db=%q (flagged)", socket, socket.addr, db)
+		debugf(LogConnections, "Socket %p to %s: logout: db=%q (flagged)", socket, socket.addr, db)
 		socket.logout = append(socket.logout, cred)
 	}
 	socket.Unlock()
@@ -420,7 +489,7 @@ func (socket *mongoSocket) Logout(db string) {
 func (socket *mongoSocket) LogoutAll() {
 	socket.Lock()
 	if l := len(socket.creds); l > 0 {
-		debugf("Socket %p to %s: logout all (flagged %d)", socket, socket.addr, l)
+		debugf(LogConnections, "Socket %p to %s: logout all (flagged %d)", socket, socket.addr, l)
 		socket.logout = append(socket.logout, socket.creds...)
 		socket.creds = socket.creds[0:0]
 	}
@@ -430,7 +499,7 @@ func (socket *mongoSocket) LogoutAll() {
 func (socket *mongoSocket) flushLogout() (ops []any) {
 	socket.Lock()
 	if l := len(socket.logout); l > 0 {
-		debugf("Socket %p to %s: logout all (flushing %d)", socket, socket.addr, l)
+		debugf(LogConnections, "Socket %p to %s: logout all (flushing %d)", socket, socket.addr, l)
 		for i := 0; i != l; i++ {
 			op := queryOp{}
 			op.query = &logoutCmd{Logout: 1}
@@ -40,6 +40,7 @@ import (
 	. "gopkg.in/check.v1"
 
 	"github.com/3JoB/mgo"
+	"github.com/3JoB/mgo/bson"
 )
 
 func (s *S) TestAuthLoginDatabase(c *C) {
@@ -66,6 +67,50 @@ func (s *S) TestAuthLoginDatabase(c *C) {
 	}
 }
 
+func (s *S) TestAuthConnectionStatus(c *C) {
+	session, err := mgo.Dial("localhost:40002")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	status, err := session.ConnectionStatus()
+	c.Assert(err, IsNil)
+	c.Assert(status.AuthenticatedUsers, HasLen, 0)
+	c.Assert(status.AuthenticatedUserRoles, HasLen, 0)
+
+	err = session.DB("admin").Login("root", "rapadura")
+	c.Assert(err, IsNil)
+
+	status, err = session.ConnectionStatus()
+	c.Assert(err, IsNil)
+	c.Assert(status.AuthenticatedUsers, DeepEquals, []mgo.AuthenticatedUser{{User: "root", DB: "admin"}})
+	c.Assert(status.AuthenticatedUserRoles, DeepEquals, []mgo.AuthenticatedRole{{Role: mgo.RoleRoot, DB: "admin"}})
+}
+
+func (s *S) TestAuthConnectionStatusReply(c *C) {
+	data, err := bson.Marshal(bson.M{
+		"authenticatedUsers": []bson.M{{"user": "myruser", "db": "mydb"}, {"user": "root", "db": "admin"}},
+		"authenticatedUserRoles": []bson.M{
+			{"role": "read", "db": "mydb"},
+			{"role": "readWrite", "db": "otherdb"},
+			{"role": "root", "db": "admin"},
+		},
+	})
+	c.Assert(err, IsNil)
+
+	var status mgo.ConnectionStatus
+	err = bson.Unmarshal(data, &status)
+	c.Assert(err, IsNil)
+	c.Assert(status.AuthenticatedUsers, DeepEquals, []mgo.AuthenticatedUser{
+		{User: "myruser", DB: "mydb"},
+		{User: "root", DB: "admin"},
+	})
+	c.Assert(status.AuthenticatedUserRoles, DeepEquals, []mgo.AuthenticatedRole{
+		{Role: mgo.RoleRead, DB: "mydb"},
+		{Role: mgo.RoleReadWrite, DB: "otherdb"},
+		{Role: mgo.RoleRoot, DB: "admin"},
+	})
+}
+
 func (s *S) TestAuthLoginSession(c *C) {
 	// Test both with a normal database and with an authenticated shard.
 	for _, addr := range []string{"localhost:40002", "localhost:40203"} {
@@ -894,6 +939,93 @@ func (s *S) TestAuthScramSha1URL(c *C) {
 	c.Assert(err, Equals, mgo.ErrNotFound)
 }
 
+func (s *S) TestAuthScramSha256Cred(c *C) {
+	if !s.versionAtLeast(4, 0) {
+		c.Skip("SCRAM-SHA-256 tests depend on 4.0")
+	}
+	cred := &mgo.Credential{
+		Username:  "root",
+		Password:  "rapadura",
+		Mechanism: "SCRAM-SHA-256",
+		Source:    "admin",
+	}
+	host := "localhost:40002"
+	c.Logf("Connecting to %s...", host)
+	session, err := mgo.Dial(host)
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	mycoll := session.DB("admin").C("mycoll")
+
+	c.Logf("Connected! Testing the need for authentication...")
+	err = mycoll.Find(nil).One(nil)
+	c.Assert(err, ErrorMatches, "unauthorized|not authorized .*")
+
+	c.Logf("Authenticating...")
+	err = session.Login(cred)
+	c.Assert(err, IsNil)
+	c.Logf("Authenticated!")
+
+	c.Logf("Connected! Testing the need for authentication...")
+	err = mycoll.Find(nil).One(nil)
+	c.Assert(err, Equals, mgo.ErrNotFound)
+
+	cred.Password = "wrong"
+	err = session.Login(cred)
+	c.Assert(err, ErrorMatches, "server returned error on SASL authentication step: .*")
+}
+
+func (s *S) TestAuthScramSha256URL(c *C) {
+	if !s.versionAtLeast(4, 0) {
+		c.Skip("SCRAM-SHA-256 tests depend on 4.0")
+	}
+	host := "localhost:40002"
+	c.Logf("Connecting to %s...", host)
+	session, err := mgo.Dial(fmt.Sprintf("root:rapadura@%s?authMechanism=SCRAM-SHA-256", host))
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	mycoll := session.DB("admin").C("mycoll")
+
+	c.Logf("Connected! Testing the need for authentication...")
+	err = mycoll.Find(nil).One(nil)
+	c.Assert(err, Equals, mgo.ErrNotFound)
+}
+
+func (s *S) TestAuthScramNegotiation(c *C) {
+	if !s.versionAtLeast(4, 0) {
+		c.Skip("SCRAM mechanism negotiation depends on 4.0")
+	}
+	session, err := mgo.Dial("localhost:40002")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	admindb := session.DB("admin")
+	err = admindb.Login("root", "rapadura")
+	c.Assert(err, IsNil)
+
+	// A user holding SCRAM-SHA-1 credentials only must still be able to
+	// login without an explicit mechanism.
+	err = admindb.Run(bson.D{
+		{Name: "createUser", Value: "sha1user"},
+		{Name: "pwd", Value: "sha1pass"},
+		{Name: "roles", Value: []string{"read"}},
+		{Name: "mechanisms", Value: []string{"SCRAM-SHA-1"}},
+	}, nil)
+	c.Assert(err, IsNil)
+	defer admindb.RemoveUser("sha1user")
+
+	for _, cred := range [][2]string{{"root", "rapadura"}, {"sha1user", "sha1pass"}} {
+		other, err := mgo.Dial("localhost:40002")
+		c.Assert(err, IsNil)
+		err = other.DB("admin").Login(cred[0], cred[1])
+		c.Assert(err, IsNil, Commentf("user %s", cred[0]))
+		err = other.DB("admin").C("mycoll").Find(nil).One(nil)
+		c.Assert(err, Equals, mgo.ErrNotFound)
+		other.Close()
+	}
+}
+
 func (s *S) TestAuthX509Cred(c *C) {
 	session, err := mgo.Dial("localhost:40001")
 	c.Assert(err, IsNil)
@@ -963,6 +1095,78 @@ func (s *S) TestAuthX509Cred(c *C) {
 	c.Assert(len(names) > 0, Equals, true)
 }
 
+func (s *S) TestAuthX509CredNoUsername(c *C) {
+	if !s.versionAtLeast(3, 4) {
+		c.Skip("deriving the X509 username depends on 3.4")
+	}
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+	binfo, err := session.BuildInfo()
+	c.Assert(err, IsNil)
+	if binfo.OpenSSLVersion == "" {
+		c.Skip("server does not support SSL")
+	}
+
+	clientCertPEM, err := os.ReadFile("harness/certs/client.pem")
+	c.Assert(err, IsNil)
+
+	clientCert, err := tls.X509KeyPair(clientCertPEM, clientCertPEM)
+	c.Assert(err, IsNil)
+
+	tlsConfig := &tls.Config{
+		// Isolating tests to client certs, don't care about server validation.
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{clientCert},
+	}
+	dialServer := func(addr *mgo.ServerAddr) (net.Conn, error) {
+		return tls.Dial("tcp", addr.String(), tlsConfig)
+	}
+
+	var host = "localhost:40003"
+	session, err = mgo.DialWithInfo(&mgo.DialInfo{
+		Addrs:      []string{host},
+		DialServer: dialServer,
+	})
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	err = session.Login(&mgo.Credential{Username: "root", Password: "rapadura"})
+	c.Assert(err, IsNil)
+
+	// This needs to be kept in sync with client.pem
+	x509Subject := "CN=localhost,OU=Client,O=MGO,L=MGO,ST=MGO,C=GO"
+
+	err = session.DB("$external").UpsertUser(&mgo.User{
+		Username:     x509Subject,
+		OtherDBRoles: map[string][]mgo.Role{"admin": {mgo.RoleRoot}},
+	})
+	c.Assert(err, IsNil)
+
+	session.LogoutAll()
+
+	// Source defaults to $external with MONGODB-X509.
+	err = session.Login(&mgo.Credential{Mechanism: "MONGODB-X509"})
+	c.Assert(err, IsNil)
+
+	names, err := session.DatabaseNames()
+	c.Assert(err, IsNil)
+	c.Assert(len(names) > 0, Equals, true)
+
+	// The same works when authenticating while dialing.
+	session, err = mgo.DialWithInfo(&mgo.DialInfo{
+		Addrs:      []string{host},
+		DialServer: dialServer,
+		Mechanism:  "MONGODB-X509",
+	})
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	names, err = session.DatabaseNames()
+	c.Assert(err, IsNil)
+	c.Assert(len(names) > 0, Equals, true)
+}
+
 var (
 	plainFlag = flag.String("plain", "", "Host to test PLAIN authentication against (depends on custom environment)")
 	plainUser = "einstein"
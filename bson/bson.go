@@ -40,8 +40,11 @@ import (
 	// "encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"os"
+	stdreflect "reflect"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -109,6 +112,47 @@ var SetZero = errors.New("set to zero")
 // undefined ordered. See also the bson.D type for an ordered alternative.
 type M map[string]any
 
+// Merge returns a new map holding the elements of m deeply merged with the
+// ones of other. When both hold a map under the same name, the two maps are
+// merged recursively. Otherwise the value in other wins, so scalars and
+// arrays in other replace the ones in m. For example:
+//
+//	defaults := bson.M{"a": 1, "sub": bson.M{"b": 2, "c": 3}}
+//	patch := bson.M{"sub": bson.M{"c": 4}, "d": []int{5}}
+//	defaults.Merge(patch) // bson.M{"a": 1, "sub": bson.M{"b": 2, "c": 4}, "d": []int{5}}
+//
+// Both bson.M and map[string]interface{} values are merged as maps, and
+// merged maps are returned as bson.M. Neither m nor other are modified,
+// but values that didn't need merging are shared with them rather than
+// copied.
+func (m M) Merge(other M) M {
+	merged := make(M, len(m)+len(other))
+	for name, value := range m {
+		merged[name] = value
+	}
+	for name, value := range other {
+		if dst, ok := asMap(merged[name]); ok {
+			if src, ok := asMap(value); ok {
+				merged[name] = dst.Merge(src)
+				continue
+			}
+		}
+		merged[name] = value
+	}
+	return merged
+}
+
+// asMap returns v as an M if it's a map that Merge merges recursively.
+func asMap(v any) (M, bool) {
+	switch m := v.(type) {
+	case M:
+		return m, true
+	case map[string]any:
+		return M(m), true
+	}
+	return nil, false
+}
+
 // D represents a BSON document containing ordered elements. For example:
 //
 //	bson.D{{"a", 1}, {"b", true}}
@@ -125,6 +169,8 @@ type DocElem struct {
 }
 
 // Map returns a map out of the ordered element name/value pairs in d.
+// When d holds several elements with the same name, the map holds the
+// value of the last one. See MapSlice for keeping all of them.
 func (d D) Map() (m M) {
 	m = make(M, len(d))
 	for _, item := range d {
@@ -133,11 +179,220 @@ func (d D) Map() (m M) {
 	return m
 }
 
+// MapSlice returns a map out of the ordered element name/value pairs in d,
+// holding for each name the values of all the elements with that name,
+// in order. This is useful with documents that repeat names, as some
+// server replies do.
+func (d D) MapSlice() map[string][]any {
+	m := make(map[string][]any, len(d))
+	for _, item := range d {
+		m[item.Name] = append(m[item.Name], item.Value)
+	}
+	return m
+}
+
+// Get returns the value of the first element in d with the given name,
+// and whether there's such an element.
+func (d D) Get(name string) (value any, ok bool) {
+	for _, item := range d {
+		if item.Name == name {
+			return item.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Set sets the value of the first element in d with the given name,
+// keeping it in place, or appends a new element to d if there's none.
+func (d *D) Set(name string, value any) {
+	for i := range *d {
+		if (*d)[i].Name == name {
+			(*d)[i].Value = value
+			return
+		}
+	}
+	*d = append(*d, DocElem{Name: name, Value: value})
+}
+
+// Delete removes all the elements in d with the given name, preserving
+// the order of the remaining ones.
+func (d *D) Delete(name string) {
+	out := (*d)[:0]
+	for _, item := range *d {
+		if item.Name != name {
+			out = append(out, item)
+		}
+	}
+	for i := len(out); i < len(*d); i++ {
+		(*d)[i] = DocElem{} // Release the values removed.
+	}
+	*d = out
+}
+
+// Include returns a projection document including the given fields, for
+// use with Query.Select. Elements such as those returned by Slice and
+// ElemMatch may be appended to it.
+//
+// For example:
+//
+//	query.Select(bson.Include("name", "email"))
+//	query.Select(append(bson.Include("title"), bson.Slice("comments", -5)))
+func Include(fields ...string) D {
+	return projection(fields, 1)
+}
+
+// Exclude returns a projection document excluding the given fields, for
+// use with Query.Select. Apart from _id, fields may not be both included
+// and excluded by the same projection.
+func Exclude(fields ...string) D {
+	return projection(fields, 0)
+}
+
+func projection(fields []string, value int) D {
+	d := make(D, len(fields))
+	for i, field := range fields {
+		d[i] = DocElem{Name: field, Value: value}
+	}
+	return d
+}
+
+// Slice returns a projection element limiting the array in the given field
+// to its first n elements, or to its last -n elements if n is negative.
+func Slice(field string, n int) DocElem {
+	return DocElem{Name: field, Value: M{"$slice": n}}
+}
+
+// SliceRange returns a projection element limiting the array in the given
+// field to at most limit elements, after skipping the first skip elements,
+// or all but the last -skip elements if skip is negative.
+func SliceRange(field string, skip, limit int) DocElem {
+	return DocElem{Name: field, Value: M{"$slice": []int{skip, limit}}}
+}
+
+// ElemMatch returns a projection element limiting the array in the given
+// field to the first element matching the query cond. The same element
+// matches documents with such an array field when used in a query filter,
+// either within a D or passed to And, Or or Nor.
+func ElemMatch(field string, cond any) DocElem {
+	return DocElem{Name: field, Value: M{"$elemMatch": cond}}
+}
+
+// Eq returns a query filter matching documents where field equals value.
+//
+// The filter helpers produce the same documents as their hand-written
+// equivalents, and may be combined with And, Or and Nor. For example:
+//
+//	query := collection.Find(bson.And(bson.Eq("a", 1), bson.Gt("b", 2)))
+//
+// is equivalent to:
+//
+//	query := collection.Find(bson.M{"$and": []any{
+//		bson.M{"a": 1},
+//		bson.M{"b": bson.M{"$gt": 2}},
+//	}})
+func Eq(field string, value any) M {
+	return M{field: value}
+}
+
+// Ne returns a query filter matching documents where field does not
+// equal value, including those without the field.
+func Ne(field string, value any) M {
+	return fieldOp(field, "$ne", value)
+}
+
+// Gt returns a query filter matching documents where field is greater
+// than value.
+func Gt(field string, value any) M {
+	return fieldOp(field, "$gt", value)
+}
+
+// Gte returns a query filter matching documents where field is greater
+// than or equal to value.
+func Gte(field string, value any) M {
+	return fieldOp(field, "$gte", value)
+}
+
+// Lt returns a query filter matching documents where field is less than
+// value.
+func Lt(field string, value any) M {
+	return fieldOp(field, "$lt", value)
+}
+
+// Lte returns a query filter matching documents where field is less than
+// or equal to value.
+func Lte(field string, value any) M {
+	return fieldOp(field, "$lte", value)
+}
+
+// In returns a query filter matching documents where field equals any of
+// the elements in the values slice or array.
+func In(field string, values any) M {
+	return fieldOp(field, "$in", values)
+}
+
+// Nin returns a query filter matching documents where field equals none
+// of the elements in the values slice or array.
+func Nin(field string, values any) M {
+	return fieldOp(field, "$nin", values)
+}
+
+// Exists returns a query filter matching documents that have field if
+// exists is true, or that lack it otherwise.
+func Exists(field string, exists bool) M {
+	return fieldOp(field, "$exists", exists)
+}
+
+// Regex returns a query filter matching documents where field is a string
+// matching the regular expression pattern, with the given options as
+// documented for RegEx.
+func Regex(field, pattern, options string) M {
+	return M{field: RegEx{Pattern: pattern, Options: options}}
+}
+
+// And returns a query filter matching documents that match all of the
+// given filters.
+func And(filters ...any) M {
+	return logicalOp("$and", filters)
+}
+
+// Or returns a query filter matching documents that match at least one
+// of the given filters.
+func Or(filters ...any) M {
+	return logicalOp("$or", filters)
+}
+
+// Nor returns a query filter matching documents that match none of the
+// given filters.
+func Nor(filters ...any) M {
+	return logicalOp("$nor", filters)
+}
+
+func fieldOp(field, op string, value any) M {
+	return M{field: M{op: value}}
+}
+
+func logicalOp(op string, filters []any) M {
+	list := make([]any, len(filters))
+	for i, filter := range filters {
+		if elem, ok := filter.(DocElem); ok {
+			// Such as returned by ElemMatch.
+			filter = D{elem}
+		}
+		list[i] = filter
+	}
+	return M{op: list}
+}
+
 // The Raw type represents raw unprocessed BSON documents and elements.
 // Kind is the kind of element as defined per the BSON specification, and
 // Data is the raw unprocessed data for the respective element.
 // Using this type it is possible to unmarshal or marshal values partially.
 //
+// Arrays may be unmarshalled into a []Raw to obtain each element as a Raw
+// that may be inspected and decoded on its own, which is convenient when
+// the elements have different types. The Data of unmarshalled Raw values
+// refers to the input buffer, so it must not be modified while in use.
+//
 // Relevant documentation:
 //
 //	http://bsonspec.org/#/specification
@@ -146,6 +401,35 @@ type Raw struct {
 	Data []byte
 }
 
+// The kinds of BSON elements, as held by Raw.Kind.
+//
+// Relevant documentation:
+//
+//	http://bsonspec.org/#/specification
+const (
+	ElementDouble              byte = 0x01
+	ElementString              byte = 0x02
+	ElementDocument            byte = 0x03
+	ElementArray               byte = 0x04
+	ElementBinary              byte = 0x05
+	ElementUndefined           byte = 0x06 // Deprecated.
+	ElementObjectId            byte = 0x07
+	ElementBool                byte = 0x08
+	ElementDatetime            byte = 0x09
+	ElementNull                byte = 0x0A
+	ElementRegEx               byte = 0x0B
+	ElementDBPointer           byte = 0x0C // Deprecated.
+	ElementJavaScript          byte = 0x0D
+	ElementSymbol              byte = 0x0E // Deprecated.
+	ElementJavaScriptWithScope byte = 0x0F
+	ElementInt32               byte = 0x10
+	ElementMongoTimestamp      byte = 0x11
+	ElementInt64               byte = 0x12
+	ElementDecimal128          byte = 0x13
+	ElementMinKey              byte = 0xFF
+	ElementMaxKey              byte = 0x7F
+)
+
 // RawD represents a BSON document containing raw unprocessed elements.
 // This low-level representation may be useful when lazily processing
 // documents of uncertain content, or when manipulating the raw content
@@ -242,6 +526,38 @@ func NewObjectId() ObjectId {
 	return ObjectId(b[:])
 }
 
+// idGenerator holds the function registered via SetIdGenerator, if any.
+var idGenerator atomic.Value
+
+type idGeneratorFunc func() any
+
+// SetIdGenerator registers gen as the function used to produce ids for
+// documents that lack an _id field when they are inserted, so that values
+// other than ObjectIds, such as time-ordered UUIDs stored as Binary, may
+// be used as ids. Providing nil restores the default, in which case ids
+// are left to be generated as ObjectId values.
+//
+// The generator may be called concurrently and must be safe for that.
+func SetIdGenerator(gen func() any) {
+	idGenerator.Store(idGeneratorFunc(gen))
+}
+
+// IdGenerator returns the function registered via SetIdGenerator, or
+// nil if the default ObjectId generation is in place.
+func IdGenerator() func() any {
+	gen, _ := idGenerator.Load().(idGeneratorFunc)
+	return gen
+}
+
+// NewId returns a new id produced by the function registered via
+// SetIdGenerator, or a new ObjectId if none was registered.
+func NewId() any {
+	if gen := IdGenerator(); gen != nil {
+		return gen()
+	}
+	return NewObjectId()
+}
+
 // NewObjectIdWithTime returns a dummy ObjectId with the timestamp part filled
 // with the provided number of seconds from epoch UTC, and all other parts
 // filled with zeroes. It's not safe to insert a document with an id generated
@@ -387,6 +703,24 @@ func Now() time.Time {
 // strange reason has its own datatype defined in BSON.
 type MongoTimestamp int64
 
+// NewMongoTimestamp creates a timestamp using the given time as the
+// number of seconds since the Unix epoch in its upper 32 bits, and the
+// ordinal as the counter distinguishing operations within the same second
+// in its lower 32 bits. Sub-second precision of t is discarded.
+func NewMongoTimestamp(t time.Time, ordinal uint32) MongoTimestamp {
+	return MongoTimestamp(uint64(uint32(t.Unix()))<<32 | uint64(ordinal))
+}
+
+// Time returns the time of the timestamp, with a precision of one second.
+func (ts MongoTimestamp) Time() time.Time {
+	return time.Unix(int64(uint64(ts)>>32), 0)
+}
+
+// Counter returns the ordinal of the timestamp within its second.
+func (ts MongoTimestamp) Counter() uint32 {
+	return uint32(uint64(ts))
+}
+
 type orderKey int64
 
 // MaxKey is a special value that compares higher than all other possible BSON
@@ -437,6 +771,41 @@ type JavaScript struct {
 	Scope any
 }
 
+// JavaScriptTyped is like JavaScript, but with a scope of type T, such as
+// a struct modelling the variables of the scope, instead of a bson.M. It
+// is marshalled exactly as a JavaScript value with the same Code and
+// Scope would be, except that the scope is always included.
+//
+// JavaScript code without a scope may be unmarshalled into it as well,
+// in which case Scope is set to the zero value of T.
+type JavaScriptTyped[T any] struct {
+	Code  string
+	Scope T
+}
+
+// GetBSON implements the Getter interface.
+func (js JavaScriptTyped[T]) GetBSON() (any, error) {
+	return JavaScript{Code: js.Code, Scope: js.Scope}, nil
+}
+
+// SetBSON implements the Setter interface.
+func (js *JavaScriptTyped[T]) SetBSON(raw Raw) (err error) {
+	defer handleErr(&err)
+	d := newDecoder(raw.Data)
+	var zero T
+	switch raw.Kind {
+	case ElementJavaScript:
+		js.Code, js.Scope = d.readStr(), zero
+	case ElementJavaScriptWithScope:
+		d.readInt32() // Skip length
+		js.Code, js.Scope = d.readStr(), zero
+		d.readDocTo(reflect.ValueOf(&js.Scope))
+	default:
+		return &TypeError{Type: reflect.TypeOf(js).Elem(), Kind: raw.Kind}
+	}
+	return nil
+}
+
 // DBPointer refers to a document id in a namespace.
 //
 // This type is deprecated in the BSON specification and should not be used
@@ -446,14 +815,40 @@ type DBPointer struct {
 	Id        ObjectId
 }
 
+// typeHint holds a value along with the BSON kind it must be marshalled as.
+type typeHint struct {
+	kind  byte
+	value any
+}
+
+// As returns a value that Marshal encodes as the given BSON kind rather
+// than the kind it would pick for the Go type of value. This is mainly
+// useful within bson.M and bson.D values, where no field tag is available.
+// For instance, As(ElementInt64, 1) marshals as an int64 instead of an
+// int32.
+//
+// The supported kinds and the values they accept are:
+//
+//	ElementDouble - From any numeric value.
+//	ElementString - From a string.
+//	ElementBinary - Generic binary, from a string or byte slice.
+//	ElementBool   - From a bool.
+//	ElementSymbol - From a string.
+//	ElementInt32  - From an integer that fits in 32 bits.
+//	ElementInt64  - From any integer that fits in 64 bits.
+//
+// Marshal fails if the value can't be coerced into the requested kind.
+// Unmarshal is not affected, and decodes the value by its stored kind.
+func As(kind byte, value any) any {
+	return typeHint{kind, value}
+}
+
 const initialBufferSize = 64
 
 func handleErr(err *error) {
 	if r := recover(); r != nil {
 		if _, ok := r.(runtime.Error); ok {
 			panic(r)
-		} else if _, ok := r.(externalPanic); ok {
-			panic(r)
 		} else if s, ok := r.(string); ok {
 			*err = errors.New(s)
 		} else if e, ok := r.(error); ok {
@@ -464,6 +859,65 @@ func handleErr(err *error) {
 	}
 }
 
+// maxDepth holds the maximum nesting depth of documents and arrays that
+// are marshalled or unmarshalled, or zero if there's no limit.
+var maxDepth int64 = 200
+
+// SetMaxDepth sets the maximum nesting depth of the documents and arrays
+// handled by Marshal and Unmarshal, counting the top-level document as
+// depth one. Values nested any deeper, including cyclic data structures,
+// fail with an error instead of exhausting the stack. A limit of zero or
+// less removes the limit. The default is 200.
+func SetMaxDepth(n int) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt64(&maxDepth, int64(n))
+}
+
+// checkDepth panics if depth exceeds the configured maximum.
+func checkDepth(depth int) {
+	if max := atomic.LoadInt64(&maxDepth); max > 0 && int64(depth) > max {
+		panic("maximum document nesting depth exceeded")
+	}
+}
+
+// rejectDeprecated is non-zero if deprecated element kinds are rejected.
+var rejectDeprecated int32
+
+// SetRejectDeprecated sets whether Marshal and Unmarshal fail with an
+// error when they encounter elements of the deprecated Undefined (0x06),
+// DBPointer (0x0C) and Symbol (0x0E) kinds, rather than handling them as
+// usual. When marshalling, Raw values are only checked for their own
+// kind, not for the kinds of the elements they may hold. Deprecated kinds
+// are accepted by default.
+func SetRejectDeprecated(reject bool) {
+	var n int32
+	if reject {
+		n = 1
+	}
+	atomic.StoreInt32(&rejectDeprecated, n)
+}
+
+// checkDeprecated panics if kind is deprecated and deprecated element
+// kinds are rejected.
+func checkDeprecated(kind byte) {
+	var name string
+	switch kind {
+	case 0x06:
+		name = "Undefined"
+	case 0x0C:
+		name = "DBPointer"
+	case 0x0E:
+		name = "Symbol"
+	default:
+		return
+	}
+	if atomic.LoadInt32(&rejectDeprecated) != 0 {
+		panic(fmt.Sprintf("deprecated BSON element kind %s (0x%02X) rejected", name, kind))
+	}
+}
+
 // Marshal serializes the in value, which may be a map or a struct value.
 // In the case of struct values, only exported fields will be serialized,
 // and the order of serialized fields will match that of the struct itself.
@@ -489,6 +943,34 @@ func handleErr(err *error) {
 //	           they were part of the outer struct. For maps, keys must
 //	           not conflict with the bson keys of other struct fields.
 //
+//	min=<n>    Have Unmarshal fail if the value of the numeric field
+//	max=<n>    would be below min or above max. Marshalling is not
+//	           affected by these flags.
+//
+//	enum=<v1>|<v2>|...
+//	           Have Unmarshal fail if the value of the string field
+//	           isn't one of the listed values. An empty string is
+//	           also accepted if the field has the omitempty flag,
+//	           since it's marshalled as a missing value. Marshalling
+//	           is not affected by this flag.
+//
+//	rawalso=<field>
+//	           Have Unmarshal also store the element as a bson.Raw value
+//	           in the named field of the same struct, alongside the typed
+//	           value. The named field has no key of its own, so it is
+//	           neither marshalled nor unmarshalled otherwise.
+//
+//	set        Marshal a map[T]struct{} or map[T]bool value, with T being
+//	           a string or numeric type, as a sorted array of its keys,
+//	           leaving out keys mapped to false. Unmarshal accepts such
+//	           an array back, as well as a plain document.
+//
+//	duration=<unit>
+//	           Marshal a time.Duration value as an integer number of
+//	           the given unit, either ms or s, truncating any remainder,
+//	           and unmarshal such a number back. Without this flag, a
+//	           duration is marshalled as its int64 nanoseconds.
+//
 // Some examples:
 //
 //	type T struct {
@@ -498,14 +980,67 @@ func handleErr(err *error) {
 //	    D string `bson:",omitempty" json:"jsonkey"`
 //	    E int64  ",minsize"
 //	    F int64  "myf,omitempty,minsize"
+//	    G int    "age,min=0,max=150"
+//	    S string "status,enum=active|inactive|banned"
+//	    H map[string]struct{} "tags,set"
+//	    T time.Duration "timeout,duration=ms"
 //	}
+//
+// Defined types such as "type Celsius float64" are marshalled according
+// to their underlying kind, the same as the predefined types, including
+// when they instantiate the type parameters of a generic type.
+//
+// Values implementing encoding.BinaryMarshaler, other than time.Time and
+// url.URL which have their own representation, are marshalled as binary
+// data of the generic subtype, unless they implement Getter as well.
+//
+// Fields computed by methods of a struct may be added to its documents
+// with RegisterComputedField.
 func Marshal(in any) (out []byte, err error) {
 	defer handleErr(&err)
 	e := &encoder{out: make([]byte, 0, initialBufferSize)}
 	e.addDoc(reflect.ValueOf(in))
+	if observe, _ := marshalObserver.Load().(marshalObserverFunc); observe != nil {
+		observe(stdreflect.TypeOf(in), len(e.out))
+	}
 	return e.out, nil
 }
 
+// MarshalValue serializes in as a single BSON element rather than as a
+// document, returning the element kind and its data. Unlike Marshal, in
+// may be any value supported within a document, such as an int or a
+// string. The result is what a Raw value holds for the element.
+func MarshalValue(in any) (kind byte, data []byte, err error) {
+	defer handleErr(&err)
+	e := &encoder{out: make([]byte, 0, initialBufferSize)}
+	e.addElem("", reflect.ValueOf(in), false)
+	// Skip the kind byte and the empty element name terminating it.
+	return e.out[0], e.out[2:], nil
+}
+
+// UnmarshalValue deserializes the data of a single BSON element of the
+// given kind, as produced by MarshalValue, into out. It is equivalent
+// to unmarshalling Raw{Kind: kind, Data: data}.
+func UnmarshalValue(kind byte, data []byte, out any) error {
+	return Raw{Kind: kind, Data: data}.Unmarshal(out)
+}
+
+// marshalObserver holds the function registered via SetMarshalObserver.
+var marshalObserver atomic.Value
+
+type marshalObserverFunc func(t stdreflect.Type, size int)
+
+// SetMarshalObserver registers observe to be called after every successful
+// call to Marshal with the type of the value marshalled and the size in
+// bytes of the resulting document. This may be used for debugging or for
+// collecting metrics. Documents marshalled as part of another one are not
+// observed separately. Providing nil unregisters the observer.
+//
+// The observer may be called concurrently and must be safe for that.
+func SetMarshalObserver(observe func(t stdreflect.Type, size int)) {
+	marshalObserver.Store(marshalObserverFunc(observe))
+}
+
 // Unmarshal deserializes data from in into the out value.  The out value
 // must be a map, a pointer to a struct, or a pointer to a bson.D value.
 // In the case of struct values, only exported fields will be deserialized.
@@ -536,12 +1071,98 @@ func Marshal(in any) (out []byte, err error) {
 //   - Bools are converted to numeric types as 1 or 0
 //   - Numeric types are converted to bools as true if not 0 or false otherwise
 //   - Binary and string BSON data is converted to a string, array or byte slice
+//   - Binary BSON data of any subtype is handed to the UnmarshalBinary method
+//     of types implementing encoding.BinaryUnmarshaler, other than time.Time
+//     and url.URL
 //
 // If the value would not fit the type and cannot be converted, it's
 // silently skipped.
 //
+// Documents unmarshalled into an interface{} value take the type of the
+// closest enclosing map or bson.D value, or bson.M at the top level. This
+// means a struct field of type bson.D captures its subdocument in order,
+// including any nested subdocuments, even if the rest of the struct
+// decodes into unordered maps.
+//
 // Pointer values are initialized when necessary.
 func Unmarshal(in []byte, out any) (err error) {
+	return unmarshal(in, out, nil)
+}
+
+// UnmarshalStrict works like Unmarshal, but fails with an
+// *UnknownFieldsError if the document holds elements with no matching
+// field in the struct they're unmarshalled into, including those of
+// nested documents. Elements caught by an ",inline" map aren't unknown.
+// The value of out is still set as Unmarshal would.
+func UnmarshalStrict(in []byte, out any) error {
+	d := newDecoder(in)
+	d.strict = true
+	if err := unmarshal(in, out, d); err != nil {
+		return err
+	}
+	if len(d.unknown) > 0 {
+		return &UnknownFieldsError{Fields: d.unknown}
+	}
+	return nil
+}
+
+// UnmarshalMerge works like Unmarshal, but merges the document into the
+// map or struct pointed to by out rather than resetting it first. Map keys
+// and struct fields not present in the document are left untouched, so
+// values may be accumulated from several documents, such as layers of
+// configuration. Nested documents replace the values previously held by
+// their respective keys or fields as usual.
+func UnmarshalMerge(in []byte, out any) error {
+	d := newDecoder(in)
+	d.merge = true
+	return unmarshal(in, out, d)
+}
+
+// UnknownFieldsError is returned by UnmarshalStrict when the document
+// holds elements with no matching struct field. Fields holds their
+// names, in order, prefixed by the names of the documents they're in
+// separated by dots.
+type UnknownFieldsError struct {
+	Fields []string
+}
+
+func (e *UnknownFieldsError) Error() string {
+	return "Unknown fields in document: " + strings.Join(e.Fields, ", ")
+}
+
+// DecodeContext unmarshals documents like Unmarshal does, but reuses its
+// internal decoding state and type information across calls, avoiding the
+// per-call allocation and the locking of the global type caches. This is
+// useful in high-throughput loops decoding many documents of the same types.
+//
+// A DecodeContext is not safe for concurrent use. Use one per goroutine.
+type DecodeContext struct {
+	d     decoder
+	cache decodeCache
+}
+
+// NewDecodeContext returns a new DecodeContext ready for use.
+func NewDecodeContext() *DecodeContext {
+	return &DecodeContext{cache: decodeCache{
+		structs: make(map[reflect.Type]*structInfo),
+		setters: make(map[reflect.Type]int),
+	}}
+}
+
+// Unmarshal deserializes the in document into the out value, exactly as
+// the Unmarshal function does.
+func (ctx *DecodeContext) Unmarshal(in []byte, out any) error {
+	intern := atomic.LoadInt32(&decodeInternStrings) != 0
+	if !intern {
+		ctx.cache.strs = nil
+	}
+	ctx.d = decoder{in: in, docType: typeM, cache: &ctx.cache, interns: intern}
+	err := unmarshal(in, out, &ctx.d)
+	ctx.d.in = nil
+	return err
+}
+
+func unmarshal(in []byte, out any, d *decoder) (err error) {
 	if raw, ok := out.(*Raw); ok {
 		raw.Kind = 3
 		raw.Data = in
@@ -553,7 +1174,9 @@ func Unmarshal(in []byte, out any) (err error) {
 	case reflect.Ptr:
 		fallthrough
 	case reflect.Map:
-		d := newDecoder(in)
+		if d == nil {
+			d = newDecoder(in)
+		}
 		d.readDocTo(v)
 	case reflect.Struct:
 		return errors.New("Unmarshal can't deal with struct values. Use a pointer.")
@@ -563,6 +1186,36 @@ func Unmarshal(in []byte, out any) (err error) {
 	return nil
 }
 
+// Lookup returns the element found by following path from raw through
+// nested documents and arrays, with array elements named after their
+// index. Only the element names along the way are read, so this is much
+// cheaper than unmarshalling the whole of raw to get a single element.
+// If raw is not a document or array, has no such element, or is found to
+// be corrupted, ok is false.
+func (raw Raw) Lookup(path ...string) (elem Raw, ok bool) {
+	var err error
+	defer func() {
+		if err != nil {
+			elem, ok = Raw{}, false
+		}
+	}()
+	defer handleErr(&err)
+	kind, data := raw.Kind, raw.Data
+	if kind == 0x00 {
+		kind = 0x03
+	}
+	for _, name := range path {
+		if kind != 0x03 && kind != 0x04 {
+			return Raw{}, false
+		}
+		d := &decoder{in: data}
+		if kind, data, ok = d.lookup(name); !ok {
+			return Raw{}, false
+		}
+	}
+	return Raw{Kind: kind, Data: data}, true
+}
+
 // Unmarshal deserializes raw into the out value.  If the out value type
 // is not compatible with raw, a *bson.TypeError is returned.
 //
@@ -589,6 +1242,182 @@ func (raw Raw) Unmarshal(out any) (err error) {
 	return nil
 }
 
+// String returns the value of raw, which must be a string element.
+// Otherwise, a *bson.TypeError is returned.
+func (raw Raw) String() (s string, err error) {
+	if raw.Kind != ElementString {
+		return "", &TypeError{Type: reflect.TypeOf(""), Kind: raw.Kind}
+	}
+	defer handleErr(&err)
+	return newDecoder(raw.Data).readStr(), nil
+}
+
+// Int64 returns the value of raw, which must be an int32 or int64 element.
+// Otherwise, a *bson.TypeError is returned.
+func (raw Raw) Int64() (i int64, err error) {
+	defer handleErr(&err)
+	switch raw.Kind {
+	case ElementInt32:
+		return int64(newDecoder(raw.Data).readInt32()), nil
+	case ElementInt64:
+		return newDecoder(raw.Data).readInt64(), nil
+	}
+	return 0, &TypeError{Type: reflect.TypeOf(int64(0)), Kind: raw.Kind}
+}
+
+// ObjectId returns the value of raw, which must be an ObjectId element.
+// Otherwise, a *bson.TypeError is returned.
+func (raw Raw) ObjectId() (id ObjectId, err error) {
+	if raw.Kind != ElementObjectId {
+		return "", &TypeError{Type: typeObjectId, Kind: raw.Kind}
+	}
+	defer handleErr(&err)
+	return ObjectId(newDecoder(raw.Data).readBytes(12)), nil
+}
+
+// Document returns the elements of raw, which must be a document. As with
+// Lookup, a zero Kind is taken to mean a document. Otherwise, a
+// *bson.TypeError is returned.
+func (raw Raw) Document() (RawD, error) {
+	if raw.Kind != ElementDocument && raw.Kind != 0x00 {
+		return nil, &TypeError{Type: reflect.TypeOf(RawD(nil)), Kind: raw.Kind}
+	}
+	var d RawD
+	if err := Unmarshal(raw.Data, &d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// EqualFlag tweaks the comparison made by EqualWith.
+type EqualFlag int
+
+const (
+	// EqualNumeric has numeric values of different kinds compare equal
+	// if they represent the same number, such as int32(1), int64(1)
+	// and float64(1).
+	EqualNumeric EqualFlag = 1 << iota
+
+	// EqualOrdered has the order of elements within documents matter,
+	// as it does for bson.D values. Array elements are always ordered.
+	EqualOrdered
+)
+
+// Equal reports whether a and b hold equal BSON documents, ignoring the
+// order of the elements within documents as a bson.M would. Numeric
+// values must also be of the same kind to be equal. Corrupted documents
+// are never equal.
+//
+// See EqualWith for other ways of comparing documents.
+func Equal(a, b []byte) bool {
+	return EqualWith(a, b, 0)
+}
+
+// EqualWith reports whether a and b hold equal BSON documents, as Equal
+// does but with the comparison tweaked by flags.
+func EqualWith(a, b []byte, flags EqualFlag) (equal bool) {
+	var err error
+	defer func() {
+		if err != nil {
+			equal = false
+		}
+	}()
+	defer handleErr(&err)
+	return equalDocs(Raw{Kind: ElementDocument, Data: a}, Raw{Kind: ElementDocument, Data: b}, flags, 1)
+}
+
+// equalDocs compares the documents or arrays a and b, found at the given
+// nesting depth.
+func equalDocs(a, b Raw, flags EqualFlag, depth int) bool {
+	checkDepth(depth)
+	// Arrays are documents with the indexes as names.
+	var da, db RawD
+	if err := Unmarshal(a.Data, &da); err != nil {
+		panic(err)
+	}
+	if err := Unmarshal(b.Data, &db); err != nil {
+		panic(err)
+	}
+	if len(da) != len(db) {
+		return false
+	}
+	if a.Kind == ElementArray || flags&EqualOrdered != 0 {
+		for i := range da {
+			if da[i].Name != db[i].Name || !equalValues(da[i].Value, db[i].Value, flags, depth) {
+				return false
+			}
+		}
+		return true
+	}
+	mb := make(map[string]Raw, len(db))
+	for _, elem := range db {
+		mb[elem.Name] = elem.Value
+	}
+	if len(mb) != len(db) {
+		// Duplicated names can't be matched unordered.
+		return equalDocs(a, b, flags|EqualOrdered, depth)
+	}
+	for _, elem := range da {
+		value, ok := mb[elem.Name]
+		if !ok || !equalValues(elem.Value, value, flags, depth) {
+			return false
+		}
+	}
+	return true
+}
+
+func equalValues(a, b Raw, flags EqualFlag, depth int) bool {
+	if flags&EqualNumeric != 0 && isNumericElement(a.Kind) && isNumericElement(b.Kind) {
+		return equalNumbers(a, b)
+	}
+	if a.Kind != b.Kind {
+		return false
+	}
+	switch a.Kind {
+	case ElementDocument, ElementArray:
+		return equalDocs(a, b, flags, depth+1)
+	case ElementDouble:
+		return equalNumbers(a, b)
+	}
+	var va, vb any
+	if err := a.Unmarshal(&va); err != nil {
+		panic(err)
+	}
+	if err := b.Unmarshal(&vb); err != nil {
+		panic(err)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+func isNumericElement(kind byte) bool {
+	return kind == ElementDouble || kind == ElementInt32 || kind == ElementInt64
+}
+
+// equalNumbers reports whether the numeric values a and b are equal,
+// comparing integers exactly even when a float64 can't hold them.
+func equalNumbers(a, b Raw) bool {
+	if a.Kind == ElementDouble && b.Kind == ElementDouble {
+		fa, fb := newDecoder(a.Data).readFloat64(), newDecoder(b.Data).readFloat64()
+		return fa == fb || fa != fa && fb != fb // NaNs are all alike.
+	}
+	if a.Kind == ElementDouble {
+		a, b = b, a
+	}
+	i, err := a.Int64()
+	if err != nil {
+		panic(err)
+	}
+	if b.Kind != ElementDouble {
+		j, err := b.Int64()
+		if err != nil {
+			panic(err)
+		}
+		return i == j
+	}
+	f := newDecoder(b.Data).readFloat64()
+	return f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 && int64(f) == i
+}
+
 type TypeError struct {
 	Type reflect.Type
 	Kind byte
@@ -614,17 +1443,118 @@ type fieldInfo struct {
 	OmitEmpty bool
 	MinSize   bool
 	Inline    []int
+	Range     *fieldRange
+	Enum      *fieldEnum
+	Set       bool
+	RawAlso   []int
+	Duration  time.Duration // Unit of a duration field, if set
 }
 
-var structMap = make(map[reflect.Type]*structInfo)
-var structMapMutex sync.RWMutex
+// durationUnits maps the units accepted by the duration tag option to
+// their durations.
+var durationUnits = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
 
-type externalPanic string
+// isSetType returns whether t may be used with the set tag flag.
+func isSetType(t reflect.Type) bool {
+	if t.Kind() != reflect.Map {
+		return false
+	}
+	switch elem := t.Elem(); elem.Kind() {
+	case reflect.Bool:
+	case reflect.Struct:
+		if elem.NumField() != 0 {
+			return false
+		}
+	default:
+		return false
+	}
+	k := t.Key().Kind()
+	return k == reflect.String || isNumericKind(k)
+}
 
-func (e externalPanic) String() string {
-	return string(e)
+// fieldRange holds the bounds a numeric field must respect when
+// unmarshalled, as defined via the min and max tag flags.
+type fieldRange struct {
+	Min, Max float64
 }
 
+// check panics if the numeric value held by field is out of range.
+func (r *fieldRange) check(key string, field reflect.Value) {
+	for field.Kind() == reflect.Ptr {
+		if field.IsNil() {
+			return
+		}
+		field = field.Elem()
+	}
+	var f float64
+	switch field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		f = float64(field.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		f = float64(field.Uint())
+	case reflect.Float32, reflect.Float64:
+		f = field.Float()
+	default:
+		return
+	}
+	if math.IsNaN(f) {
+		panic(fmt.Sprintf("Value NaN for key %s is out of range", key))
+	}
+	if f < r.Min {
+		panic(fmt.Sprintf("Value %v for key %s is below the minimum of %v", field.Interface(), key, r.Min))
+	}
+	if f > r.Max {
+		panic(fmt.Sprintf("Value %v for key %s is above the maximum of %v", field.Interface(), key, r.Max))
+	}
+}
+
+// fieldEnum holds the values a string field may take when unmarshalled,
+// as defined via the enum tag flag.
+type fieldEnum struct {
+	Values    []string
+	OmitEmpty bool
+}
+
+// check panics if the string value held by field isn't one of the
+// allowed values.
+func (e *fieldEnum) check(key string, field reflect.Value) {
+	for field.Kind() == reflect.Ptr {
+		if field.IsNil() {
+			return
+		}
+		field = field.Elem()
+	}
+	if field.Kind() != reflect.String {
+		return
+	}
+	value := field.String()
+	if value == "" && e.OmitEmpty {
+		return
+	}
+	for _, v := range e.Values {
+		if value == v {
+			return
+		}
+	}
+	panic(fmt.Sprintf("Value %q for key %s is not one of %s", value, key, strings.Join(e.Values, "|")))
+}
+
+func isNumericKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+var structMap = make(map[reflect.Type]*structInfo)
+var structMapMutex sync.RWMutex
+
 func getStructInfo(st reflect.Type) (*structInfo, error) {
 	structMapMutex.RLock()
 	sinfo, found := structMap[st]
@@ -636,6 +1566,7 @@ func getStructInfo(st reflect.Type) (*structInfo, error) {
 	fieldsMap := make(map[string]fieldInfo)
 	fieldsList := make([]fieldInfo, 0, n)
 	inlineMap := -1
+	rawTargets := make(map[int]bool)
 	for i := 0; i != n; i++ {
 		field := st.Field(i)
 		if field.PkgPath != "" && !field.Anonymous {
@@ -652,6 +1583,7 @@ func getStructInfo(st reflect.Type) (*structInfo, error) {
 			continue
 		}
 
+		fullTag := tag
 		inline := false
 		fields := strings.Split(tag, ",")
 		if len(fields) > 1 {
@@ -663,14 +1595,91 @@ func getStructInfo(st reflect.Type) (*structInfo, error) {
 					info.MinSize = true
 				case "inline":
 					inline = true
+				case "set":
+					info.Set = true
 				default:
-					msg := fmt.Sprintf("Unsupported flag %q in tag %q of type %s", flag, tag, st)
-					panic(externalPanic(msg))
+					if name, value, ok := strings.Cut(flag, "="); ok && name == "rawalso" {
+						target, found := st.FieldByName(value)
+						if !found || len(target.Index) != 1 || target.PkgPath != "" || target.Type != typeRaw || target.Index[0] == i {
+							return nil, fmt.Errorf("Option rawalso needs an exported bson.Raw field in the same struct in tag %q of type %s", tag, st)
+						}
+						info.RawAlso = target.Index
+						rawTargets[target.Index[0]] = true
+						continue
+					}
+					if name, value, ok := strings.Cut(flag, "="); ok && name == "duration" {
+						unit, ok := durationUnits[value]
+						if !ok {
+							return nil, fmt.Errorf("Invalid duration unit %q in tag %q of type %s", value, tag, st)
+						}
+						info.Duration = unit
+						continue
+					}
+					if name, value, ok := strings.Cut(flag, "="); ok && name == "enum" {
+						if value == "" {
+							return nil, fmt.Errorf("Invalid enum value %q in tag %q of type %s", value, tag, st)
+						}
+						info.Enum = &fieldEnum{Values: strings.Split(value, "|")}
+						continue
+					}
+					if name, value, ok := strings.Cut(flag, "="); ok && (name == "min" || name == "max") {
+						bound, err := strconv.ParseFloat(value, 64)
+						if err != nil || math.IsNaN(bound) {
+							return nil, fmt.Errorf("Invalid %s value %q in tag %q of type %s", name, value, tag, st)
+						}
+						if info.Range == nil {
+							info.Range = &fieldRange{Min: math.Inf(-1), Max: math.Inf(1)}
+						}
+						if name == "min" {
+							info.Range.Min = bound
+						} else {
+							info.Range.Max = bound
+						}
+						continue
+					}
+					return nil, fmt.Errorf("Unsupported flag %q in tag %q of type %s", flag, tag, st)
 				}
 			}
 			tag = fields[0]
 		}
 
+		if info.Range != nil {
+			ft := field.Type
+			for ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if !isNumericKind(ft.Kind()) {
+				return nil, fmt.Errorf("Options min and max need a numeric field in tag %q of type %s", fullTag, st)
+			}
+			if info.Range.Min > info.Range.Max {
+				return nil, fmt.Errorf("Invalid range with min above max in tag %q of type %s", fullTag, st)
+			}
+		}
+
+		if info.Enum != nil {
+			ft := field.Type
+			for ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() != reflect.String {
+				return nil, fmt.Errorf("Option enum needs a string field in tag %q of type %s", fullTag, st)
+			}
+			info.Enum.OmitEmpty = info.OmitEmpty
+		}
+
+		if info.Duration != 0 {
+			if field.Type != typeDuration {
+				return nil, fmt.Errorf("Option duration needs a time.Duration field in tag %q of type %s", fullTag, st)
+			}
+			if info.Range != nil {
+				return nil, fmt.Errorf("Options min and max can't be combined with duration in tag %q of type %s", fullTag, st)
+			}
+		}
+
+		if info.Set && !isSetType(field.Type) {
+			return nil, fmt.Errorf("Option ,set needs a map[T]struct{} or map[T]bool field in tag %q of type %s", fullTag, st)
+		}
+
 		if inline {
 			switch field.Type.Kind() {
 			case reflect.Map:
@@ -696,6 +1705,9 @@ func getStructInfo(st reflect.Type) (*structInfo, error) {
 					} else {
 						finfo.Inline = append([]int{i}, finfo.Inline...)
 					}
+					if finfo.RawAlso != nil {
+						finfo.RawAlso = append([]int{i}, finfo.RawAlso...)
+					}
 					fieldsMap[finfo.Key] = finfo
 					fieldsList = append(fieldsList, finfo)
 				}
@@ -719,6 +1731,18 @@ func getStructInfo(st reflect.Type) (*structInfo, error) {
 		fieldsList = append(fieldsList, info)
 		fieldsMap[info.Key] = info
 	}
+	if len(rawTargets) > 0 {
+		// Fields receiving raw elements via rawalso have no key of their own.
+		kept := fieldsList[:0]
+		for _, info := range fieldsList {
+			if info.Inline == nil && rawTargets[info.Num] {
+				delete(fieldsMap, info.Key)
+				continue
+			}
+			kept = append(kept, info)
+		}
+		fieldsList = kept
+	}
 	sinfo = &structInfo{
 		FieldsMap:  fieldsMap,
 		FieldsList: fieldsList,
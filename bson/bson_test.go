@@ -33,11 +33,14 @@ import (
 	"encoding/json"
 	"encoding/xml"
 	"errors"
+	"fmt"
+	"math"
 	"net/url"
 	"reflect"
 	"strings"
 	"testing"
 	"time"
+	"unsafe"
 
 	. "gopkg.in/check.v1"
 	"gopkg.in/yaml.v2"
@@ -212,6 +215,161 @@ func (s *S) TestUnmarshalRawAllItems(c *C) {
 	}
 }
 
+func (s *S) TestRawLookupAllItems(c *C) {
+	for i, item := range allItems {
+		// Looking up an element after the item requires skipping it.
+		raw := bson.Raw{Kind: 0x03, Data: []byte(wrapInDoc(item.data + "\x10z\x00\x07\x00\x00\x00"))}
+		elem, ok := raw.Lookup("z")
+		c.Assert(ok, Equals, true, Commentf("Failed on item %d: %#v", i, item))
+		c.Assert(elem, DeepEquals, bson.Raw{Kind: 0x10, Data: []byte("\x07\x00\x00\x00")})
+		if len(item.data) > 0 {
+			elem, ok = raw.Lookup("_")
+			c.Assert(ok, Equals, true)
+			c.Assert(elem, DeepEquals, bson.Raw{Kind: item.data[0], Data: []byte(item.data[3:])})
+		}
+	}
+}
+
+func (s *S) TestRawTypedValues(c *C) {
+	id := bson.ObjectIdHex("0102030405060708090a0b0c")
+	data, err := bson.Marshal(bson.D{{"s", "str"}, {"i", 42}, {"l", int64(1) << 40}, {"o", id}, {"d", bson.D{{"x", 1}}}})
+	c.Assert(err, IsNil)
+	raw := bson.Raw{Kind: bson.ElementDocument, Data: data}
+	get := func(name string) bson.Raw {
+		elem, ok := raw.Lookup(name)
+		c.Assert(ok, Equals, true)
+		return elem
+	}
+
+	str, err := get("s").String()
+	c.Assert(err, IsNil)
+	c.Assert(str, Equals, "str")
+	i, err := get("i").Int64()
+	c.Assert(err, IsNil)
+	c.Assert(i, Equals, int64(42))
+	i, err = get("l").Int64()
+	c.Assert(err, IsNil)
+	c.Assert(i, Equals, int64(1)<<40)
+	oid, err := get("o").ObjectId()
+	c.Assert(err, IsNil)
+	c.Assert(oid, Equals, id)
+	doc, err := get("d").Document()
+	c.Assert(err, IsNil)
+	c.Assert(doc, HasLen, 1)
+	c.Assert(doc[0].Name, Equals, "x")
+	doc, err = bson.Raw{Data: data}.Document()
+	c.Assert(err, IsNil)
+	c.Assert(doc, HasLen, 5)
+
+	_, err = get("i").String()
+	c.Assert(err, ErrorMatches, "BSON kind 0x10 isn't compatible with type string")
+	_, err = get("s").Int64()
+	c.Assert(err, ErrorMatches, "BSON kind 0x02 isn't compatible with type int64")
+	_, err = get("s").ObjectId()
+	c.Assert(err, ErrorMatches, "BSON kind 0x02 isn't compatible with type bson.ObjectId")
+	_, err = get("s").Document()
+	c.Assert(err, ErrorMatches, "BSON kind 0x02 isn't compatible with type bson.RawD")
+
+	// Truncated data is reported rather than panicking.
+	_, err = bson.Raw{Kind: bson.ElementString, Data: []byte("\x05\x00\x00\x00ab")}.String()
+	c.Assert(err, NotNil)
+	_, err = bson.Raw{Kind: bson.ElementObjectId, Data: []byte("\x01\x02")}.ObjectId()
+	c.Assert(err, NotNil)
+}
+
+func (s *S) TestEqual(c *C) {
+	marshal := func(v any) []byte {
+		data, err := bson.Marshal(v)
+		c.Assert(err, IsNil)
+		return data
+	}
+	ab := marshal(bson.D{{"a", 1}, {"b", bson.D{{"c", "x"}, {"d", []any{1, 2}}}}})
+	ba := marshal(bson.D{{"b", bson.D{{"d", []any{1, 2}}, {"c", "x"}}}, {"a", 1}})
+
+	c.Assert(bson.Equal(ab, ab), Equals, true)
+	c.Assert(bson.Equal(ab, ba), Equals, true)
+	c.Assert(bson.EqualWith(ab, ba, bson.EqualOrdered), Equals, false)
+	c.Assert(bson.EqualWith(ab, marshal(struct {
+		A int
+		B bson.D
+	}{1, bson.D{{"c", "x"}, {"d", []any{1, 2}}}}), bson.EqualOrdered), Equals, true)
+
+	// Arrays are always ordered.
+	c.Assert(bson.Equal(marshal(bson.M{"a": []any{1, 2}}), marshal(bson.M{"a": []any{2, 1}})), Equals, false)
+
+	for _, item := range []struct {
+		a, b    any
+		equal   bool
+		numeric bool
+	}{
+		{bson.M{"a": 1}, bson.M{"a": 1}, true, true},
+		{bson.M{"a": 1}, bson.M{"a": 2}, false, false},
+		{bson.M{"a": 1}, bson.M{"b": 1}, false, false},
+		{bson.M{"a": 1}, bson.M{"a": 1, "b": 1}, false, false},
+		{bson.M{"a": 1}, bson.M{"a": int64(1)}, false, true},
+		{bson.M{"a": 1}, bson.M{"a": 1.0}, false, true},
+		{bson.M{"a": 1}, bson.M{"a": 1.5}, false, false},
+		{bson.M{"a": []any{int64(2)}}, bson.M{"a": []any{2.0}}, false, true},
+		{bson.M{"a": int64(1)<<62 + 1}, bson.M{"a": float64(int64(1)<<62 + 1)}, false, false},
+		{bson.M{"a": 0.0}, bson.M{"a": math.Copysign(0, -1)}, true, true},
+		{bson.M{"a": math.NaN()}, bson.M{"a": math.NaN()}, true, true},
+		{bson.M{"a": 1}, bson.M{"a": "1"}, false, false},
+		{bson.M{"a": "x"}, bson.M{"a": "x"}, true, true},
+		{bson.M{"a": []byte("x")}, bson.M{"a": "x"}, false, false},
+		{bson.M{"a": bson.M{}}, bson.M{"a": []any{}}, false, false},
+		{bson.M{"a": nil}, bson.M{"a": bson.Undefined}, false, false},
+		{bson.M{"a": time.Unix(1e9, 0)}, bson.M{"a": time.Unix(1e9, 0).UTC()}, true, true},
+		{bson.M{"a": bson.JavaScript{"f", bson.M{"x": 1, "y": 2}}}, bson.M{"a": bson.JavaScript{"f", bson.D{{"y", 2}, {"x", 1}}}}, true, true},
+	} {
+		a, b := marshal(item.a), marshal(item.b)
+		c.Assert(bson.Equal(a, b), Equals, item.equal, Commentf("%#v == %#v", item.a, item.b))
+		c.Assert(bson.Equal(b, a), Equals, item.equal, Commentf("%#v == %#v", item.b, item.a))
+		c.Assert(bson.EqualWith(a, b, bson.EqualNumeric), Equals, item.numeric, Commentf("%#v == %#v", item.a, item.b))
+		c.Assert(bson.EqualWith(b, a, bson.EqualNumeric), Equals, item.numeric, Commentf("%#v == %#v", item.b, item.a))
+	}
+
+	// Duplicated names are compared in order.
+	dup := marshal(bson.D{{"a", 1}, {"a", 2}})
+	c.Assert(bson.Equal(dup, dup), Equals, true)
+	c.Assert(bson.Equal(dup, marshal(bson.D{{"a", 2}, {"a", 1}})), Equals, false)
+	c.Assert(bson.Equal(dup, marshal(bson.D{{"a", 1}, {"b", 2}})), Equals, false)
+
+	// Corrupted documents are never equal.
+	c.Assert(bson.Equal(ab[:len(ab)-1], ab[:len(ab)-1]), Equals, false)
+	c.Assert(bson.Equal(nil, nil), Equals, false)
+}
+
+func (s *S) TestRawLookup(c *C) {
+	data, err := bson.Marshal(bson.M{"a": bson.M{"b": []any{"x", bson.M{"c": 42}}}, "d": "e"})
+	c.Assert(err, IsNil)
+	raw := bson.Raw{Kind: 0x03, Data: data}
+
+	elem, ok := raw.Lookup("a", "b", "1", "c")
+	c.Assert(ok, Equals, true)
+	var n int
+	c.Assert(elem.Unmarshal(&n), IsNil)
+	c.Assert(n, Equals, 42)
+
+	elem, ok = raw.Lookup("d")
+	c.Assert(ok, Equals, true)
+	c.Assert(elem.Kind, Equals, byte(0x02))
+
+	elem, ok = raw.Lookup()
+	c.Assert(ok, Equals, true)
+	c.Assert(elem, DeepEquals, raw)
+
+	for _, path := range [][]string{{"x"}, {"a", "x"}, {"d", "x"}, {"a", "b", "2"}} {
+		_, ok = raw.Lookup(path...)
+		c.Assert(ok, Equals, false, Commentf("Path: %v", path))
+	}
+
+	// Corrupted documents are not found rather than panicking.
+	_, ok = bson.Raw{Kind: 0x03, Data: data[:len(data)-3]}.Lookup("d")
+	c.Assert(ok, Equals, false)
+	_, ok = bson.Raw{Kind: 0x03, Data: []byte("\x0c\x00\x00\x00\x02a\x00\xff\x00\x00\x00\x00")}.Lookup("b")
+	c.Assert(ok, Equals, false)
+}
+
 func (s *S) TestUnmarshalRawIncompatible(c *C) {
 	raw := bson.Raw{Kind: 0x08, Data: []byte{0x01}} // true
 	err := raw.Unmarshal(&struct{}{})
@@ -238,6 +396,37 @@ func (s *S) TestUnmarshalZeroesMap(c *C) {
 	c.Assert(m, DeepEquals, bson.M{"b": 2})
 }
 
+func (s *S) TestUnmarshalMerge(c *C) {
+	base, err := bson.Marshal(bson.M{"a": 1, "b": bson.M{"x": 1, "y": 2}})
+	c.Assert(err, IsNil)
+	layer, err := bson.Marshal(bson.M{"b": bson.M{"x": 3}, "c": 4})
+	c.Assert(err, IsNil)
+
+	m := bson.M{"z": 0}
+	c.Assert(bson.UnmarshalMerge(base, &m), IsNil)
+	c.Assert(bson.UnmarshalMerge(layer, &m), IsNil)
+	c.Assert(m, DeepEquals, bson.M{"z": 0, "a": 1, "b": bson.M{"x": 3}, "c": 4})
+
+	flat, err := bson.Marshal(bson.M{"a": 2})
+	c.Assert(err, IsNil)
+	m2 := map[string]int{"z": 0, "a": 1}
+	c.Assert(bson.UnmarshalMerge(flat, m2), IsNil)
+	c.Assert(m2, DeepEquals, map[string]int{"z": 0, "a": 2})
+
+	type config struct {
+		A     int
+		C     int
+		Extra bson.M `bson:",inline"`
+	}
+	cfg := config{A: 7, Extra: bson.M{"z": 0}}
+	c.Assert(bson.UnmarshalMerge(layer, &cfg), IsNil)
+	c.Assert(cfg, DeepEquals, config{A: 7, C: 4, Extra: bson.M{"z": 0, "b": bson.M{"x": 3}}})
+
+	// Unmarshal still resets the value.
+	c.Assert(bson.Unmarshal(layer, &cfg), IsNil)
+	c.Assert(cfg, DeepEquals, config{C: 4, Extra: bson.M{"b": bson.M{"x": 3}}})
+}
+
 func (s *S) TestUnmarshalNonNilInterface(c *C) {
 	data, err := bson.Marshal(bson.M{"b": 2})
 	c.Assert(err, IsNil)
@@ -535,6 +724,8 @@ var unmarshalItems = []testItemType{
 	// Ordered document.
 	{obj: &struct{ bson.D }{D: bson.D{{Name: "a", Value: nil}, {Name: "c", Value: nil}, {Name: "b", Value: nil}, {Name: "d", Value: true}}},
 		data: "\x03d\x00" + wrapInDoc("\x0Aa\x00\x0Ac\x00\x0Ab\x00\x08d\x00\x01")},
+	{obj: &struct{ V bson.D }{V: bson.D{{Name: "b", Value: bson.D{{Name: "d", Value: nil}, {Name: "c", Value: true}}}, {Name: "a", Value: nil}}},
+		data: "\x03v\x00" + wrapInDoc("\x03b\x00"+wrapInDoc("\x0Ad\x00\x08c\x00\x01")+"\x0Aa\x00")},
 
 	// Raw document.
 	{obj: &bson.Raw{Kind: 0x03, Data: []byte(wrapInDoc("\x10byte\x00\x08\x00\x00\x00"))},
@@ -557,12 +748,1141 @@ var unmarshalItems = []testItemType{
 		data: "\x03\x66\x6f\x6f\x00\x05\x00\x00\x00\x00"},
 }
 
+func (s *S) TestSetMarshalObserver(c *C) {
+	type observed struct {
+		t    reflect.Type
+		size int
+	}
+	var seen []observed
+	bson.SetMarshalObserver(func(t reflect.Type, size int) {
+		seen = append(seen, observed{t, size})
+	})
+	defer bson.SetMarshalObserver(nil)
+
+	type doc struct {
+		A int
+		B bson.M
+	}
+	data1, err := bson.Marshal(&doc{A: 1, B: bson.M{"c": "d"}})
+	c.Assert(err, IsNil)
+	data2, err := bson.Marshal(bson.M{"a": 1})
+	c.Assert(err, IsNil)
+
+	// Failed marshalling is not observed.
+	_, err = bson.Marshal(bson.M{"a": func() {}})
+	c.Assert(err, NotNil)
+
+	c.Assert(seen, HasLen, 2)
+	c.Assert(seen[0].t, Equals, reflect.TypeOf(&doc{}))
+	c.Assert(seen[0].size, Equals, len(data1))
+	c.Assert(seen[1].t, Equals, reflect.TypeOf(bson.M{}))
+	c.Assert(seen[1].size, Equals, len(data2))
+
+	bson.SetMarshalObserver(nil)
+	_, err = bson.Marshal(bson.M{"a": 1})
+	c.Assert(err, IsNil)
+	c.Assert(seen, HasLen, 2)
+}
+
+func BenchmarkMarshalWithoutObserver(b *testing.B) {
+	doc := bson.M{"a": 1, "b": "c"}
+	for i := 0; i < b.N; i++ {
+		bson.Marshal(doc)
+	}
+}
+
+type computedUser struct {
+	Name  string
+	roles []string
+}
+
+func (u computedUser) Roles() []string { return u.roles }
+
+func (u computedUser) Perms() map[string]bool {
+	perms := make(map[string]bool)
+	for _, role := range u.roles {
+		perms[role] = true
+	}
+	return perms
+}
+
+func (u computedUser) Grant(role string) {}
+
+func (u *computedUser) Reset() {}
+
+// Registrations are global, so they're done once however many times
+// the tests run.
+var computedUserErrs = []error{
+	bson.RegisterComputedField(computedUser{}, "roles", "Roles"),
+	bson.RegisterComputedField(&computedUser{}, "perms", "Perms"),
+}
+
+func (s *S) TestRegisterComputedField(c *C) {
+	c.Assert(computedUserErrs, DeepEquals, []error{nil, nil})
+
+	data, err := bson.Marshal(computedUser{Name: "joe", roles: []string{"admin", "dev"}})
+	c.Assert(err, IsNil)
+	var doc bson.D
+	c.Assert(bson.Unmarshal(data, &doc), IsNil)
+	c.Assert(doc, HasLen, 3)
+	c.Assert(doc[:2], DeepEquals, bson.D{
+		{Name: "name", Value: "joe"},
+		{Name: "roles", Value: []any{"admin", "dev"}},
+	})
+	c.Assert(doc[2].Name, Equals, "perms")
+	var perms struct{ Perms map[string]bool }
+	c.Assert(bson.Unmarshal(data, &perms), IsNil)
+	c.Assert(perms.Perms, DeepEquals, map[string]bool{"admin": true, "dev": true})
+
+	// The roles are sent as a BSON array.
+	raw, ok := bson.Raw{Kind: 0x03, Data: data}.Lookup("roles")
+	c.Assert(ok, Equals, true)
+	c.Assert(raw.Kind, Equals, byte(0x04))
+
+	// Computed fields are ignored when unmarshalling.
+	var u computedUser
+	c.Assert(bson.Unmarshal(data, &u), IsNil)
+	c.Assert(u, DeepEquals, computedUser{Name: "joe"})
+
+	bad := []struct {
+		value       any
+		key, method string
+		msg         string
+	}{
+		{computedUser{}, "roles", "Roles", `computed field "roles" of type bson_test.computedUser is already registered`},
+		{computedUser{}, "name", "Roles", `computed field "name" of type bson_test.computedUser conflicts with struct field`},
+		{computedUser{}, "other", "Missing", "type bson_test.computedUser has no method Missing with a value receiver"},
+		{computedUser{}, "other", "Reset", "type bson_test.computedUser has no method Reset with a value receiver"},
+		{computedUser{}, "other", "Grant", "method Grant of type bson_test.computedUser must take no arguments and return a single value"},
+		{42, "other", "Roles", `computed field "other" must be registered on a struct type, not int`},
+	}
+	for _, b := range bad {
+		err := bson.RegisterComputedField(b.value, b.key, b.method)
+		c.Assert(err, ErrorMatches, b.msg)
+	}
+}
+
+type polyShape interface {
+	Area() float64
+}
+
+type polyCircle struct {
+	Kind   string `bson:"shapeKind"`
+	Radius float64
+}
+
+func (p polyCircle) Area() float64 { return 3 * p.Radius * p.Radius }
+
+type polySquare struct {
+	Kind string `bson:"shapeKind"`
+	Side float64
+}
+
+func (p *polySquare) Area() float64 { return p.Side * p.Side }
+
+type polyLabel struct {
+	Text string
+}
+
+func (p *polyLabel) SetBSON(raw bson.Raw) error {
+	var doc struct{ Label string }
+	if err := raw.Unmarshal(&doc); err != nil {
+		return err
+	}
+	p.Text = "label: " + doc.Label
+	return nil
+}
+
+// Registrations are global, so they're done once however many times
+// the tests run.
+var polymorphicErrs = []error{
+	bson.RegisterPolymorphic("shapeKind", map[string]reflect.Type{
+		"circle": reflect.TypeOf(polyCircle{}),
+		"square": reflect.TypeOf(polySquare{}),
+	}),
+	bson.RegisterPolymorphic("shapeKind", map[string]reflect.Type{
+		"label": reflect.TypeOf(&polyLabel{}),
+	}),
+}
+
+func (s *S) TestRegisterPolymorphic(c *C) {
+	c.Assert(polymorphicErrs, DeepEquals, []error{nil, nil})
+
+	data, err := bson.Marshal(bson.M{"shapes": []any{
+		polyCircle{Kind: "circle", Radius: 2},
+		&polySquare{Kind: "square", Side: 3},
+	}})
+	c.Assert(err, IsNil)
+
+	var doc struct{ Shapes []polyShape }
+	c.Assert(bson.Unmarshal(data, &doc), IsNil)
+	c.Assert(doc.Shapes, DeepEquals, []polyShape{
+		polyCircle{Kind: "circle", Radius: 2},
+		&polySquare{Kind: "square", Side: 3},
+	})
+
+	// Empty interfaces work as well, and setters are used.
+	data, err = bson.Marshal(bson.M{
+		"a": bson.M{"shapeKind": "circle", "radius": 1},
+		"b": bson.M{"shapeKind": "label", "label": "hi"},
+		"c": bson.M{"shapeKind": "triangle"},
+		"d": bson.M{"other": 1},
+	})
+	c.Assert(err, IsNil)
+	var m bson.M
+	c.Assert(bson.Unmarshal(data, &m), IsNil)
+	c.Assert(m, DeepEquals, bson.M{
+		"a": polyCircle{Kind: "circle", Radius: 1},
+		"b": &polyLabel{Text: "label: hi"},
+		"c": bson.M{"shapeKind": "triangle"},
+		"d": bson.M{"other": 1},
+	})
+
+	// Types not implementing the interface are left out, so the
+	// document is unmarshalled as usual, which fails in this case.
+	data, err = bson.Marshal(bson.M{"shape": bson.M{"shapeKind": "label"}})
+	c.Assert(err, IsNil)
+	var one struct{ Shape polyShape }
+	c.Assert(bson.Unmarshal(data, &one), ErrorMatches, "reflect.Set: value of type bson.M is not assignable to type bson_test.polyShape")
+
+	bad := []struct {
+		field   string
+		mapping map[string]reflect.Type
+		msg     string
+	}{
+		{"", nil, "polymorphic discriminator field must not be empty"},
+		{"shapeKind", map[string]reflect.Type{"circle": reflect.TypeOf(polyLabel{})}, `polymorphic type for shapeKind "circle" is already registered`},
+		{"shapeKind", map[string]reflect.Type{"x": nil}, `polymorphic type for shapeKind "x" must be a concrete type, not <nil>`},
+		{"shapeKind", map[string]reflect.Type{"x": reflect.TypeOf((*polyShape)(nil)).Elem()}, `polymorphic type for shapeKind "x" must be a concrete type, not bson_test.polyShape`},
+	}
+	for _, b := range bad {
+		err := bson.RegisterPolymorphic(b.field, b.mapping)
+		c.Assert(err, ErrorMatches, b.msg)
+	}
+}
+
+func (s *S) TestMarshalAs(c *C) {
+	data, err := bson.Marshal(bson.M{"n": bson.As(0x12, 1)})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x12n\x00\x01\x00\x00\x00\x00\x00\x00\x00"))
+
+	data, err = bson.Marshal(bson.M{"s": bson.As(0x0E, "sym")})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x0Es\x00\x04\x00\x00\x00sym\x00"))
+	var m bson.M
+	c.Assert(bson.Unmarshal(data, &m), IsNil)
+	c.Assert(m["s"], Equals, bson.Symbol("sym"))
+
+	data, err = bson.Marshal(bson.D{{Name: "b", Value: bson.As(0x05, []byte("ab"))}, {Name: "c", Value: bson.As(0x05, "cd")}})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x05b\x00\x02\x00\x00\x00\x00ab\x05c\x00\x02\x00\x00\x00\x00cd"))
+
+	data, err = bson.Marshal(bson.M{"i": bson.As(0x10, int64(7)), "f": bson.As(0x01, uint8(2))})
+	c.Assert(err, IsNil)
+	m = nil
+	c.Assert(bson.Unmarshal(data, &m), IsNil)
+	c.Assert(m["i"], Equals, 7)
+	c.Assert(m["f"], Equals, 2.0)
+
+	_, err = bson.Marshal(bson.M{"a": bson.As(0x12, "abc")})
+	c.Assert(err, ErrorMatches, `can't marshal "abc" as BSON kind 0x12 for key a`)
+	_, err = bson.Marshal(bson.M{"a": bson.As(0x10, int64(1)<<40)})
+	c.Assert(err, ErrorMatches, "can't marshal 1099511627776 as BSON kind 0x10 for key a")
+	_, err = bson.Marshal(bson.M{"a": bson.As(0x07, "abc")})
+	c.Assert(err, ErrorMatches, `can't marshal "abc" as BSON kind 0x07 for key a`)
+}
+
+func (s *S) TestMarshalMaxArrayLen(c *C) {
+	bson.SetMarshalMaxArrayLen(3)
+	defer bson.SetMarshalMaxArrayLen(0)
+
+	// Under and at the limit.
+	data, err := bson.Marshal(bson.M{"a": []int{1, 2}, "b": [3]string{"x", "y", "z"}})
+	c.Assert(err, IsNil)
+	var m bson.M
+	c.Assert(bson.Unmarshal(data, &m), IsNil)
+	c.Assert(m["a"], DeepEquals, []any{1, 2})
+
+	// Over the limit.
+	_, err = bson.Marshal(bson.M{"a": []int{1, 2, 3, 4}})
+	c.Assert(err, ErrorMatches, "array exceeds max length 3 for key a")
+	_, err = bson.Marshal(&struct{ V [4]int }{})
+	c.Assert(err, ErrorMatches, "array exceeds max length 3 for key v")
+
+	// Nested arrays are checked as well.
+	_, err = bson.Marshal(bson.M{"a": []any{1, []int{1, 2, 3, 4}}})
+	c.Assert(err, ErrorMatches, "array exceeds max length 3 for key 1")
+	_, err = bson.Marshal(bson.M{"a": bson.M{"b": []any{[]int{1}, []int{1, 2, 3}}}})
+	c.Assert(err, IsNil)
+	_, err = bson.Marshal(bson.M{"a": bson.M{"b": []any{[]int{1}, []int{1, 2, 3}, nil, nil}}})
+	c.Assert(err, ErrorMatches, "array exceeds max length 3 for key b")
+
+	// Binary data and ordered documents are not arrays.
+	_, err = bson.Marshal(bson.M{"a": []byte("abcdef")})
+	c.Assert(err, IsNil)
+	_, err = bson.Marshal(bson.D{{Name: "a", Value: 1}, {Name: "b", Value: 2}, {Name: "c", Value: 3}, {Name: "d", Value: 4}})
+	c.Assert(err, IsNil)
+
+	// No limit.
+	bson.SetMarshalMaxArrayLen(0)
+	_, err = bson.Marshal(bson.M{"a": make([]int, 100)})
+	c.Assert(err, IsNil)
+}
+
+type cyclicNode struct {
+	Name string
+	Next *cyclicNode
+}
+
+// nestedDoc returns depth levels of documents, the outermost included,
+// nested under the key "a" and marshalled by hand.
+func nestedDoc(depth int) []byte {
+	var doc []byte
+	for i := depth; i > 1; i-- {
+		n := 5 + 8*(i-1)
+		doc = append(doc, byte(n), byte(n>>8), byte(n>>16), 0, 0x03, 'a', 0)
+	}
+	doc = append(doc, 5, 0, 0, 0, 0)
+	return append(doc, make([]byte, depth-1)...)
+}
+
+func (s *S) TestRejectDeprecated(c *C) {
+	deprecated := []struct {
+		value any
+		name  string
+		kind  byte
+	}{
+		{bson.Undefined, "Undefined", 0x06},
+		{bson.DBPointer{Namespace: "db.c", Id: bson.ObjectId("0123456789ab")}, "DBPointer", 0x0C},
+		{bson.Symbol("sym"), "Symbol", 0x0E},
+		{bson.As(0x0E, "sym"), "Symbol", 0x0E},
+	}
+	datas := make([][]byte, len(deprecated))
+	for i, item := range deprecated {
+		data, err := bson.Marshal(bson.M{"v": item.value})
+		c.Assert(err, IsNil)
+		datas[i] = data
+	}
+
+	bson.SetRejectDeprecated(true)
+	defer bson.SetRejectDeprecated(false)
+	for i, item := range deprecated {
+		msg := fmt.Sprintf(`deprecated BSON element kind %s \(0x%02X\) rejected`, item.name, item.kind)
+		_, err := bson.Marshal(bson.M{"a": 1, "b": bson.M{"v": item.value}})
+		c.Assert(err, ErrorMatches, msg)
+		_, err = bson.Marshal(bson.M{"v": bson.Raw{Kind: item.kind, Data: datas[i][7 : len(datas[i])-1]}})
+		c.Assert(err, ErrorMatches, msg)
+
+		var m bson.M
+		c.Assert(bson.Unmarshal(datas[i], &m), ErrorMatches, msg)
+		// Elements are rejected even if they'd be skipped.
+		var v struct{ Other int }
+		c.Assert(bson.Unmarshal(datas[i], &v), ErrorMatches, msg)
+	}
+
+	// Other kinds are unaffected.
+	data, err := bson.Marshal(bson.M{"s": "str", "n": nil, "a": []any{1}})
+	c.Assert(err, IsNil)
+	var m bson.M
+	c.Assert(bson.Unmarshal(data, &m), IsNil)
+
+	bson.SetRejectDeprecated(false)
+	for _, data := range datas {
+		c.Assert(bson.Unmarshal(data, &m), IsNil)
+	}
+}
+
+func (s *S) TestMaxDepth(c *C) {
+	// Cyclic values fail rather than overflowing the stack.
+	node := &cyclicNode{Name: "a"}
+	node.Next = node
+	_, err := bson.Marshal(node)
+	c.Assert(err, ErrorMatches, "maximum document nesting depth exceeded")
+	m := bson.M{}
+	m["m"] = m
+	_, err = bson.Marshal(m)
+	c.Assert(err, ErrorMatches, "maximum document nesting depth exceeded")
+	l := []any{nil}
+	l[0] = l
+	_, err = bson.Marshal(bson.M{"l": l})
+	c.Assert(err, ErrorMatches, "maximum document nesting depth exceeded")
+
+	// The default limit is 200 levels, the top-level document included.
+	data := nestedDoc(200)
+	var out bson.M
+	c.Assert(bson.Unmarshal(data, &out), IsNil)
+	redata, err := bson.Marshal(out)
+	c.Assert(err, IsNil)
+	c.Assert(redata, DeepEquals, data)
+	err = bson.Unmarshal(nestedDoc(201), &out)
+	c.Assert(err, ErrorMatches, "maximum document nesting depth exceeded")
+	var raw bson.Raw
+	c.Assert(bson.Unmarshal(nestedDoc(1000), &raw), IsNil)
+
+	// Hostile input can't exhaust the stack either.
+	err = bson.Unmarshal(nestedDoc(100000), &out)
+	c.Assert(err, ErrorMatches, "maximum document nesting depth exceeded")
+
+	bson.SetMaxDepth(2)
+	defer bson.SetMaxDepth(200)
+	_, err = bson.Marshal(bson.M{"a": bson.M{"b": 1}})
+	c.Assert(err, IsNil)
+	_, err = bson.Marshal(bson.M{"a": []any{bson.M{}}})
+	c.Assert(err, ErrorMatches, "maximum document nesting depth exceeded")
+	_, err = bson.Marshal(&cyclicNode{Next: &cyclicNode{Next: &cyclicNode{}}})
+	c.Assert(err, ErrorMatches, "maximum document nesting depth exceeded")
+	c.Assert(bson.Unmarshal(nestedDoc(2), &out), IsNil)
+	err = bson.Unmarshal(nestedDoc(3), &out)
+	c.Assert(err, ErrorMatches, "maximum document nesting depth exceeded")
+
+	// No limit.
+	bson.SetMaxDepth(0)
+	data = nestedDoc(1000)
+	c.Assert(bson.Unmarshal(data, &out), IsNil)
+	redata, err = bson.Marshal(out)
+	c.Assert(err, IsNil)
+	c.Assert(redata, DeepEquals, data)
+}
+
+func (s *S) TestDecodeNumbersAsJSONNumber(c *C) {
+	data, err := bson.Marshal(bson.D{
+		{Name: "i32", Value: int32(42)},
+		{Name: "i64", Value: int64(1) << 60},
+		{Name: "f", Value: 5.05},
+		{Name: "fi", Value: 2.0},
+		{Name: "fe", Value: 1e300},
+		{Name: "a", Value: []any{1, 1.5}},
+		{Name: "d", Value: bson.M{"n": -7}},
+		{Name: "s", Value: "str"},
+	})
+	c.Assert(err, IsNil)
+
+	// Disabled by default.
+	var m bson.M
+	c.Assert(bson.Unmarshal(data, &m), IsNil)
+	c.Assert(m["i32"], Equals, 42)
+	c.Assert(m["f"], Equals, 5.05)
+
+	bson.SetDecodeNumbersAsJSONNumber(true)
+	defer bson.SetDecodeNumbersAsJSONNumber(false)
+
+	m = nil
+	c.Assert(bson.Unmarshal(data, &m), IsNil)
+	c.Assert(m["i32"], Equals, json.Number("42"))
+	c.Assert(m["i64"], Equals, json.Number("1152921504606846976"))
+	c.Assert(m["f"], Equals, json.Number("5.05"))
+	c.Assert(m["fi"], Equals, json.Number("2.0"))
+	c.Assert(m["fe"], Equals, json.Number("1e+300"))
+	c.Assert(m["a"], DeepEquals, []any{json.Number("1"), json.Number("1.5")})
+	c.Assert(m["d"], DeepEquals, bson.M{"n": json.Number("-7")})
+	c.Assert(m["s"], Equals, "str")
+
+	// Integers and floats can still be told apart.
+	_, err = m["fi"].(json.Number).Int64()
+	c.Assert(err, NotNil)
+	f, err := m["fi"].(json.Number).Float64()
+	c.Assert(err, IsNil)
+	c.Assert(f, Equals, 2.0)
+
+	// Concrete targets are unaffected.
+	var v struct {
+		I32 int
+		F   float64
+		FI  any
+	}
+	c.Assert(bson.Unmarshal(data, &v), IsNil)
+	c.Assert(v.I32, Equals, 42)
+	c.Assert(v.F, Equals, 5.05)
+	c.Assert(v.FI, Equals, json.Number("2.0"))
+
+	// And the numbers marshal back into their original types.
+	data2, err := bson.Marshal(bson.D{{Name: "i64", Value: m["i64"]}, {Name: "fi", Value: m["fi"]}})
+	c.Assert(err, IsNil)
+	var back bson.M
+	bson.SetDecodeNumbersAsJSONNumber(false)
+	c.Assert(bson.Unmarshal(data2, &back), IsNil)
+	c.Assert(back["i64"], Equals, int64(1)<<60)
+	c.Assert(back["fi"], Equals, 2.0)
+}
+
+func (s *S) TestSetIdGenerator(c *C) {
+	id, ok := bson.NewId().(bson.ObjectId)
+	c.Assert(ok, Equals, true)
+	c.Assert(id.Valid(), Equals, true)
+	c.Assert(bson.IdGenerator(), IsNil)
+
+	n := byte(0)
+	bson.SetIdGenerator(func() any {
+		n++
+		return bson.Binary{Kind: 0x04, Data: []byte{n, 0, 0, 0, 0, 0, 0x70, 0, 0x80, 0, 0, 0, 0, 0, 0, 0}}
+	})
+	defer bson.SetIdGenerator(nil)
+
+	c.Assert(bson.IdGenerator(), NotNil)
+	c.Assert(bson.NewId(), DeepEquals, bson.Binary{Kind: 0x04, Data: []byte{1, 0, 0, 0, 0, 0, 0x70, 0, 0x80, 0, 0, 0, 0, 0, 0, 0}})
+	c.Assert(bson.NewId().(bson.Binary).Data[0], Equals, byte(2))
+
+	bson.SetIdGenerator(nil)
+	c.Assert(bson.IdGenerator(), IsNil)
+	_, ok = bson.NewId().(bson.ObjectId)
+	c.Assert(ok, Equals, true)
+}
+
+func (s *S) TestNewMongoTimestamp(c *C) {
+	t := time.Unix(12345678, 500)
+	ts := bson.NewMongoTimestamp(t, 42)
+	c.Assert(ts, Equals, bson.MongoTimestamp(12345678<<32|42))
+	c.Assert(ts.Time(), Equals, time.Unix(12345678, 0))
+	c.Assert(ts.Counter(), Equals, uint32(42))
+
+	// Must remain byte-identical to the raw value encoding.
+	ts = bson.NewMongoTimestamp(time.Unix(0, 0), 258)
+	data, err := bson.Marshal(bson.M{"_": ts})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x11_\x00\x02\x01\x00\x00\x00\x00\x00\x00"))
+
+	var v struct{ TS bson.MongoTimestamp }
+	ts = bson.NewMongoTimestamp(time.Unix(1<<32-1, 0), 1<<32-1)
+	data, err = bson.Marshal(bson.M{"ts": ts})
+	c.Assert(err, IsNil)
+	err = bson.Unmarshal(data, &v)
+	c.Assert(err, IsNil)
+	c.Assert(v.TS.Time().Unix(), Equals, int64(1<<32-1))
+	c.Assert(v.TS.Counter(), Equals, uint32(1<<32-1))
+}
+
+type orderedField struct {
+	M bson.M
+	D bson.D
+}
+
+func (s *S) TestUnmarshalNamedDField(c *C) {
+	data, err := bson.Marshal(bson.D{
+		{Name: "m", Value: bson.D{{Name: "b", Value: 1}, {Name: "a", Value: bson.D{{Name: "y", Value: 2}, {Name: "x", Value: 3}}}}},
+		{Name: "d", Value: bson.D{
+			{Name: "c", Value: 1},
+			{Name: "b", Value: bson.D{{Name: "z", Value: 2}, {Name: "y", Value: 3}, {Name: "x", Value: 4}}},
+			{Name: "a", Value: []any{bson.D{{Name: "q", Value: 5}, {Name: "p", Value: 6}}}},
+		}},
+	})
+	c.Assert(err, IsNil)
+
+	var v orderedField
+	err = bson.Unmarshal(data, &v)
+	c.Assert(err, IsNil)
+
+	// Plain maps decode nested documents as maps.
+	c.Assert(v.M, DeepEquals, bson.M{"b": 1, "a": bson.M{"y": 2, "x": 3}})
+
+	// The bson.D field preserves the order at every nesting level.
+	c.Assert(v.D, DeepEquals, bson.D{
+		{Name: "c", Value: 1},
+		{Name: "b", Value: bson.D{{Name: "z", Value: 2}, {Name: "y", Value: 3}, {Name: "x", Value: 4}}},
+		{Name: "a", Value: []any{bson.D{{Name: "q", Value: 5}, {Name: "p", Value: 6}}}},
+	})
+}
+
 func (s *S) TestUnmarshalOneWayItems(c *C) {
 	for _, item := range unmarshalItems {
 		testUnmarshal(c, wrapInDoc(item.data), item.obj)
 	}
 }
 
+func (s *S) TestDecodeContext(c *C) {
+	ctx := bson.NewDecodeContext()
+
+	// The same context is reused across items of many types, and twice for
+	// each item so that the cached type information is exercised as well.
+	var items []testItemType
+	items = append(items, allItems...)
+	items = append(items, structItems...)
+	items = append(items, unmarshalItems...)
+	for i, item := range items {
+		data := []byte(wrapInDoc(item.data))
+		for j := 0; j != 2; j++ {
+			expected := makeZeroDoc(item.obj)
+			err := bson.Unmarshal(data, expected)
+			c.Assert(err, IsNil)
+
+			value := makeZeroDoc(item.obj)
+			err = ctx.Unmarshal(data, value)
+			c.Assert(err, IsNil)
+			c.Assert(value, DeepEquals, expected, Commentf("Failed on item %d: %#v", i, item))
+		}
+	}
+
+	// Setters are honored.
+	for i := 0; i != 2; i++ {
+		obj := &ptrSetterDoc{}
+		err := ctx.Unmarshal([]byte(wrapInDoc("\x02_\x00\x04\x00\x00\x00abc\x00")), obj)
+		c.Assert(err, IsNil)
+		c.Assert(obj.Field, NotNil)
+		c.Assert(obj.Field.received, Equals, "abc")
+	}
+
+	// Errors are reported as usual, and don't spoil the context.
+	for _, item := range unmarshalErrorItems {
+		data := []byte(wrapInDoc(item.data))
+		var value any
+		switch reflect.ValueOf(item.obj).Kind() {
+		case reflect.Map, reflect.Ptr:
+			value = makeZeroDoc(item.obj)
+		case reflect.Invalid:
+			value = bson.M{}
+		default:
+			value = item.obj
+		}
+		err := ctx.Unmarshal(data, value)
+		c.Assert(err, ErrorMatches, item.error)
+	}
+	var m bson.M
+	err := ctx.Unmarshal([]byte(wrapInDoc("\x02a\x00\x02\x00\x00\x00b\x00")), &m)
+	c.Assert(err, IsNil)
+	c.Assert(m, DeepEquals, bson.M{"a": "b"})
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	data, err := bson.Marshal(&struct {
+		A int
+		B string
+		C []float64
+	}{1, "two", []float64{3, 4}})
+	if err != nil {
+		b.Fatal(err)
+	}
+	var v struct {
+		A int
+		B string
+		C []float64
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bson.Unmarshal(data, &v)
+	}
+}
+
+func BenchmarkDecodeContextUnmarshal(b *testing.B) {
+	data, err := bson.Marshal(&struct {
+		A int
+		B string
+		C []float64
+	}{1, "two", []float64{3, 4}})
+	if err != nil {
+		b.Fatal(err)
+	}
+	var v struct {
+		A int
+		B string
+		C []float64
+	}
+	ctx := bson.NewDecodeContext()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ctx.Unmarshal(data, &v)
+	}
+}
+
+type internItem struct {
+	Status string
+	Kind   string
+}
+
+func internDoc(n int) []byte {
+	items := make([]internItem, n)
+	for i := range items {
+		items[i] = internItem{Status: []string{"active", "inactive", "pending"}[i%3], Kind: "user"}
+	}
+	data, err := bson.Marshal(bson.M{"items": items})
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func (s *S) TestDecodeInternStrings(c *C) {
+	bson.SetDecodeInternStrings(true)
+	defer bson.SetDecodeInternStrings(false)
+
+	data := internDoc(6)
+	var v struct{ Items []internItem }
+	c.Assert(bson.NewDecodeContext().Unmarshal(data, &v), IsNil)
+	c.Assert(v.Items, HasLen, 6)
+	for i, item := range v.Items {
+		c.Assert(item.Status, Equals, []string{"active", "inactive", "pending"}[i%3])
+		c.Assert(item.Kind, Equals, "user")
+	}
+	// Repeated values share their memory.
+	c.Assert(unsafe.StringData(v.Items[0].Status) == unsafe.StringData(v.Items[3].Status), Equals, true)
+	c.Assert(unsafe.StringData(v.Items[0].Kind) == unsafe.StringData(v.Items[5].Kind), Equals, true)
+
+	// Values are independent from the input data.
+	for i := range data {
+		data[i] = 'x'
+	}
+	c.Assert(v.Items[0].Status, Equals, "active")
+	c.Assert(v.Items[1].Kind, Equals, "user")
+
+	// Contexts keep interning across calls.
+	ctx := bson.NewDecodeContext()
+	var m1, m2 bson.M
+	c.Assert(ctx.Unmarshal(internDoc(1), &m1), IsNil)
+	c.Assert(ctx.Unmarshal(internDoc(1), &m2), IsNil)
+	c.Assert(m1, DeepEquals, m2)
+	status1 := m1["items"].([]any)[0].(bson.M)["status"].(string)
+	status2 := m2["items"].([]any)[0].(bson.M)["status"].(string)
+	c.Assert(unsafe.StringData(status1) == unsafe.StringData(status2), Equals, true)
+
+	// Long strings are left alone.
+	long := strings.Repeat("x", 100)
+	data, err := bson.Marshal(bson.M{"a": long, "b": long})
+	c.Assert(err, IsNil)
+	var m bson.M
+	c.Assert(ctx.Unmarshal(data, &m), IsNil)
+	c.Assert(m["a"], Equals, long)
+	c.Assert(unsafe.StringData(m["a"].(string)) == unsafe.StringData(m["b"].(string)), Equals, false)
+
+	// Plain Unmarshal calls don't intern.
+	data = internDoc(6)
+	v.Items = nil
+	c.Assert(bson.Unmarshal(data, &v), IsNil)
+	c.Assert(v.Items[0].Status, Equals, v.Items[3].Status)
+	c.Assert(unsafe.StringData(v.Items[0].Status) == unsafe.StringData(v.Items[3].Status), Equals, false)
+}
+
+func BenchmarkUnmarshalRepeatedStrings(b *testing.B) {
+	benchmarkUnmarshalRepeatedStrings(b, false)
+}
+
+func BenchmarkUnmarshalRepeatedStringsInterned(b *testing.B) {
+	benchmarkUnmarshalRepeatedStrings(b, true)
+}
+
+// Plain Unmarshal calls don't share an intern cache, so enabling interning
+// must not add allocations to them.
+func BenchmarkUnmarshalInternEnabled(b *testing.B) {
+	bson.SetDecodeInternStrings(true)
+	defer bson.SetDecodeInternStrings(false)
+	data := internDoc(1)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var v struct{ Items []internItem }
+		bson.Unmarshal(data, &v)
+	}
+}
+
+func benchmarkUnmarshalRepeatedStrings(b *testing.B, intern bool) {
+	bson.SetDecodeInternStrings(intern)
+	defer bson.SetDecodeInternStrings(false)
+	data := internDoc(100)
+	ctx := bson.NewDecodeContext()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var v struct{ Items []internItem }
+		ctx.Unmarshal(data, &v)
+	}
+}
+
+type rangeDoc struct {
+	Age   int      `bson:"age,min=0,max=150"`
+	Ratio *float64 `bson:"ratio,omitempty,min=-1.5,max=1.5"`
+	Count uint8    `bson:",max=10"`
+}
+
+func (s *S) TestUnmarshalFieldRange(c *C) {
+	tests := []struct {
+		doc   bson.M
+		error string
+	}{
+		{bson.M{"age": 0, "ratio": -1.5, "count": 10}, ""},
+		{bson.M{"age": 150, "ratio": 1.5, "count": 0}, ""},
+		{bson.M{"age": 42}, ""},
+		{bson.M{"age": int64(-1)}, "Value -1 for key age is below the minimum of 0"},
+		{bson.M{"age": 151}, "Value 151 for key age is above the maximum of 150"},
+		{bson.M{"age": 150.5}, ""}, // Truncated into 150.
+		{bson.M{"ratio": -2.0}, "Value -2 for key ratio is below the minimum of -1.5"},
+		{bson.M{"ratio": 1.75}, "Value 1.75 for key ratio is above the maximum of 1.5"},
+		{bson.M{"ratio": math.NaN()}, "Value NaN for key ratio is out of range"},
+		{bson.M{"count": 11}, "Value 11 for key count is above the maximum of 10"},
+	}
+	for i, test := range tests {
+		data, err := bson.Marshal(test.doc)
+		c.Assert(err, IsNil)
+		var v rangeDoc
+		err = bson.Unmarshal(data, &v)
+		if test.error == "" {
+			c.Assert(err, IsNil, Commentf("Failed on test %d: %#v", i, test.doc))
+		} else {
+			c.Assert(err, ErrorMatches, test.error, Commentf("Failed on test %d: %#v", i, test.doc))
+		}
+	}
+
+	// Marshalling is not affected.
+	data, err := bson.Marshal(&rangeDoc{Age: 200})
+	c.Assert(err, IsNil)
+	var m bson.M
+	c.Assert(bson.Unmarshal(data, &m), IsNil)
+	c.Assert(m["age"], Equals, 200)
+}
+
+func (s *S) TestUnmarshalFieldRangeBadSpec(c *C) {
+	data, err := bson.Marshal(bson.M{"a": 1})
+	c.Assert(err, IsNil)
+
+	var v1 struct {
+		A int `bson:"a,min=zero"`
+	}
+	err = bson.Unmarshal(data, &v1)
+	c.Assert(err, ErrorMatches, `Invalid min value "zero" in tag "a,min=zero" of type .*`)
+
+	var v2 struct {
+		A int `bson:"a,max="`
+	}
+	err = bson.Unmarshal(data, &v2)
+	c.Assert(err, ErrorMatches, `Invalid max value "" in tag "a,max=" of type .*`)
+
+	var v3 struct {
+		A int `bson:"a,min=2,max=1"`
+	}
+	err = bson.Unmarshal(data, &v3)
+	c.Assert(err, ErrorMatches, `Invalid range with min above max in tag "a,min=2,max=1" of type .*`)
+
+	var v4 struct {
+		A string `bson:"a,min=1"`
+	}
+	err = bson.Unmarshal(data, &v4)
+	c.Assert(err, ErrorMatches, `Options min and max need a numeric field in tag "a,min=1" of type .*`)
+}
+
+type enumDoc struct {
+	Status string  `bson:"status,enum=active|inactive|banned"`
+	Role   *string `bson:"role,omitempty,enum=admin|user"`
+	Level  string  `bson:"level,enum=|low|high"`
+}
+
+func (s *S) TestUnmarshalFieldEnum(c *C) {
+	tests := []struct {
+		doc   bson.M
+		error string
+	}{
+		{bson.M{"status": "active", "role": "admin", "level": "low"}, ""},
+		{bson.M{"status": "banned", "role": "user"}, ""},
+		{bson.M{}, ""},
+		{bson.M{"status": "deleted"}, `Value "deleted" for key status is not one of active\|inactive\|banned`},
+		{bson.M{"status": "Active"}, `Value "Active" for key status is not one of active\|inactive\|banned`},
+		{bson.M{"role": "root"}, `Value "root" for key role is not one of admin\|user`},
+
+		// Empty values are only accepted with omitempty or when listed.
+		{bson.M{"status": ""}, `Value "" for key status is not one of active\|inactive\|banned`},
+		{bson.M{"role": ""}, ""},
+		{bson.M{"level": ""}, ""},
+	}
+	for i, test := range tests {
+		data, err := bson.Marshal(test.doc)
+		c.Assert(err, IsNil)
+		var v enumDoc
+		err = bson.Unmarshal(data, &v)
+		if test.error == "" {
+			c.Assert(err, IsNil, Commentf("Failed on test %d: %#v", i, test.doc))
+		} else {
+			c.Assert(err, ErrorMatches, test.error, Commentf("Failed on test %d: %#v", i, test.doc))
+		}
+	}
+
+	// Marshalling is not affected.
+	data, err := bson.Marshal(&enumDoc{Status: "unknown"})
+	c.Assert(err, IsNil)
+	var m bson.M
+	c.Assert(bson.Unmarshal(data, &m), IsNil)
+	c.Assert(m["status"], Equals, "unknown")
+}
+
+func (s *S) TestUnmarshalFieldEnumBadSpec(c *C) {
+	data, err := bson.Marshal(bson.M{"a": "x"})
+	c.Assert(err, IsNil)
+
+	var v1 struct {
+		A string `bson:"a,enum="`
+	}
+	err = bson.Unmarshal(data, &v1)
+	c.Assert(err, ErrorMatches, `Invalid enum value "" in tag "a,enum=" of type .*`)
+
+	var v2 struct {
+		A int `bson:"a,enum=1|2"`
+	}
+	err = bson.Unmarshal(data, &v2)
+	c.Assert(err, ErrorMatches, `Option enum needs a string field in tag "a,enum=1\|2" of type .*`)
+}
+
+type durationDoc struct {
+	Timeout time.Duration `bson:"timeout,duration=ms"`
+	TTL     time.Duration `bson:"ttl,minsize,duration=s"`
+	Raw     time.Duration `bson:"raw"`
+}
+
+func (s *S) TestDurationTag(c *C) {
+	data, err := bson.Marshal(&durationDoc{Timeout: 1500*time.Millisecond + 999*time.Microsecond, TTL: 90 * time.Second, Raw: 5})
+	c.Assert(err, IsNil)
+	var m bson.M
+	err = bson.Unmarshal(data, &m)
+	c.Assert(err, IsNil)
+	c.Assert(m, DeepEquals, bson.M{"timeout": int64(1500), "ttl": 90, "raw": int64(5)})
+
+	var doc durationDoc
+	err = bson.Unmarshal(data, &doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc, Equals, durationDoc{Timeout: 1500 * time.Millisecond, TTL: 90 * time.Second, Raw: 5})
+
+	// Numbers stored by others with any numeric type.
+	data, err = bson.Marshal(bson.M{"timeout": 250, "ttl": 2.0})
+	c.Assert(err, IsNil)
+	doc = durationDoc{}
+	err = bson.Unmarshal(data, &doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc, Equals, durationDoc{Timeout: 250 * time.Millisecond, TTL: 2 * time.Second})
+
+	// Numbers beyond the range of time.Duration are left out.
+	data, err = bson.Marshal(bson.M{"timeout": int64(math.MaxInt64 / 1000)})
+	c.Assert(err, IsNil)
+	doc = durationDoc{}
+	err = bson.Unmarshal(data, &doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc.Timeout, Equals, time.Duration(0))
+}
+
+func (s *S) TestDurationTagBadSpec(c *C) {
+	data, err := bson.Marshal(bson.M{"a": 1})
+	c.Assert(err, IsNil)
+
+	var v1 struct {
+		A time.Duration `bson:"a,duration=us"`
+	}
+	err = bson.Unmarshal(data, &v1)
+	c.Assert(err, ErrorMatches, `Invalid duration unit "us" in tag "a,duration=us" of type .*`)
+
+	var v2 struct {
+		A int64 `bson:"a,duration=ms"`
+	}
+	err = bson.Unmarshal(data, &v2)
+	c.Assert(err, ErrorMatches, `Option duration needs a time.Duration field in tag "a,duration=ms" of type .*`)
+
+	var v3 struct {
+		A time.Duration `bson:"a,duration=s,min=0"`
+	}
+	_, err = bson.Marshal(&v3)
+	c.Assert(err, ErrorMatches, `Options min and max can't be combined with duration in tag "a,duration=s,min=0" of type .*`)
+}
+
+type strictInner struct {
+	A int
+}
+
+type strictDoc struct {
+	Name  string
+	Inner strictInner
+	Items []strictInner
+	Extra struct {
+		B     int
+		Other map[string]any `bson:",inline"`
+	}
+}
+
+func (s *S) TestUnmarshalStrict(c *C) {
+	data, err := bson.Marshal(bson.D{
+		{Name: "name", Value: "n"},
+		{Name: "inner", Value: bson.D{{Name: "a", Value: 1}, {Name: "b", Value: 2}}},
+		{Name: "items", Value: []bson.D{{{Name: "a", Value: 3}}, {{Name: "c", Value: 4}}}},
+		{Name: "extra", Value: bson.D{{Name: "b", Value: 5}, {Name: "caught", Value: 6}}},
+		{Name: "bogus", Value: true},
+	})
+	c.Assert(err, IsNil)
+
+	var v strictDoc
+	err = bson.UnmarshalStrict(data, &v)
+	c.Assert(err, ErrorMatches, "Unknown fields in document: inner.b, items.c, bogus")
+	c.Assert(err.(*bson.UnknownFieldsError).Fields, DeepEquals, []string{"inner.b", "items.c", "bogus"})
+
+	// The known fields are still set, and inline maps catch the rest.
+	c.Assert(v.Name, Equals, "n")
+	c.Assert(v.Inner.A, Equals, 1)
+	c.Assert(v.Items, DeepEquals, []strictInner{{A: 3}, {}})
+	c.Assert(v.Extra.B, Equals, 5)
+	c.Assert(v.Extra.Other, DeepEquals, map[string]any{"caught": 6})
+
+	// Unmarshal stays lenient.
+	c.Assert(bson.Unmarshal(data, &strictDoc{}), IsNil)
+
+	data, err = bson.Marshal(bson.M{"name": "n", "inner": bson.M{"a": 1}})
+	c.Assert(err, IsNil)
+	c.Assert(bson.UnmarshalStrict(data, &strictDoc{}), IsNil)
+
+	// Maps have no unknown fields.
+	m := bson.M{}
+	c.Assert(bson.UnmarshalStrict(data, m), IsNil)
+	c.Assert(m["name"], Equals, "n")
+}
+
+type setDoc struct {
+	Tags  map[string]struct{} `bson:"tags,set"`
+	Nums  map[int]bool        `bson:"nums,set"`
+	Other map[string]struct{} `bson:"other,set,omitempty"`
+}
+
+func (s *S) TestMarshalSet(c *C) {
+	v := setDoc{
+		Tags: map[string]struct{}{"go": {}, "bson": {}, "mongo": {}},
+		Nums: map[int]bool{3: true, -1: true, 2: false, 10: true},
+	}
+	data, err := bson.Marshal(&v)
+	c.Assert(err, IsNil)
+
+	var m bson.M
+	c.Assert(bson.Unmarshal(data, &m), IsNil)
+	c.Assert(m, DeepEquals, bson.M{
+		"tags": []any{"bson", "go", "mongo"},
+		"nums": []any{-1, 3, 10},
+	})
+
+	// The representation is deterministic.
+	for i := 0; i < 10; i++ {
+		again, err := bson.Marshal(&v)
+		c.Assert(err, IsNil)
+		c.Assert(again, DeepEquals, data)
+	}
+
+	var v2 setDoc
+	c.Assert(bson.Unmarshal(data, &v2), IsNil)
+	c.Assert(v2.Tags, DeepEquals, v.Tags)
+	c.Assert(v2.Nums, DeepEquals, map[int]bool{3: true, -1: true, 10: true})
+	c.Assert(v2.Other, IsNil)
+}
+
+func (s *S) TestUnmarshalSet(c *C) {
+	// Duplicated keys collapse into a single set member.
+	data, err := bson.Marshal(bson.M{"tags": []string{"b", "a", "b"}, "nums": []int{2, 2}})
+	c.Assert(err, IsNil)
+	var v setDoc
+	c.Assert(bson.Unmarshal(data, &v), IsNil)
+	c.Assert(v.Tags, DeepEquals, map[string]struct{}{"a": {}, "b": {}})
+	c.Assert(v.Nums, DeepEquals, map[int]bool{2: true})
+
+	data, err = bson.Marshal(&v)
+	c.Assert(err, IsNil)
+	var m bson.M
+	c.Assert(bson.Unmarshal(data, &m), IsNil)
+	c.Assert(m["tags"], DeepEquals, []any{"a", "b"})
+
+	// Documents are still accepted.
+	data, err = bson.Marshal(bson.M{"tags": bson.M{"a": bson.M{}}})
+	c.Assert(err, IsNil)
+	v = setDoc{}
+	c.Assert(bson.Unmarshal(data, &v), IsNil)
+	c.Assert(v.Tags, DeepEquals, map[string]struct{}{"a": {}})
+}
+
+func (s *S) TestSetBadSpec(c *C) {
+	var v1 struct {
+		A map[string]int `bson:"a,set"`
+	}
+	_, err := bson.Marshal(&v1)
+	c.Assert(err, ErrorMatches, `Option ,set needs a map\[T\]struct\{\} or map\[T\]bool field in tag "a,set" of type .*`)
+
+	var v2 struct {
+		A []string `bson:"a,set"`
+	}
+	_, err = bson.Marshal(&v2)
+	c.Assert(err, ErrorMatches, `Option ,set needs .*`)
+}
+
+func (s *S) TestUnsupportedTagFlag(c *C) {
+	var v struct {
+		A int `bson:"a,bogus"`
+	}
+	_, err := bson.Marshal(&v)
+	c.Assert(err, ErrorMatches, `Unsupported flag "bogus" in tag "a,bogus" of type .*`)
+	err = bson.Unmarshal([]byte("\x05\x00\x00\x00\x00"), &v)
+	c.Assert(err, ErrorMatches, `Unsupported flag "bogus" in tag "a,bogus" of type .*`)
+}
+
+type rawAlsoPayload struct {
+	Name  string
+	Count int
+}
+
+type rawAlsoDoc struct {
+	Payload    rawAlsoPayload `bson:"payload,rawalso=PayloadRaw"`
+	PayloadRaw bson.Raw
+	Other      string
+}
+
+func (s *S) TestUnmarshalRawAlso(c *C) {
+	data, err := bson.Marshal(bson.D{
+		{Name: "payload", Value: bson.D{{Name: "name", Value: "x"}, {Name: "count", Value: 2}}},
+		{Name: "other", Value: "y"},
+	})
+	c.Assert(err, IsNil)
+
+	var v rawAlsoDoc
+	c.Assert(bson.Unmarshal(data, &v), IsNil)
+	c.Assert(v.Payload, Equals, rawAlsoPayload{Name: "x", Count: 2})
+	c.Assert(v.Other, Equals, "y")
+	c.Assert(v.PayloadRaw.Kind, Equals, byte(0x03))
+
+	var payload bson.D
+	c.Assert(v.PayloadRaw.Unmarshal(&payload), IsNil)
+	c.Assert(payload, DeepEquals, bson.D{{Name: "name", Value: "x"}, {Name: "count", Value: 2}})
+
+	// The raw field is not marshalled on its own.
+	data, err = bson.Marshal(&v)
+	c.Assert(err, IsNil)
+	var m bson.M
+	c.Assert(bson.Unmarshal(data, &m), IsNil)
+	c.Assert(m, DeepEquals, bson.M{"payload": bson.M{"name": "x", "count": 2}, "other": "y"})
+
+	// The raw value is kept even if the typed decoding is incompatible.
+	data, err = bson.Marshal(bson.M{"payload": "not a document"})
+	c.Assert(err, IsNil)
+	v = rawAlsoDoc{}
+	c.Assert(bson.Unmarshal(data, &v), IsNil)
+	c.Assert(v.Payload, Equals, rawAlsoPayload{})
+	c.Assert(v.PayloadRaw.Kind, Equals, byte(0x02))
+	var str string
+	c.Assert(v.PayloadRaw.Unmarshal(&str), IsNil)
+	c.Assert(str, Equals, "not a document")
+}
+
+func (s *S) TestUnmarshalRawAlsoInline(c *C) {
+	var v struct {
+		Inner rawAlsoDoc `bson:",inline"`
+	}
+	data, err := bson.Marshal(bson.M{"payload": bson.M{"count": 3}})
+	c.Assert(err, IsNil)
+	c.Assert(bson.Unmarshal(data, &v), IsNil)
+	c.Assert(v.Inner.Payload.Count, Equals, 3)
+	c.Assert(v.Inner.PayloadRaw.Kind, Equals, byte(0x03))
+}
+
+func (s *S) TestUnmarshalRawAlsoBadSpec(c *C) {
+	data, err := bson.Marshal(bson.M{"a": 1})
+	c.Assert(err, IsNil)
+
+	var v1 struct {
+		A int `bson:"a,rawalso=Missing"`
+	}
+	err = bson.Unmarshal(data, &v1)
+	c.Assert(err, ErrorMatches, `Option rawalso needs an exported bson.Raw field in the same struct in tag "a,rawalso=Missing" of type .*`)
+
+	var v2 struct {
+		A int `bson:"a,rawalso=B"`
+		B []byte
+	}
+	err = bson.Unmarshal(data, &v2)
+	c.Assert(err, ErrorMatches, `Option rawalso needs an exported bson.Raw field .*`)
+}
+
 func (s *S) TestUnmarshalNilInStruct(c *C) {
 	// Nil is the default value, so we need to ensure it's indeed being set.
 	b := byte(1)
@@ -617,6 +1937,41 @@ func (s *S) TestMarshalErrorItems(c *C) {
 	}
 }
 
+func (s *S) TestMarshalValueAllItems(c *C) {
+	for i, item := range allItems {
+		if len(item.data) == 0 {
+			continue
+		}
+		value := item.obj.(bson.M)["_"]
+		kind, data, err := bson.MarshalValue(value)
+		c.Assert(err, IsNil)
+		c.Assert(kind, Equals, item.data[0], Commentf("Failed on item %d: %#v", i, item))
+		c.Assert(string(data), Equals, item.data[3:], Commentf("Failed on item %d: %#v", i, item))
+
+		var out any
+		c.Assert(bson.UnmarshalValue(kind, data, &out), IsNil)
+		c.Assert(out, DeepEquals, value, Commentf("Failed on item %d: %#v", i, item))
+	}
+}
+
+func (s *S) TestMarshalValue(c *C) {
+	kind, data, err := bson.MarshalValue(int64(123))
+	c.Assert(err, IsNil)
+	c.Assert(kind, Equals, bson.ElementInt64)
+	c.Assert(data, DeepEquals, []byte("\x7b\x00\x00\x00\x00\x00\x00\x00"))
+
+	var n int
+	c.Assert(bson.UnmarshalValue(kind, data, &n), IsNil)
+	c.Assert(n, Equals, 123)
+
+	var str string
+	err = bson.UnmarshalValue(kind, data, &str)
+	c.Assert(err, ErrorMatches, "BSON kind 0x12 isn't compatible with type string")
+
+	_, _, err = bson.MarshalValue(make(chan int))
+	c.Assert(err, ErrorMatches, "Can't marshal chan int in a BSON document")
+}
+
 // --------------------------------------------------------------------------
 // Unmarshalling error cases.
 
@@ -852,9 +2207,228 @@ func (s *S) TestUnmarshalSetterErrors(c *C) {
 	c.Assert(m["abc"].received, Equals, "1")
 }
 
+func (s *S) TestElementKinds(c *C) {
+	dec, err := bson.ParseDecimal128("1.5")
+	c.Assert(err, IsNil)
+	tests := []struct {
+		value any
+		kind  byte
+	}{
+		{1.5, bson.ElementDouble},
+		{"s", bson.ElementString},
+		{bson.M{"a": 1}, bson.ElementDocument},
+		{[]any{1}, bson.ElementArray},
+		{[]byte("b"), bson.ElementBinary},
+		{bson.Undefined, bson.ElementUndefined},
+		{bson.ObjectIdHex("0102030405060708090a0b0c"), bson.ElementObjectId},
+		{true, bson.ElementBool},
+		{time.Unix(0, 0), bson.ElementDatetime},
+		{nil, bson.ElementNull},
+		{bson.RegEx{Pattern: "ab", Options: "i"}, bson.ElementRegEx},
+		{bson.DBPointer{Namespace: "db.c", Id: bson.ObjectIdHex("0102030405060708090a0b0c")}, bson.ElementDBPointer},
+		{bson.JavaScript{Code: "f()"}, bson.ElementJavaScript},
+		{bson.Symbol("s"), bson.ElementSymbol},
+		{bson.JavaScript{Code: "f()", Scope: bson.M{"a": 1}}, bson.ElementJavaScriptWithScope},
+		{int32(1), bson.ElementInt32},
+		{bson.MongoTimestamp(1), bson.ElementMongoTimestamp},
+		{int64(1), bson.ElementInt64},
+		{dec, bson.ElementDecimal128},
+		{bson.MinKey, bson.ElementMinKey},
+		{bson.MaxKey, bson.ElementMaxKey},
+	}
+	for _, test := range tests {
+		data, err := bson.Marshal(bson.D{{Name: "v", Value: test.value}})
+		c.Assert(err, IsNil)
+		// The kind is the first byte after the document length.
+		c.Assert(data[4], Equals, test.kind, Commentf("value: %#v", test.value))
+	}
+}
+
 func (s *S) TestDMap(c *C) {
 	d := bson.D{{Name: "a", Value: 1}, {Name: "b", Value: 2}}
 	c.Assert(d.Map(), DeepEquals, bson.M{"a": 1, "b": 2})
+
+	// The last value wins with duplicate names.
+	d = bson.D{{Name: "a", Value: 1}, {Name: "b", Value: 2}, {Name: "a", Value: 3}}
+	c.Assert(d.Map(), DeepEquals, bson.M{"a": 3, "b": 2})
+}
+
+func (s *S) TestMMerge(c *C) {
+	m := bson.M{
+		"a":    1,
+		"list": []int{1, 2},
+		"sub":  bson.M{"b": 2, "c": 3, "deep": map[string]any{"x": 1}},
+		"s":    "left",
+	}
+	other := bson.M{
+		"list": []int{3},
+		"sub":  bson.M{"c": 4, "deep": bson.M{"y": 2}},
+		"s":    bson.M{"now": "a map"},
+		"d":    true,
+	}
+	merged := m.Merge(other)
+	c.Assert(merged, DeepEquals, bson.M{
+		"a":    1,
+		"list": []int{3},
+		"sub":  bson.M{"b": 2, "c": 4, "deep": bson.M{"x": 1, "y": 2}},
+		"s":    bson.M{"now": "a map"},
+		"d":    true,
+	})
+
+	// The inputs are left untouched.
+	c.Assert(m["sub"], DeepEquals, bson.M{"b": 2, "c": 3, "deep": map[string]any{"x": 1}})
+	c.Assert(other["sub"], DeepEquals, bson.M{"c": 4, "deep": bson.M{"y": 2}})
+
+	// A scalar on the right replaces a map on the left.
+	c.Assert(m.Merge(bson.M{"sub": nil}), DeepEquals, bson.M{"a": 1, "list": []int{1, 2}, "sub": nil, "s": "left"})
+
+	c.Assert(bson.M(nil).Merge(nil), DeepEquals, bson.M{})
+}
+
+func (s *S) TestDGetSetDelete(c *C) {
+	var d bson.D
+	_, ok := d.Get("a")
+	c.Assert(ok, Equals, false)
+
+	d.Set("a", 1)
+	d.Set("b", 2)
+	d.Set("c", nil)
+	c.Assert(d, DeepEquals, bson.D{{Name: "a", Value: 1}, {Name: "b", Value: 2}, {Name: "c", Value: nil}})
+
+	value, ok := d.Get("b")
+	c.Assert(ok, Equals, true)
+	c.Assert(value, Equals, 2)
+	value, ok = d.Get("c")
+	c.Assert(ok, Equals, true)
+	c.Assert(value, IsNil)
+
+	// Set replaces the first element in place.
+	d = append(d, bson.DocElem{Name: "a", Value: 4})
+	d.Set("a", 3)
+	c.Assert(d, DeepEquals, bson.D{{Name: "a", Value: 3}, {Name: "b", Value: 2}, {Name: "c", Value: nil}, {Name: "a", Value: 4}})
+	value, _ = d.Get("a")
+	c.Assert(value, Equals, 3)
+
+	// Delete removes all elements with the name.
+	d.Delete("a")
+	c.Assert(d, DeepEquals, bson.D{{Name: "b", Value: 2}, {Name: "c", Value: nil}})
+	d.Delete("missing")
+	c.Assert(d, DeepEquals, bson.D{{Name: "b", Value: 2}, {Name: "c", Value: nil}})
+	d.Delete("b")
+	d.Delete("c")
+	c.Assert(d, HasLen, 0)
+}
+
+func (s *S) TestProjectionHelpers(c *C) {
+	c.Assert(bson.Include("a", "b"), DeepEquals, bson.D{{"a", 1}, {"b", 1}})
+	c.Assert(bson.Exclude("a"), DeepEquals, bson.D{{"a", 0}})
+	c.Assert(bson.Include(), HasLen, 0)
+
+	c.Assert(bson.Slice("a", -5), DeepEquals, bson.DocElem{"a", bson.M{"$slice": -5}})
+	c.Assert(bson.SliceRange("a", 10, 5), DeepEquals, bson.DocElem{"a", bson.M{"$slice": []int{10, 5}}})
+	c.Assert(bson.ElemMatch("a", bson.M{"x": 1}), DeepEquals, bson.DocElem{"a", bson.M{"$elemMatch": bson.M{"x": 1}}})
+
+	data, err := bson.Marshal(append(bson.Include("a"), bson.SliceRange("b", -2, 1)))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc("\x10a\x00\x01\x00\x00\x00"+
+		"\x03b\x00\x20\x00\x00\x00\x04$slice\x00\x13\x00\x00\x00\x100\x00\xfe\xff\xff\xff\x101\x00\x01\x00\x00\x00\x00\x00"))
+}
+
+func (s *S) TestUnmarshalRawSlice(c *C) {
+	data, err := bson.Marshal(bson.M{"a": []any{1, "x", bson.M{"b": true}, []int{2}, nil}, "e": []any{}})
+	c.Assert(err, IsNil)
+
+	var v struct {
+		A []bson.Raw
+		E []bson.Raw
+	}
+	err = bson.Unmarshal(data, &v)
+	c.Assert(err, IsNil)
+	c.Assert(v.A, HasLen, 5)
+	c.Assert(v.E, HasLen, 0)
+
+	kinds := []byte{bson.ElementInt32, bson.ElementString, bson.ElementDocument, bson.ElementArray, bson.ElementNull}
+	for i, kind := range kinds {
+		c.Assert(v.A[i].Kind, Equals, kind)
+	}
+
+	// Each element decodes lazily into the type matching its kind.
+	var n int
+	c.Assert(v.A[0].Unmarshal(&n), IsNil)
+	c.Assert(n, Equals, 1)
+	var str string
+	c.Assert(v.A[1].Unmarshal(&str), IsNil)
+	c.Assert(str, Equals, "x")
+	var doc struct{ B bool }
+	c.Assert(v.A[2].Unmarshal(&doc), IsNil)
+	c.Assert(doc.B, Equals, true)
+	var list []int
+	c.Assert(v.A[3].Unmarshal(&list), IsNil)
+	c.Assert(list, DeepEquals, []int{2})
+
+	// Arrays work as well, and the raw elements marshal back unchanged.
+	var w struct{ A [5]bson.Raw }
+	err = bson.Unmarshal(data, &w)
+	c.Assert(err, IsNil)
+	c.Assert(w.A[:], DeepEquals, v.A)
+
+	out, err := bson.Marshal(bson.M{"a": v.A})
+	c.Assert(err, IsNil)
+	in, err := bson.Marshal(bson.M{"a": []any{1, "x", bson.M{"b": true}, []int{2}, nil}})
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, in)
+}
+
+func (s *S) TestFilterHelpers(c *C) {
+	tests := []struct {
+		built, written any
+	}{
+		{bson.Eq("a", 1), bson.M{"a": 1}},
+		{bson.Ne("a", "x"), bson.M{"a": bson.M{"$ne": "x"}}},
+		{bson.Gt("a", 1), bson.M{"a": bson.M{"$gt": 1}}},
+		{bson.Gte("a", 1.5), bson.M{"a": bson.M{"$gte": 1.5}}},
+		{bson.Lt("a", int64(1)), bson.M{"a": bson.M{"$lt": int64(1)}}},
+		{bson.Lte("a.b", 1), bson.M{"a.b": bson.M{"$lte": 1}}},
+		{bson.In("a", []int{1, 2}), bson.M{"a": bson.M{"$in": []int{1, 2}}}},
+		{bson.Nin("a", []string{"x"}), bson.M{"a": bson.M{"$nin": []string{"x"}}}},
+		{bson.Exists("a", false), bson.M{"a": bson.M{"$exists": false}}},
+		{bson.Regex("a", "^x", "i"), bson.M{"a": bson.RegEx{"^x", "i"}}},
+		{
+			bson.And(bson.Eq("a", 1), bson.Gt("b", 2)),
+			bson.M{"$and": []any{bson.M{"a": 1}, bson.M{"b": bson.M{"$gt": 2}}}},
+		}, {
+			bson.Or(bson.Exists("a", true), bson.Nor(bson.In("b", []int{1}))),
+			bson.M{"$or": []bson.M{{"a": bson.M{"$exists": true}}, {"$nor": []bson.M{{"b": bson.M{"$in": []int{1}}}}}}},
+		}, {
+			bson.And(bson.ElemMatch("a", bson.Gt("x", 1)), bson.D{{"b", 1}}),
+			bson.M{"$and": []any{bson.M{"a": bson.M{"$elemMatch": bson.M{"x": bson.M{"$gt": 1}}}}, bson.D{{"b", 1}}}},
+		},
+		{bson.And(), bson.M{"$and": []any{}}},
+	}
+	for i, test := range tests {
+		built, err := bson.Marshal(test.built)
+		c.Assert(err, IsNil)
+		written, err := bson.Marshal(test.written)
+		c.Assert(err, IsNil)
+		c.Assert(built, DeepEquals, written, Commentf("test %d: %#v", i, test.built))
+	}
+}
+
+func (s *S) TestDMapSlice(c *C) {
+	d := bson.D{{Name: "a", Value: 1}, {Name: "b", Value: 2}}
+	c.Assert(d.MapSlice(), DeepEquals, map[string][]any{"a": {1}, "b": {2}})
+
+	d = bson.D{{Name: "a", Value: 1}, {Name: "b", Value: 2}, {Name: "a", Value: "x"}, {Name: "a", Value: nil}}
+	c.Assert(d.MapSlice(), DeepEquals, map[string][]any{"a": {1, "x", nil}, "b": {2}})
+
+	c.Assert(bson.D{}.MapSlice(), DeepEquals, map[string][]any{})
+
+	// Repeated names survive a round trip through raw data.
+	data, err := bson.Marshal(d)
+	c.Assert(err, IsNil)
+	var out bson.D
+	c.Assert(bson.Unmarshal(data, &out), IsNil)
+	c.Assert(out.MapSlice(), DeepEquals, d.MapSlice())
 }
 
 func (s *S) TestUnmarshalSetterSetZero(c *C) {
@@ -958,6 +2532,180 @@ func (s *S) TestMarshalWithGetterNil(c *C) {
 	c.Assert(m, DeepEquals, bson.M{"_": "<value is nil>"})
 }
 
+// binaryUUID is marshalled via encoding.BinaryMarshaler.
+type binaryUUID [4]byte
+
+func (u binaryUUID) MarshalBinary() ([]byte, error) {
+	return u[:], nil
+}
+
+func (u *binaryUUID) UnmarshalBinary(data []byte) error {
+	if len(data) != len(u) {
+		return errors.New("bad uuid length")
+	}
+	copy(u[:], data)
+	return nil
+}
+
+// binaryPoint implements encoding.BinaryMarshaler on its pointer only.
+type binaryPoint struct {
+	X, Y byte
+}
+
+func (p *binaryPoint) MarshalBinary() ([]byte, error) {
+	if p.X == 0xFF {
+		return nil, errors.New("bad point")
+	}
+	return []byte{p.X, p.Y}, nil
+}
+
+func (p *binaryPoint) UnmarshalBinary(data []byte) error {
+	p.X, p.Y = data[0], data[1]
+	return nil
+}
+
+type binaryDoc struct {
+	U  binaryUUID
+	UP *binaryUUID
+	P  *binaryPoint
+	T  time.Time
+}
+
+type Celsius float64
+
+type genericReading[T ~float32 | ~float64] struct {
+	Value T
+	Min   []T
+	ByKey map[string]T
+}
+
+func (s *S) TestMarshalDefinedNumeric(c *C) {
+	in := genericReading[Celsius]{Value: 21.5, Min: []Celsius{-4, 0.25}, ByKey: map[string]Celsius{"a": 3}}
+	data, err := bson.Marshal(in)
+	c.Assert(err, IsNil)
+
+	var m bson.M
+	c.Assert(bson.Unmarshal(data, &m), IsNil)
+	c.Assert(m, DeepEquals, bson.M{"value": 21.5, "min": []any{-4.0, 0.25}, "bykey": bson.M{"a": 3.0}})
+
+	var out genericReading[Celsius]
+	c.Assert(bson.Unmarshal(data, &out), IsNil)
+	c.Assert(out, DeepEquals, in)
+
+	// Integral values are converted on the way back in.
+	data, err = bson.Marshal(bson.M{"value": 20, "min": []any{int64(-4)}})
+	c.Assert(err, IsNil)
+	out = genericReading[Celsius]{}
+	c.Assert(bson.Unmarshal(data, &out), IsNil)
+	c.Assert(out.Value, Equals, Celsius(20))
+	c.Assert(out.Min, DeepEquals, []Celsius{-4})
+
+	// Defined numeric types held in interfaces marshal by their kind too.
+	data, err = bson.Marshal(bson.M{"c": any(Celsius(1.5)), "f": any(MyFloat32(2)), "u": any(MyUint8(3))})
+	c.Assert(err, IsNil)
+	m = nil
+	c.Assert(bson.Unmarshal(data, &m), IsNil)
+	c.Assert(m, DeepEquals, bson.M{"c": 1.5, "f": 2.0, "u": 3})
+}
+
+type mapReduceScope struct {
+	Limit int
+	Tags  []string `bson:"tags,omitempty"`
+}
+
+type storedMapReduce struct {
+	Map    bson.JavaScriptTyped[mapReduceScope]
+	Reduce bson.JavaScriptTyped[*mapReduceScope]
+}
+
+func (s *S) TestJavaScriptTyped(c *C) {
+	in := storedMapReduce{
+		Map:    bson.JavaScriptTyped[mapReduceScope]{Code: "function() {}", Scope: mapReduceScope{Limit: 3, Tags: []string{"a"}}},
+		Reduce: bson.JavaScriptTyped[*mapReduceScope]{Code: "function(k, v) {}", Scope: &mapReduceScope{Limit: 5}},
+	}
+	data, err := bson.Marshal(in)
+	c.Assert(err, IsNil)
+
+	// The encoding is the one of the equivalent JavaScript values.
+	plain, err := bson.Marshal(bson.D{
+		{"map", bson.JavaScript{Code: "function() {}", Scope: bson.D{{"limit", 3}, {"tags", []string{"a"}}}}},
+		{"reduce", bson.JavaScript{Code: "function(k, v) {}", Scope: bson.D{{"limit", 5}}}},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(data, DeepEquals, plain)
+
+	var out storedMapReduce
+	c.Assert(bson.Unmarshal(data, &out), IsNil)
+	c.Assert(out, DeepEquals, in)
+
+	// Code without a scope leaves the scope zeroed.
+	data, err = bson.Marshal(bson.M{"map": bson.JavaScript{Code: "f()"}})
+	c.Assert(err, IsNil)
+	out.Map.Scope.Limit = 1
+	c.Assert(bson.Unmarshal(data, &out), IsNil)
+	c.Assert(out.Map, DeepEquals, bson.JavaScriptTyped[mapReduceScope]{Code: "f()"})
+
+	// The vector used for JavaScript values round-trips.
+	var js struct {
+		V bson.JavaScriptTyped[bson.M] `bson:"_"`
+	}
+	item := "\x0F_\x00\x14\x00\x00\x00\x05\x00\x00\x00code\x00\x07\x00\x00\x00\x0A\x00\x00"
+	c.Assert(bson.Unmarshal([]byte(wrapInDoc(item)), &js), IsNil)
+	c.Assert(js.V, DeepEquals, bson.JavaScriptTyped[bson.M]{Code: "code", Scope: bson.M{"": nil}})
+	data, err = bson.Marshal(js)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, wrapInDoc(item))
+
+	kind, data, err := bson.MarshalValue("f()")
+	c.Assert(err, IsNil)
+	err = bson.UnmarshalValue(kind, data, &out.Map)
+	c.Assert(err, ErrorMatches, `BSON kind 0x02 isn't compatible with type bson.JavaScriptTyped\[.*mapReduceScope\]`)
+}
+
+func (s *S) TestMarshalBinaryMarshaler(c *C) {
+	up := binaryUUID{5, 6, 7, 8}
+	doc := binaryDoc{
+		U:  binaryUUID{1, 2, 3, 4},
+		UP: &up,
+		P:  &binaryPoint{X: 9, Y: 10},
+		T:  time.Unix(1e9, 0),
+	}
+	data, err := bson.Marshal(&doc)
+	c.Assert(err, IsNil)
+
+	var m bson.M
+	c.Assert(bson.Unmarshal(data, &m), IsNil)
+	c.Assert(m["u"], DeepEquals, []byte{1, 2, 3, 4})
+	c.Assert(m["up"], DeepEquals, []byte{5, 6, 7, 8})
+	c.Assert(m["p"], DeepEquals, []byte{9, 10})
+	c.Assert(m["t"], FitsTypeOf, time.Time{}) // Not affected.
+
+	var out binaryDoc
+	c.Assert(bson.Unmarshal(data, &out), IsNil)
+	c.Assert(out, DeepEquals, doc)
+
+	// Nil pointers are still marshalled as null.
+	data, err = bson.Marshal(&binaryDoc{})
+	c.Assert(err, IsNil)
+	out = binaryDoc{UP: &up}
+	c.Assert(bson.Unmarshal(data, &out), IsNil)
+	c.Assert(out.UP, IsNil)
+	c.Assert(out.P, IsNil)
+
+	// Other binary subtypes are unmarshalled too.
+	data, err = bson.Marshal(bson.M{"u": bson.Binary{Kind: 0x04, Data: []byte{4, 3, 2, 1}}})
+	c.Assert(err, IsNil)
+	c.Assert(bson.Unmarshal(data, &out), IsNil)
+	c.Assert(out.U, Equals, binaryUUID{4, 3, 2, 1})
+
+	// Errors are reported.
+	_, err = bson.Marshal(&binaryDoc{P: &binaryPoint{X: 0xFF}})
+	c.Assert(err, ErrorMatches, "bad point")
+	data, err = bson.Marshal(bson.M{"u": []byte{1}})
+	c.Assert(err, IsNil)
+	c.Assert(bson.Unmarshal(data, &out), ErrorMatches, "bad uuid length")
+}
+
 // --------------------------------------------------------------------------
 // Cross-type conversion tests.
 
@@ -1144,6 +2892,12 @@ type (
 
 	MyBool bool
 
+	MyFloat32 float32
+
+	MyUint8 uint8
+
+	MyInt16 int16
+
 	MyD []bson.DocElem
 
 	MyRawD []bson.RawDocElem
@@ -1340,6 +3094,15 @@ var twoWayCrossItems = []crossTypeItem{
 	{obj1: &struct{ B MyBool }{}, obj2: map[string]string{}},
 	{obj1: &struct{ B bool }{}, obj2: map[string]MyBool{"b": false}},
 
+	// numeric <=> defined numeric types
+	{obj1: &struct{ F MyFloat32 }{F: 1.5}, obj2: map[string]float64{"f": 1.5}},
+	{obj1: &struct{ F float64 }{F: 1.5}, obj2: map[string]MyFloat32{"f": 1.5}},
+	{obj1: &struct{ U MyUint8 }{U: 7}, obj2: map[string]int{"u": 7}},
+	{obj1: &struct{ U int }{U: 7}, obj2: map[string]MyUint8{"u": 7}},
+	{obj1: &struct{ I MyInt16 }{I: -3}, obj2: map[string]int{"i": -3}},
+	{obj1: &struct{ I int }{I: -3}, obj2: map[string]MyInt16{"i": -3}},
+	{obj1: &struct{ I MyInt16 }{}, obj2: map[string]float64{"i": 0}},
+
 	// arrays
 	{obj1: &struct{ V [2]int }{V: [...]int{1, 2}}, obj2: map[string][2]int{"v": {1, 2}}},
 	{obj1: &struct{ V [2]byte }{V: [...]byte{1, 2}}, obj2: map[string][2]byte{"v": {1, 2}}},
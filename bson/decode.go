@@ -28,11 +28,15 @@
 package bson
 
 import (
+	"encoding"
 	"fmt"
 	"math"
 	"net/url"
+	stdreflect "reflect"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/3JoB/go-reflect"
@@ -42,14 +46,261 @@ type decoder struct {
 	in      []byte
 	i       int
 	docType reflect.Type
+	cache   *decodeCache
+	interns bool // Whether strings are interned in cache.strs.
+	depth   int  // Documents and arrays being read below the top level.
+
+	merge   bool     // Whether the next document read keeps the values in out.
+	strict  bool     // Whether to collect unknown struct fields.
+	path    []string // Names of the documents being read, when strict.
+	unknown []string // Unknown struct fields found, when strict.
+}
+
+// decodeCache holds type information that is reused across the calls
+// made with a DecodeContext, so that the global caches are only consulted
+// once per type.
+type decodeCache struct {
+	structs map[reflect.Type]*structInfo
+	setters map[reflect.Type]int
+	strs    map[string]string // Interned strings, allocated on first use.
+}
+
+func (d *decoder) getStructInfo(st reflect.Type) (*structInfo, error) {
+	if d.cache == nil {
+		return getStructInfo(st)
+	}
+	if sinfo, ok := d.cache.structs[st]; ok {
+		return sinfo, nil
+	}
+	sinfo, err := getStructInfo(st)
+	if err == nil {
+		d.cache.structs[st] = sinfo
+	}
+	return sinfo, err
+}
+
+// addUnknown records that the document being read has an element with
+// the given name that matches no struct field.
+func (d *decoder) addUnknown(name string) {
+	if len(d.path) > 0 {
+		name = strings.Join(d.path, ".") + "." + name
+	}
+	d.unknown = append(d.unknown, name)
+}
+
+// polymorphicMapping maps the values of a discriminator field to the
+// types that documents holding them are unmarshalled into.
+type polymorphicMapping struct {
+	field string
+	types map[string]reflect.Type
+}
+
+var (
+	// polymorphicMappings holds a []polymorphicMapping in registration
+	// order, replaced as a whole on registration so that unmarshalling
+	// needs no locking.
+	polymorphicMappings      atomic.Value
+	polymorphicMappingsMutex sync.Mutex
+)
+
+// RegisterPolymorphic registers the types that documents are unmarshalled
+// into when their destination is an interface value, according to the
+// string held by their discriminator field. For example, after:
+//
+//	bson.RegisterPolymorphic("type", map[string]reflect.Type{
+//		"circle": reflect.TypeOf(Circle{}),
+//		"square": reflect.TypeOf(&Square{}),
+//	})
+//
+// documents with {"type": "circle"} unmarshalled into a field of type
+// Shape or any hold a Circle, unmarshalled as such including through its
+// SetBSON method, if any. A pointer to the registered type is used if
+// only the pointer implements the interface. Documents lacking the
+// discriminator, holding an unregistered value, or whose type doesn't
+// implement the interface are unmarshalled as usual.
+//
+// Discriminators are tried in the order they were registered. Registering
+// an existing discriminator adds to its mapping, but values may not be
+// registered twice. The discriminator is a regular field, so the types
+// should hold it to marshal it back.
+func RegisterPolymorphic(discriminatorField string, mapping map[string]stdreflect.Type) error {
+	if discriminatorField == "" {
+		return fmt.Errorf("polymorphic discriminator field must not be empty")
+	}
+	types := make(map[string]reflect.Type, len(mapping))
+	for value, t := range mapping {
+		if t == nil || t.Kind() == stdreflect.Interface {
+			return fmt.Errorf("polymorphic type for %s %q must be a concrete type, not %v", discriminatorField, value, t)
+		}
+		types[value] = reflect.TypeOf(stdreflect.New(t).Interface()).Elem()
+	}
+
+	polymorphicMappingsMutex.Lock()
+	defer polymorphicMappingsMutex.Unlock()
+	old, _ := polymorphicMappings.Load().([]polymorphicMapping)
+	mappings := make([]polymorphicMapping, len(old), len(old)+1)
+	copy(mappings, old)
+	for i, m := range mappings {
+		if m.field != discriminatorField {
+			continue
+		}
+		for value := range types {
+			if _, found := m.types[value]; found {
+				return fmt.Errorf("polymorphic type for %s %q is already registered", discriminatorField, value)
+			}
+		}
+		merged := make(map[string]reflect.Type, len(m.types)+len(types))
+		for value, t := range m.types {
+			merged[value] = t
+		}
+		for value, t := range types {
+			merged[value] = t
+		}
+		mappings[i].types = merged
+		polymorphicMappings.Store(mappings)
+		return nil
+	}
+	polymorphicMappings.Store(append(mappings, polymorphicMapping{discriminatorField, types}))
+	return nil
+}
+
+// polymorphicValue returns a new value of the type registered for the
+// discriminator of the document at the decoder position, if any and if
+// it may be stored in an interface of type outt.
+func (d *decoder) polymorphicValue(outt reflect.Type) (v reflect.Value, ok bool) {
+	mappings, _ := polymorphicMappings.Load().([]polymorphicMapping)
+	for _, m := range mappings {
+		start := d.i
+		kind, data, found := d.lookup(m.field)
+		d.i = start
+		if !found || kind != 0x02 {
+			continue
+		}
+		t, found := m.types[string(data[4:len(data)-1])]
+		if !found {
+			continue
+		}
+		switch {
+		case t.Implements(outt):
+			return reflect.New(t).Elem(), true
+		case t.Kind() != reflect.Ptr && reflect.PtrTo(t).Implements(outt):
+			return reflect.New(t), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func (d *decoder) getSetter(outt reflect.Type, out reflect.Value) Setter {
+	if d.cache == nil {
+		return getSetter(outt, out)
+	}
+	style, ok := d.cache.setters[outt]
+	if !ok {
+		style = setterStyle(outt)
+		d.cache.setters[outt] = style
+	}
+	return setterFor(style, outt, out)
 }
 
 var typeM = reflect.TypeOf(M{})
 
+// decodeNumbersAsJSONNumber is non-zero if numbers unmarshalled into
+// interface{} values should be held as json.Number values.
+var decodeNumbersAsJSONNumber int32
+
+// SetDecodeNumbersAsJSONNumber sets whether numeric values unmarshalled into
+// interface{} targets, such as the values of a bson.M, are held as
+// json.Number values rather than as int, int64, or float64 values. This
+// preserves their exact representation for later handling, including
+// whether they were integers or floats: 32 and 64-bit integers are held
+// as their decimal representation, and floats always include a decimal
+// point or an exponent. The default is to not use json.Number.
+//
+// Targets with a concrete type are not affected by this setting.
+func SetDecodeNumbersAsJSONNumber(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&decodeNumbersAsJSONNumber, v)
+}
+
+// jsonNumber returns the value held by in as a json.Number if it's a
+// number that should be unmarshalled as such into an interface{} value.
+func jsonNumber(in any) (reflect.Value, bool) {
+	if atomic.LoadInt32(&decodeNumbersAsJSONNumber) == 0 {
+		return reflect.Value{}, false
+	}
+	var n string
+	switch v := in.(type) {
+	case int:
+		n = strconv.Itoa(v)
+	case int64:
+		n = strconv.FormatInt(v, 10)
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return reflect.Value{}, false
+		}
+		n = strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(n, ".e") {
+			n += ".0"
+		}
+	default:
+		return reflect.Value{}, false
+	}
+	return reflect.ValueOf(n).Convert(typeJSONNumber), true
+}
+
 func newDecoder(in []byte) *decoder {
 	return &decoder{in: in, i: 0, docType: typeM}
 }
 
+// decodeInternStrings is non-zero if decoded strings should be interned.
+var decodeInternStrings int32
+
+// SetDecodeInternStrings sets whether short strings decoded repeatedly,
+// such as document keys and enumeration-like values, share a single
+// allocation instead of being allocated each time they are seen. Strings
+// are interned in a small cache shared by all calls made with the same
+// DecodeContext. Plain Unmarshal calls are unaffected, as a cache lasting a
+// single call costs more than it saves. The default is to not intern strings.
+//
+// Decoded strings never share memory with the input data, so the data may
+// be reused after unmarshalling either way.
+func SetDecodeInternStrings(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&decodeInternStrings, v)
+}
+
+const (
+	internMaxLen     = 64   // Longer strings are not interned.
+	internMaxEntries = 4096 // Strings seen after the cache is full are not interned.
+)
+
+// intern returns b as a string, reusing a previous allocation for the
+// same content when interning is enabled.
+func (d *decoder) intern(b []byte) string {
+	if !d.interns || len(b) > internMaxLen {
+		return string(b)
+	}
+	strs := d.cache.strs
+	if s, ok := strs[string(b)]; ok {
+		return s
+	}
+	s := string(b)
+	if strs == nil {
+		strs = make(map[string]string)
+		d.cache.strs = strs
+	}
+	if len(strs) < internMaxEntries {
+		strs[s] = s
+	}
+	return s
+}
+
 // --------------------------------------------------------------------------
 // Some helper functions.
 
@@ -104,7 +355,10 @@ func setterStyle(outt reflect.Type) int {
 }
 
 func getSetter(outt reflect.Type, out reflect.Value) Setter {
-	style := setterStyle(outt)
+	return setterFor(setterStyle(outt), outt, out)
+}
+
+func setterFor(style int, outt reflect.Type, out reflect.Value) Setter {
 	if style == setterNone {
 		return nil
 	}
@@ -119,6 +373,26 @@ func getSetter(outt reflect.Type, out reflect.Value) Setter {
 	return out.Interface().(Setter)
 }
 
+var binaryUnmarshalerIface = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+
+// binaryUnmarshaler returns the encoding.BinaryUnmarshaler to hand the
+// data of a binary element unmarshalled into out, if any, allocating
+// out first if it's a nil pointer.
+func binaryUnmarshaler(out reflect.Value) (encoding.BinaryUnmarshaler, bool) {
+	t := out.Type()
+	switch {
+	case t.Kind() == reflect.Ptr && t.Implements(binaryUnmarshalerIface) && !isOwnKind(t.Elem()):
+		if out.IsNil() {
+			out.Set(reflect.New(t.Elem()))
+		}
+		return out.Interface().(encoding.BinaryUnmarshaler), true
+	case t.Kind() != reflect.Ptr && t.Kind() != reflect.Interface && !isOwnKind(t) &&
+		out.CanAddr() && reflect.PtrTo(t).Implements(binaryUnmarshalerIface):
+		return out.Addr().Interface().(encoding.BinaryUnmarshaler), true
+	}
+	return nil, false
+}
+
 func clearMap(m reflect.Value) {
 	var none reflect.Value
 	for _, k := range m.MapKeys() {
@@ -130,12 +404,14 @@ func (d *decoder) readDocTo(out reflect.Value) {
 	var elemType reflect.Type
 	outt := out.Type()
 	outk := outt.Kind()
+	merge := d.merge
+	d.merge = false // Nested documents replace the values in out.
 
 	for {
 		if outk == reflect.Ptr && out.IsNil() {
 			out.Set(reflect.New(outt.Elem()))
 		}
-		if setter := getSetter(outt, out); setter != nil {
+		if setter := d.getSetter(outt, out); setter != nil {
 			var raw Raw
 			d.readDocTo(reflect.ValueOf(&raw))
 			err := setter.SetBSON(raw)
@@ -159,6 +435,11 @@ func (d *decoder) readDocTo(out reflect.Value) {
 
 	origout := out
 	if outk == reflect.Interface {
+		if v, ok := d.polymorphicValue(outt); ok {
+			d.readDocTo(v)
+			out.Set(v)
+			return
+		}
 		if d.docType.Kind() == reflect.Map {
 			mv := reflect.MakeMap(d.docType)
 			out.Set(mv)
@@ -190,20 +471,22 @@ func (d *decoder) readDocTo(out reflect.Value) {
 		}
 		if out.IsNil() {
 			out.Set(reflect.MakeMap(out.Type()))
-		} else if out.Len() > 0 {
+		} else if out.Len() > 0 && !merge {
 			clearMap(out)
 		}
 	case reflect.Struct:
 		if outt != typeRaw {
-			sinfo, err := getStructInfo(out.Type())
+			sinfo, err := d.getStructInfo(out.Type())
 			if err != nil {
 				panic(err)
 			}
 			fieldsMap = sinfo.FieldsMap
-			out.Set(sinfo.Zero)
+			if !merge {
+				out.Set(sinfo.Zero)
+			}
 			if sinfo.InlineMap != -1 {
 				inlineMap = out.Field(sinfo.InlineMap)
-				if !inlineMap.IsNil() && inlineMap.Len() > 0 {
+				if !inlineMap.IsNil() && inlineMap.Len() > 0 && !merge {
 					clearMap(inlineMap)
 				}
 				elemType = inlineMap.Type().Elem()
@@ -253,10 +536,34 @@ func (d *decoder) readDocTo(out reflect.Value) {
 				d.dropElem(kind)
 			} else {
 				if info, ok := fieldsMap[name]; ok {
+					var field reflect.Value
 					if info.Inline == nil {
-						d.readElemTo(out.Field(info.Num), kind)
+						field = out.Field(info.Num)
 					} else {
-						d.readElemTo(out.FieldByIndex(info.Inline), kind)
+						field = out.FieldByIndex(info.Inline)
+					}
+					start := d.i
+					if d.strict {
+						d.path = append(d.path, name)
+					}
+					if info.Set && kind == 0x04 {
+						d.readSetTo(field)
+					} else if info.Duration != 0 {
+						d.readDurationTo(field, kind, info.Duration)
+					} else if d.readElemTo(field, kind) {
+						if info.Range != nil {
+							info.Range.check(info.Key, field)
+						}
+						if info.Enum != nil {
+							info.Enum.check(info.Key, field)
+						}
+					}
+					if d.strict {
+						d.path = d.path[:len(d.path)-1]
+					}
+					if info.RawAlso != nil {
+						raw := Raw{Kind: kind, Data: d.in[start:d.i]}
+						out.FieldByIndex(info.RawAlso).Set(reflect.ValueOf(raw))
 					}
 				} else if inlineMap.IsValid() {
 					if inlineMap.IsNil() {
@@ -267,6 +574,9 @@ func (d *decoder) readDocTo(out reflect.Value) {
 						inlineMap.SetMapIndex(reflect.ValueOf(name), e)
 					}
 				} else {
+					if d.strict {
+						d.addUnknown(name)
+					}
 					d.dropElem(kind)
 				}
 			}
@@ -323,6 +633,39 @@ func (d *decoder) readArrayDocTo(out reflect.Value) {
 	}
 }
 
+// readSetTo unmarshals an array of keys into out, a map field with the
+// set tag flag, mapping each key to true or to an empty struct.
+func (d *decoder) readSetTo(out reflect.Value) {
+	outt := out.Type()
+	keys := reflect.New(reflect.SliceOf(outt.Key())).Elem()
+	if !d.readElemTo(keys, 0x04) {
+		return
+	}
+	member := reflect.New(outt.Elem()).Elem()
+	if member.Kind() == reflect.Bool {
+		member.SetBool(true)
+	}
+	set := reflect.MakeMap(outt)
+	for i := 0; i < keys.Len(); i++ {
+		set.SetMapIndex(keys.Index(i), member)
+	}
+	out.Set(set)
+}
+
+// readDurationTo unmarshals a number of the given unit into out, a
+// time.Duration field with the duration tag flag. Numbers that don't fit
+// a time.Duration leave out untouched.
+func (d *decoder) readDurationTo(out reflect.Value, kind byte, unit time.Duration) {
+	var n int64
+	if !d.readElemTo(reflect.ValueOf(&n).Elem(), kind) {
+		return
+	}
+	if n > math.MaxInt64/int64(unit) || n < math.MinInt64/int64(unit) {
+		return
+	}
+	out.SetInt(n * int64(unit))
+}
+
 func (d *decoder) readSliceDoc(t reflect.Type) any {
 	tmp := make([]reflect.Value, 0, 8)
 	elemType := t.Elem()
@@ -435,11 +778,93 @@ func (d *decoder) dropElem(kind byte) {
 	d.readElemTo(blackHole, kind)
 }
 
+// skipElem moves past an element of the given kind without decoding it.
+func (d *decoder) skipElem(kind byte) {
+	switch kind {
+	case 0x06, 0x0A, 0xFF, 0x7F: // Undefined, nil, MinKey, MaxKey
+	case 0x08: // Bool
+		d.i++
+	case 0x10: // Int32
+		d.i += 4
+	case 0x01, 0x09, 0x11, 0x12: // Float64, UTC datetime, timestamp, int64
+		d.i += 8
+	case 0x07: // ObjectId
+		d.i += 12
+	case 0x13: // Decimal128
+		d.i += 16
+	case 0x02, 0x0D, 0x0E: // String, JavaScript, Symbol
+		d.skipBytes(d.readInt32())
+	case 0x05: // Binary
+		d.skipBytes(d.readInt32() + 1)
+	case 0x03, 0x04, 0x0F: // Document, array, JavaScript with scope
+		d.skipBytes(d.readInt32() - 4)
+	case 0x0B: // RegEx
+		d.skipCStr()
+		d.skipCStr()
+	case 0x0C: // DBPointer
+		d.skipBytes(d.readInt32() + 12)
+	default:
+		panic(fmt.Sprintf("Unknown element kind (0x%02X)", kind))
+	}
+	if d.i > len(d.in) {
+		corrupted()
+	}
+}
+
+func (d *decoder) skipBytes(length int32) {
+	if length < 0 || int(length) > len(d.in)-d.i {
+		corrupted()
+	}
+	d.i += int(length)
+}
+
+func (d *decoder) skipCStr() {
+	for d.i < len(d.in) && d.in[d.i] != '\x00' {
+		d.i++
+	}
+	if d.i == len(d.in) {
+		corrupted()
+	}
+	d.i++
+}
+
+// lookup returns the kind and data of the element with the given name in
+// the document at the decoder position, skipping over any other elements.
+func (d *decoder) lookup(name string) (kind byte, data []byte, ok bool) {
+	end := int(d.readInt32())
+	end += d.i - 4
+	if end <= d.i || end > len(d.in) || d.in[end-1] != '\x00' {
+		corrupted()
+	}
+	for d.in[d.i] != '\x00' {
+		kind := d.readByte()
+		start := d.i
+		d.skipCStr()
+		found := string(d.in[start:d.i-1]) == name
+		start = d.i
+		d.skipElem(kind)
+		if d.i >= end {
+			corrupted()
+		}
+		if found {
+			return kind, d.in[start:d.i], true
+		}
+	}
+	return 0, nil, false
+}
+
 // Attempt to decode an element from the document and put it into out.
 // If the types are not compatible, the returned ok value will be
 // false and out will be unchanged.
 func (d *decoder) readElemTo(out reflect.Value, kind byte) (good bool) {
 	start := d.i
+	checkDeprecated(kind)
+
+	if kind == 0x03 || kind == 0x04 || kind == 0x0F {
+		d.depth++
+		checkDepth(d.depth + 1) // The top-level document is depth one.
+		defer func() { d.depth-- }()
+	}
 
 	if kind == 0x03 {
 		// Delegate unmarshaling of documents.
@@ -559,7 +984,7 @@ func (d *decoder) readElemTo(out reflect.Value, kind byte) (good bool) {
 		return true
 	}
 
-	if setter := getSetter(outt, out); setter != nil {
+	if setter := d.getSetter(outt, out); setter != nil {
 		err := setter.SetBSON(Raw{Kind: kind, Data: d.in[start:d.i]})
 		if err == SetZero {
 			out.Set(reflect.Zero(outt))
@@ -574,6 +999,19 @@ func (d *decoder) readElemTo(out reflect.Value, kind byte) (good bool) {
 		return false
 	}
 
+	if kind == 0x05 {
+		if unmarshaler, ok := binaryUnmarshaler(out); ok {
+			data, ok := in.([]byte)
+			if !ok {
+				data = in.(Binary).Data
+			}
+			if err := unmarshaler.UnmarshalBinary(data); err != nil {
+				panic(err)
+			}
+			return true
+		}
+	}
+
 	if in == nil {
 		out.Set(reflect.Zero(outt))
 		return true
@@ -613,6 +1051,10 @@ func (d *decoder) readElemTo(out reflect.Value, kind byte) (good bool) {
 
 	switch outk {
 	case reflect.Interface:
+		if n, ok := jsonNumber(in); ok && outt.NumMethod() == 0 {
+			out.Set(n)
+			return true
+		}
 		out.Set(inv)
 		return true
 	case reflect.String:
@@ -773,7 +1215,7 @@ func (d *decoder) readStr() string {
 	if d.readByte() != '\x00' {
 		corrupted()
 	}
-	return string(b)
+	return d.intern(b)
 }
 
 func (d *decoder) readCStr() string {
@@ -789,7 +1231,7 @@ func (d *decoder) readCStr() string {
 	if d.i > l {
 		corrupted()
 	}
-	return string(d.in[start:end])
+	return d.intern(d.in[start:end])
 }
 
 func (d *decoder) readBool() bool {
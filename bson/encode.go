@@ -28,10 +28,14 @@
 package bson
 
 import (
+	"encoding"
 	"fmt"
 	"math"
 	"net/url"
+	"sort"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/3JoB/go-json"
@@ -53,10 +57,99 @@ var (
 	typeRaw            = reflect.TypeOf(Raw{})
 	typeURL            = reflect.TypeOf(url.URL{})
 	typeTime           = reflect.TypeOf(time.Time{})
+	typeDuration       = reflect.TypeOf(time.Duration(0))
 	typeString         = reflect.TypeOf("")
 	typeJSONNumber     = reflect.TypeOf(json.Number(""))
 )
 
+// marshalMaxArrayLen holds the maximum number of elements an array may
+// have to be marshalled, or zero if there's no limit.
+var marshalMaxArrayLen int64
+
+// SetMarshalMaxArrayLen sets the maximum number of elements that any array
+// or slice being marshalled may have. Marshalling a value that holds a
+// larger array, at any nesting level, fails with an error. A limit of zero
+// or less removes the limit, which is the default.
+//
+// The limit does not apply to byte slices and arrays, which are marshalled
+// as binary data, nor to bson.D and other ordered document values.
+func SetMarshalMaxArrayLen(n int) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt64(&marshalMaxArrayLen, int64(n))
+}
+
+func checkArrayLen(name string, v reflect.Value) {
+	max := atomic.LoadInt64(&marshalMaxArrayLen)
+	if max > 0 && int64(v.Len()) > max {
+		panic(fmt.Sprintf("array exceeds max length %d for key %s", max, name))
+	}
+}
+
+// computedField is a document field whose value is computed by a method
+// of the struct being marshalled.
+type computedField struct {
+	key    string
+	method int
+}
+
+var (
+	// computedFields holds a map[reflect.Type][]computedField, replaced
+	// as a whole on registration so that marshalling needs no locking.
+	computedFields      atomic.Value
+	computedFieldsMutex sync.Mutex
+)
+
+// RegisterComputedField registers the method named method of the struct
+// type of value to be called whenever a value of that type is marshalled,
+// with its result stored under key after the fields of the struct. The
+// method must have a value receiver, take no arguments and return a single
+// value, which is marshalled as any field holding it would be: slices and
+// arrays become BSON arrays, and maps and structs become documents.
+//
+// Computed fields are only marshalled. Unmarshalling documents holding
+// them ignores the key unless a struct field takes it.
+func RegisterComputedField(value any, key, method string) error {
+	t := reflect.TypeOf(value)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return fmt.Errorf("computed field %q must be registered on a struct type, not %v", key, t)
+	}
+	m, ok := t.MethodByName(method)
+	if !ok {
+		return fmt.Errorf("type %s has no method %s with a value receiver", t, method)
+	}
+	if m.Type.NumIn() != 1 || m.Type.NumOut() != 1 {
+		return fmt.Errorf("method %s of type %s must take no arguments and return a single value", method, t)
+	}
+	sinfo, err := getStructInfo(t)
+	if err != nil {
+		return err
+	}
+	if _, found := sinfo.FieldsMap[key]; found {
+		return fmt.Errorf("computed field %q of type %s conflicts with struct field", key, t)
+	}
+
+	computedFieldsMutex.Lock()
+	defer computedFieldsMutex.Unlock()
+	old, _ := computedFields.Load().(map[reflect.Type][]computedField)
+	for _, field := range old[t] {
+		if field.key == key {
+			return fmt.Errorf("computed field %q of type %s is already registered", key, t)
+		}
+	}
+	fields := make(map[reflect.Type][]computedField, len(old)+1)
+	for k, v := range old {
+		fields[k] = v
+	}
+	fields[t] = append(fields[t][:len(fields[t]):len(fields[t])], computedField{key, m.Index})
+	computedFields.Store(fields)
+	return nil
+}
+
 const itoaCacheSize = 32
 
 var itoaCache []string
@@ -79,7 +172,8 @@ func itoa(i int) string {
 // Marshaling of the document value itself.
 
 type encoder struct {
-	out []byte
+	out   []byte
+	depth int // Nesting depth of the document being added.
 }
 
 func (e *encoder) addDoc(v reflect.Value) {
@@ -111,6 +205,8 @@ func (e *encoder) addDoc(v reflect.Value) {
 		return
 	}
 
+	e.depth++
+	checkDepth(e.depth)
 	start := e.reserveInt32()
 
 	switch v.Kind() {
@@ -126,6 +222,7 @@ func (e *encoder) addDoc(v reflect.Value) {
 
 	e.addBytes(0)
 	e.setInt32(start, int32(len(e.out)-start))
+	e.depth--
 }
 
 func (e *encoder) addMap(v reflect.Value) {
@@ -161,8 +258,50 @@ func (e *encoder) addStruct(v reflect.Value) {
 		if info.OmitEmpty && isZero(value) {
 			continue
 		}
+		if info.Set {
+			value = setKeys(value)
+		}
+		if info.Duration != 0 {
+			value = reflect.ValueOf(value.Int() / int64(info.Duration))
+		}
 		e.addElem(info.Key, value, info.MinSize)
 	}
+	if fields, _ := computedFields.Load().(map[reflect.Type][]computedField); fields != nil {
+		for _, field := range fields[v.Type()] {
+			e.addElem(field.key, v.Method(field.method).Call(nil)[0], false)
+		}
+	}
+}
+
+// setKeys returns a sorted slice with the keys of m, a map marshalled
+// via the set tag flag. Keys mapped to false are left out.
+func setKeys(m reflect.Value) reflect.Value {
+	mt := m.Type()
+	keys := make([]reflect.Value, 0, m.Len())
+	for _, k := range m.MapKeys() {
+		if mt.Elem().Kind() == reflect.Bool && !m.MapIndex(k).Bool() {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		switch a.Kind() {
+		case reflect.String:
+			return a.String() < b.String()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return a.Int() < b.Int()
+		case reflect.Float32, reflect.Float64:
+			return a.Float() < b.Float()
+		default:
+			return a.Uint() < b.Uint()
+		}
+	})
+	slice := reflect.MakeSlice(reflect.SliceOf(mt.Key()), len(keys), len(keys))
+	for i, k := range keys {
+		slice.Index(i).Set(k)
+	}
+	return slice
 }
 
 func isZero(v reflect.Value) bool {
@@ -236,10 +375,42 @@ func (e *encoder) addSlice(v reflect.Value) {
 	}
 }
 
+var binaryMarshalerIface = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+
+// binaryMarshaler returns v as an encoding.BinaryMarshaler if its data
+// should be marshalled as a binary element. That's not the case of types
+// marshalled in other ways despite implementing the interface, such as
+// time.Time, nor of pointers to values that implement it themselves, which
+// are marshalled once dereferenced.
+func binaryMarshaler(v reflect.Value) (encoding.BinaryMarshaler, bool) {
+	t := v.Type()
+	switch t.Kind() {
+	case reflect.Interface:
+		return nil, false
+	case reflect.Ptr:
+		if v.IsNil() || t.Elem().Implements(binaryMarshalerIface) || isOwnKind(t.Elem()) {
+			return nil, false
+		}
+	default:
+		if isOwnKind(t) {
+			return nil, false
+		}
+	}
+	marshaler, ok := v.Interface().(encoding.BinaryMarshaler)
+	return marshaler, ok
+}
+
+// isOwnKind returns whether t is marshalled as a specific kind of element
+// that takes precedence over the interfaces it implements.
+func isOwnKind(t reflect.Type) bool {
+	return t == typeTime || t == typeURL
+}
+
 // --------------------------------------------------------------------------
 // Marshaling of elements in a document.
 
 func (e *encoder) addElemName(kind byte, name string) {
+	checkDeprecated(kind)
 	e.addBytes(kind)
 	e.addBytes([]byte(name)...)
 	e.addBytes(0)
@@ -260,6 +431,16 @@ func (e *encoder) addElem(name string, v reflect.Value, minSize bool) {
 		return
 	}
 
+	if marshaler, ok := binaryMarshaler(v); ok {
+		data, err := marshaler.MarshalBinary()
+		if err != nil {
+			panic(err)
+		}
+		e.addElemName(0x05, name)
+		e.addBinary(0x00, data)
+		return
+	}
+
 	switch v.Kind() {
 	case reflect.Interface:
 		e.addElem(name, v.Elem(), minSize)
@@ -359,6 +540,7 @@ func (e *encoder) addElem(name string, v reflect.Value, minSize bool) {
 			e.addElemName(0x03, name)
 			e.addDoc(v)
 		} else {
+			checkArrayLen(name, v)
 			e.addElemName(0x04, name)
 			e.addDoc(v)
 		}
@@ -379,6 +561,7 @@ func (e *encoder) addElem(name string, v reflect.Value, minSize bool) {
 				}
 			}
 		} else {
+			checkArrayLen(name, v)
 			e.addElemName(0x04, name)
 			e.addDoc(v)
 		}
@@ -443,6 +626,9 @@ func (e *encoder) addElem(name string, v reflect.Value, minSize bool) {
 		case undefined:
 			e.addElemName(0x06, name)
 
+		case typeHint:
+			e.addHinted(name, s)
+
 		default:
 			e.addElemName(0x03, name)
 			e.addDoc(v)
@@ -453,6 +639,63 @@ func (e *encoder) addElem(name string, v reflect.Value, minSize bool) {
 	}
 }
 
+func (e *encoder) addHinted(name string, h typeHint) {
+	v := reflect.ValueOf(h.value)
+	for v.IsValid() && (v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr) && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.IsValid() {
+		switch k := v.Kind(); {
+		case h.kind == 0x01 && (k >= reflect.Int && k <= reflect.Float64):
+			e.addElemName(0x01, name)
+			switch {
+			case k <= reflect.Int64:
+				e.addFloat64(float64(v.Int()))
+			case k <= reflect.Uintptr:
+				e.addFloat64(float64(v.Uint()))
+			default:
+				e.addFloat64(v.Float())
+			}
+			return
+		case (h.kind == 0x02 || h.kind == 0x0E) && k == reflect.String:
+			e.addElemName(h.kind, name)
+			e.addStr(v.String())
+			return
+		case h.kind == 0x05 && k == reflect.String:
+			e.addElemName(0x05, name)
+			e.addBinary(0x00, []byte(v.String()))
+			return
+		case h.kind == 0x05 && k == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			e.addElemName(0x05, name)
+			e.addBinary(0x00, v.Bytes())
+			return
+		case h.kind == 0x08 && k == reflect.Bool:
+			e.addElem(name, v, false)
+			return
+		case h.kind == 0x10 || h.kind == 0x12:
+			var i int64
+			var ok bool
+			switch {
+			case k >= reflect.Int && k <= reflect.Int64:
+				i, ok = v.Int(), true
+			case k >= reflect.Uint && k <= reflect.Uintptr:
+				i, ok = int64(v.Uint()), int64(v.Uint()) >= 0
+			}
+			if ok && h.kind == 0x10 && i >= math.MinInt32 && i <= math.MaxInt32 {
+				e.addElemName(0x10, name)
+				e.addInt32(int32(i))
+				return
+			}
+			if ok && h.kind == 0x12 {
+				e.addElemName(0x12, name)
+				e.addInt64(i)
+				return
+			}
+		}
+	}
+	panic(fmt.Sprintf("can't marshal %#v as BSON kind 0x%02x for key %s", h.value, h.kind, name))
+}
+
 // --------------------------------------------------------------------------
 // Marshaling of base types.
 
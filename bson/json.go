@@ -3,9 +3,14 @@ package bson
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/3JoB/mgo/internal/json"
 )
@@ -379,3 +384,259 @@ func jdecUndefined(data []byte) (any, error) {
 func jencUndefined(v any) ([]byte, error) {
 	return []byte(`{"$undefined":true}`), nil
 }
+
+// --------------------------------------------------------------------------
+// Canonical Extended JSON.
+
+// MarshalCanonicalExtJSON marshals value into the canonical form of the
+// Extended JSON v2 format, matching the output of
+// mongoexport --jsonFormat=canonical. Unlike MarshalJSON, every value is
+// annotated with its exact BSON type so that it may be converted back
+// without any loss. For example, int32 values are output as
+// {"$numberInt":"1"}, int64 values as {"$numberLong":"1"}, float64 values
+// as {"$numberDouble":"1.0"}, and dates as {"$date":{"$numberLong":"0"}}.
+//
+// The value is first marshalled as BSON, so it may be anything accepted as a
+// document or as a field value by Marshal. Document fields are output in
+// their BSON order, without insignificant whitespace or a trailing newline.
+//
+// Relevant documentation:
+//
+//	https://github.com/mongodb/specifications/blob/master/source/extended-json.rst
+func MarshalCanonicalExtJSON(value any) (out []byte, err error) {
+	data, err := Marshal(D{{Name: "", Value: value}})
+	if err != nil {
+		return nil, err
+	}
+	defer handleErr(&err)
+	e := &extJSONEncoder{in: data}
+	e.readInt32()
+	kind := e.readByte()
+	e.readCStr()
+	e.writeElem(kind)
+	return e.out.Bytes(), nil
+}
+
+type extJSONEncoder struct {
+	in  []byte
+	i   int
+	out bytes.Buffer
+}
+
+func (e *extJSONEncoder) writeDoc(array bool) {
+	start := e.i
+	end := start + int(e.readInt32())
+	if end <= start || end > len(e.in) {
+		corrupted()
+	}
+	if array {
+		e.out.WriteByte('[')
+	} else {
+		e.out.WriteByte('{')
+	}
+	for first := true; e.i < end-1; first = false {
+		kind := e.readByte()
+		name := e.readCStr()
+		if !first {
+			e.out.WriteByte(',')
+		}
+		if !array {
+			e.writeStr(name)
+			e.out.WriteByte(':')
+		}
+		e.writeElem(kind)
+	}
+	if e.i != end-1 || e.readByte() != 0 {
+		corrupted()
+	}
+	if array {
+		e.out.WriteByte(']')
+	} else {
+		e.out.WriteByte('}')
+	}
+}
+
+func (e *extJSONEncoder) writeElem(kind byte) {
+	switch kind {
+	case 0x01: // Float64
+		f := math.Float64frombits(uint64(e.readInt64()))
+		fmt.Fprintf(&e.out, `{"$numberDouble":"%s"}`, formatExtJSONDouble(f))
+	case 0x02: // UTF-8 string
+		e.writeStr(e.readStr())
+	case 0x03: // Document
+		e.writeDoc(false)
+	case 0x04: // Array
+		e.writeDoc(true)
+	case 0x05: // Binary
+		l := int(e.readInt32())
+		kind := e.readByte()
+		data := e.readBytes(l)
+		if kind == 0x02 && len(data) >= 4 {
+			data = data[4:]
+		}
+		fmt.Fprintf(&e.out, `{"$binary":{"base64":"%s","subType":"%02x"}}`, base64.StdEncoding.EncodeToString(data), kind)
+	case 0x06: // Undefined (obsolete, but still seen in the wild)
+		e.out.WriteString(`{"$undefined":true}`)
+	case 0x07: // ObjectId
+		fmt.Fprintf(&e.out, `{"$oid":"%x"}`, e.readBytes(12))
+	case 0x08: // Bool
+		switch e.readByte() {
+		case 0:
+			e.out.WriteString("false")
+		case 1:
+			e.out.WriteString("true")
+		default:
+			corrupted()
+		}
+	case 0x09: // UTC datetime
+		fmt.Fprintf(&e.out, `{"$date":{"$numberLong":"%d"}}`, e.readInt64())
+	case 0x0A: // Nil
+		e.out.WriteString("null")
+	case 0x0B: // RegEx
+		pattern := e.readCStr()
+		options := []byte(e.readCStr())
+		sort.Slice(options, func(i, j int) bool { return options[i] < options[j] })
+		e.out.WriteString(`{"$regularExpression":{"pattern":`)
+		e.writeStr(pattern)
+		e.out.WriteString(`,"options":`)
+		e.writeStr(string(options))
+		e.out.WriteString(`}}`)
+	case 0x0C: // DBPointer
+		e.out.WriteString(`{"$dbPointer":{"$ref":`)
+		e.writeStr(e.readStr())
+		fmt.Fprintf(&e.out, `,"$id":{"$oid":"%x"}}}`, e.readBytes(12))
+	case 0x0D: // JavaScript without scope
+		e.out.WriteString(`{"$code":`)
+		e.writeStr(e.readStr())
+		e.out.WriteByte('}')
+	case 0x0E: // Symbol
+		e.out.WriteString(`{"$symbol":`)
+		e.writeStr(e.readStr())
+		e.out.WriteByte('}')
+	case 0x0F: // JavaScript with scope
+		e.readInt32()
+		e.out.WriteString(`{"$code":`)
+		e.writeStr(e.readStr())
+		e.out.WriteString(`,"$scope":`)
+		e.writeDoc(false)
+		e.out.WriteByte('}')
+	case 0x10: // Int32
+		fmt.Fprintf(&e.out, `{"$numberInt":"%d"}`, e.readInt32())
+	case 0x11: // Mongo-specific timestamp
+		ts := uint64(e.readInt64())
+		fmt.Fprintf(&e.out, `{"$timestamp":{"t":%d,"i":%d}}`, ts>>32, uint32(ts))
+	case 0x12: // Int64
+		fmt.Fprintf(&e.out, `{"$numberLong":"%d"}`, e.readInt64())
+	case 0x13: // Decimal128
+		d := Decimal128{l: uint64(e.readInt64()), h: uint64(e.readInt64())}
+		fmt.Fprintf(&e.out, `{"$numberDecimal":"%s"}`, d.String())
+	case 0x7F: // Max key
+		e.out.WriteString(`{"$maxKey":1}`)
+	case 0xFF: // Min key
+		e.out.WriteString(`{"$minKey":1}`)
+	default:
+		panic(fmt.Sprintf("Unknown element kind (0x%02X)", kind))
+	}
+}
+
+// formatExtJSONDouble formats f as the string held by $numberDouble,
+// always including a decimal point or an exponent.
+func formatExtJSONDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	s := strconv.FormatFloat(f, 'G', -1, 64)
+	if !strings.ContainsAny(s, ".E") {
+		s += ".0"
+	}
+	return s
+}
+
+const hexDigits = "0123456789abcdef"
+
+// writeStr writes s as a quoted JSON string. Unlike encoding/json, HTML
+// characters are not escaped, as mongoexport doesn't escape them either.
+func (e *extJSONEncoder) writeStr(s string) {
+	e.out.WriteByte('"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				e.out.WriteByte('\\')
+				e.out.WriteByte(c)
+			case c == '\n':
+				e.out.WriteString(`\n`)
+			case c == '\r':
+				e.out.WriteString(`\r`)
+			case c == '\t':
+				e.out.WriteString(`\t`)
+			case c < 0x20:
+				e.out.WriteString(`\u00`)
+				e.out.WriteByte(hexDigits[c>>4])
+				e.out.WriteByte(hexDigits[c&0xF])
+			default:
+				e.out.WriteByte(c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			e.out.WriteString(`\ufffd`)
+		case r == '\u2028' || r == '\u2029':
+			e.out.WriteString(`\u202`)
+			e.out.WriteByte(hexDigits[r&0xF])
+		default:
+			e.out.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	e.out.WriteByte('"')
+}
+
+func (e *extJSONEncoder) readByte() byte {
+	return e.readBytes(1)[0]
+}
+
+func (e *extJSONEncoder) readBytes(n int) []byte {
+	if n < 0 || n > len(e.in)-e.i {
+		corrupted()
+	}
+	b := e.in[e.i : e.i+n]
+	e.i += n
+	return b
+}
+
+func (e *extJSONEncoder) readInt32() int32 {
+	return int32(binary.LittleEndian.Uint32(e.readBytes(4)))
+}
+
+func (e *extJSONEncoder) readInt64() int64 {
+	return int64(binary.LittleEndian.Uint64(e.readBytes(8)))
+}
+
+func (e *extJSONEncoder) readCStr() string {
+	end := bytes.IndexByte(e.in[e.i:], 0)
+	if end < 0 {
+		corrupted()
+	}
+	s := string(e.in[e.i : e.i+end])
+	e.i += end + 1
+	return s
+}
+
+func (e *extJSONEncoder) readStr() string {
+	l := int(e.readInt32())
+	b := e.readBytes(l)
+	if l < 1 || b[l-1] != 0 {
+		corrupted()
+	}
+	return string(b[:l-1])
+}
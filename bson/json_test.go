@@ -1,6 +1,7 @@
 package bson_test
 
 import (
+	"math"
 	"strings"
 	"time"
 
@@ -183,3 +184,84 @@ func (s *S) TestJSON(c *C) {
 		c.Assert(value, DeepEquals, item.c)
 	}
 }
+
+// Expected outputs follow the canonical representations defined by the
+// Extended JSON v2 specification. Values that aren't documents are output
+// as they would be when found as a document field.
+var canonicalExtJSONTests = []struct {
+	value any
+	json  string
+}{
+	{int32(1), `{"$numberInt":"1"}`},
+	{int32(-2147483648), `{"$numberInt":"-2147483648"}`},
+	{int64(1), `{"$numberLong":"1"}`},
+	{int64(-9223372036854775808), `{"$numberLong":"-9223372036854775808"}`},
+	{1.0, `{"$numberDouble":"1.0"}`},
+	{-1.0001, `{"$numberDouble":"-1.0001"}`},
+	{1.2345678921232e18, `{"$numberDouble":"1.2345678921232E+18"}`},
+	{math.Copysign(0, -1), `{"$numberDouble":"-0.0"}`},
+	{math.Inf(1), `{"$numberDouble":"Infinity"}`},
+	{math.Inf(-1), `{"$numberDouble":"-Infinity"}`},
+	{math.NaN(), `{"$numberDouble":"NaN"}`},
+	{bson.ObjectIdHex("57e193d7a9cc81b4027498b5"), `{"$oid":"57e193d7a9cc81b4027498b5"}`},
+	{time.Date(2016, 5, 15, 1, 2, 3, 4000000, time.UTC), `{"$date":{"$numberLong":"1463274123004"}}`},
+	{time.Date(1960, 1, 1, 0, 0, 0, 0, time.UTC), `{"$date":{"$numberLong":"-315619200000"}}`},
+	{[]byte("foo"), `{"$binary":{"base64":"Zm9v","subType":"00"}}`},
+	{bson.Binary{Kind: 0x02, Data: []byte("foo")}, `{"$binary":{"base64":"Zm9v","subType":"02"}}`},
+	{bson.Binary{Kind: 0x80, Data: []byte("foo")}, `{"$binary":{"base64":"Zm9v","subType":"80"}}`},
+	{bson.RegEx{Pattern: "a*b", Options: "xi"}, `{"$regularExpression":{"pattern":"a*b","options":"ix"}}`},
+	{bson.MongoTimestamp(4294967298), `{"$timestamp":{"t":1,"i":2}}`},
+	{bson.JavaScript{Code: "x"}, `{"$code":"x"}`},
+	{bson.JavaScript{Code: "x", Scope: bson.D{{Name: "y", Value: int32(1)}}}, `{"$code":"x","$scope":{"y":{"$numberInt":"1"}}}`},
+	{bson.Symbol("sym"), `{"$symbol":"sym"}`},
+	{bson.DBPointer{Namespace: "db.c", Id: bson.ObjectIdHex("57e193d7a9cc81b4027498b5")}, `{"$dbPointer":{"$ref":"db.c","$id":{"$oid":"57e193d7a9cc81b4027498b5"}}}`},
+	{bson.MinKey, `{"$minKey":1}`},
+	{bson.MaxKey, `{"$maxKey":1}`},
+	{bson.Undefined, `{"$undefined":true}`},
+	{nil, `null`},
+	{true, `true`},
+	{"a\"b\\c\n<>&\x01é", `"a\"b\\c\n<>&\u0001é"`},
+	{[]any{int32(1), "a", nil}, `[{"$numberInt":"1"},"a",null]`},
+	{
+		bson.D{
+			{Name: "_id", Value: bson.ObjectIdHex("57e193d7a9cc81b4027498b5")},
+			{Name: "name", Value: "Joe"},
+			{Name: "age", Value: int32(40)},
+			{Name: "tags", Value: []string{"a", "b"}},
+			{Name: "nested", Value: bson.D{{Name: "n", Value: int64(3)}}},
+		},
+		`{"_id":{"$oid":"57e193d7a9cc81b4027498b5"},"name":"Joe","age":{"$numberInt":"40"},` +
+			`"tags":["a","b"],"nested":{"n":{"$numberLong":"3"}}}`,
+	},
+	{
+		struct {
+			A float64
+			B int64 `bson:"b"`
+		}{1.5, 2},
+		`{"a":{"$numberDouble":"1.5"},"b":{"$numberLong":"2"}}`,
+	},
+}
+
+func (s *S) TestMarshalCanonicalExtJSON(c *C) {
+	for i, item := range canonicalExtJSONTests {
+		c.Logf("------------ (#%d)", i)
+		data, err := bson.MarshalCanonicalExtJSON(item.value)
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, item.json)
+	}
+}
+
+func (s *S) TestMarshalCanonicalExtJSONDecimal(c *C) {
+	for _, str := range []string{"1.0", "-1.00E-8", "NaN", "Infinity", "-0"} {
+		d, err := bson.ParseDecimal128(str)
+		c.Assert(err, IsNil)
+		data, err := bson.MarshalCanonicalExtJSON(bson.M{"d": d})
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, `{"d":{"$numberDecimal":"`+d.String()+`"}}`)
+	}
+}
+
+func (s *S) TestMarshalCanonicalExtJSONError(c *C) {
+	_, err := bson.MarshalCanonicalExtJSON(make(chan int))
+	c.Assert(err, NotNil)
+}
@@ -51,20 +51,45 @@ type BulkResult struct {
 	Matched  int
 	Modified int // Available only for MongoDB 2.6+
 
+	// Upserted holds the documents inserted by upsert operations, ordered
+	// by the index of the respective operation. Ids of documents upserted
+	// with an explicit _id are only reported by MongoDB 2.6+.
+	Upserted []BulkUpsert
+
 	// Be conservative while we understand exactly how to report these
 	// results in a useful and convenient way, and also how to emulate
 	// them with prior servers.
 	private bool
 }
 
+// BulkUpsert identifies a document inserted by an upsert operation.
+type BulkUpsert struct {
+	Index int // Position of the operation in the bulk, counting from zero.
+	Id    any // The _id of the inserted document.
+}
+
 // BulkError holds an error returned from running a Bulk operation.
 // Individual errors may be obtained and inspected via the Cases method.
+//
+// WriteErrors and WriteConcernError tell apart the two kinds of errors
+// the server may report: WriteErrors holds the errors that prevented
+// individual documents from being written, while WriteConcernError holds
+// the error reported when the writes were applied but the requested write
+// concern could not be satisfied. Both may be set at once. For backwards
+// compatibility, Cases also reports a write concern error in place of each
+// affected operation when no write errors are reported for them.
 type BulkError struct {
 	ecases []BulkErrorCase
+
+	WriteErrors       []BulkErrorCase
+	WriteConcernError *WriteConcernError
 }
 
 func (e *BulkError) Error() string {
 	if len(e.ecases) == 0 {
+		if e.WriteConcernError != nil {
+			return e.WriteConcernError.Error()
+		}
 		return "invalid BulkError instance: no errors"
 	}
 	if len(e.ecases) == 1 {
@@ -114,12 +139,28 @@ type BulkErrorCase struct {
 }
 
 // Cases returns all individual errors found while attempting the requested changes.
+// In unordered mode, these are the errors of every failed operation, ordered
+// by the position of the operation. In ordered mode, the bulk operation stops
+// at the first failure, so only its error is reported.
 //
 // See the documentation of BulkErrorCase for limitations in older MongoDB releases.
 func (e *BulkError) Cases() []BulkErrorCase {
 	return e.ecases
 }
 
+// Unwrap returns the errors of the individual cases, followed by the write
+// concern error if any, so that errors.Is and errors.As may inspect them.
+func (e *BulkError) Unwrap() []error {
+	errs := make([]error, 0, len(e.ecases)+1)
+	for _, ecase := range e.ecases {
+		errs = append(errs, ecase.Err)
+	}
+	if e.WriteConcernError != nil {
+		errs = append(errs, e.WriteConcernError)
+	}
+	return errs
+}
+
 // Bulk returns a value to prepare the execution of a bulk operation.
 func (c *Collection) Bulk() *Bulk {
 	return &Bulk{c: c, ordered: true}
@@ -160,7 +201,7 @@ func (b *Bulk) action(op bulkOp, opcount int) *bulkAction {
 // Insert queues up the provided documents for insertion.
 func (b *Bulk) Insert(docs ...any) {
 	action := b.action(bulkInsert, len(docs))
-	action.docs = append(action.docs, docs...)
+	action.docs = append(action.docs, withIds(docs)...)
 }
 
 // Remove queues up the provided selectors for removing matching documents.
@@ -249,7 +290,7 @@ func (b *Bulk) UpdateAll(pairs ...any) {
 // Each pair matches exactly one document for updating at most.
 func (b *Bulk) Upsert(pairs ...any) {
 	if len(pairs)%2 != 0 {
-		panic("Bulk.Update requires an even number of parameters")
+		panic("Bulk.Upsert requires an even number of parameters")
 	}
 	action := b.action(bulkUpdate, len(pairs)/2)
 	for i := 0; i < len(pairs); i += 2 {
@@ -299,8 +340,10 @@ func (b *Bulk) Run() (*BulkResult, error) {
 	}
 	if failed {
 		sort.Sort(bulkErrorCases(berr.ecases))
+		sort.Sort(bulkErrorCases(berr.WriteErrors))
 		return nil, &berr
 	}
+	sort.Slice(result.Upserted, func(i, j int) bool { return result.Upserted[i].Index < result.Upserted[j].Index })
 	return &result, nil
 }
 
@@ -318,6 +361,9 @@ func (b *Bulk) runUpdate(action *bulkAction, result *BulkResult, berr *BulkError
 	if lerr != nil {
 		result.Matched += lerr.N
 		result.Modified += lerr.modified
+		for _, upsert := range lerr.upserted {
+			result.Upserted = append(result.Upserted, BulkUpsert{Index: action.idxs[upsert.Index], Id: upsert.Id})
+		}
 	}
 	return b.checkSuccess(action, berr, lerr, err)
 }
@@ -332,6 +378,9 @@ func (b *Bulk) runRemove(action *bulkAction, result *BulkResult, berr *BulkError
 }
 
 func (b *Bulk) checkSuccess(action *bulkAction, berr *BulkError, lerr *LastError, err error) bool {
+	if lerr != nil && lerr.wcerr != nil {
+		berr.WriteConcernError = lerr.wcerr
+	}
 	if lerr != nil && len(lerr.ecases) > 0 {
 		for i := 0; i < len(lerr.ecases); i++ {
 			// Map back from the local error index into the visible one.
@@ -340,7 +389,9 @@ func (b *Bulk) checkSuccess(action *bulkAction, berr *BulkError, lerr *LastError
 			if idx >= 0 {
 				idx = action.idxs[idx]
 			}
-			berr.ecases = append(berr.ecases, BulkErrorCase{Index: idx, Err: ecase.Err})
+			ecase = BulkErrorCase{Index: idx, Err: ecase.Err}
+			berr.ecases = append(berr.ecases, ecase)
+			berr.WriteErrors = append(berr.WriteErrors, ecase)
 		}
 		return false
 	} else if err != nil {
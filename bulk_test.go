@@ -27,9 +27,12 @@
 package mgo_test
 
 import (
+	"errors"
+
 	. "gopkg.in/check.v1"
 
 	"github.com/3JoB/mgo"
+	"github.com/3JoB/mgo/bson"
 )
 
 func (s *S) TestBulkInsert(c *C) {
@@ -216,6 +219,104 @@ func (s *S) TestBulkErrorCases_2_6(c *C) {
 	c.Check(ecases[2].Index, Equals, 1008)
 }
 
+func (s *S) TestBulkErrorCasesUnorderedUpdates(c *C) {
+	if !s.versionAtLeast(2, 6) {
+		c.Skip("2.4- has poor bulk reporting")
+	}
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.EnsureIndex(mgo.Index{Key: []string{"n"}, Unique: true})
+	c.Assert(err, IsNil)
+
+	// Failures past the first command of a split batch are reported
+	// with their position in the bulk, and the rest are applied.
+	bulk := coll.Bulk()
+	bulk.Unordered()
+	for i := 0; i < 1500; i++ {
+		n := i
+		if i == 10 || i == 1200 {
+			n = 0
+		}
+		bulk.Upsert(M{"_id": i}, M{"$set": M{"n": n}})
+	}
+	_, err = bulk.Run()
+	c.Assert(err, NotNil)
+	ecases := err.(*mgo.BulkError).Cases()
+	c.Assert(ecases, HasLen, 2)
+	c.Assert(ecases[0].Index, Equals, 10)
+	c.Assert(ecases[1].Index, Equals, 1200)
+	for _, ecase := range ecases {
+		c.Assert(mgo.IsDup(ecase.Err), Equals, true)
+	}
+
+	var qerr *mgo.QueryError
+	c.Assert(errors.As(err, &qerr), Equals, true)
+	c.Assert(qerr.Code, Equals, 11000)
+	c.Assert(errors.Is(err, ecases[1].Err), Equals, true)
+
+	n, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1498)
+}
+
+func (s *S) TestBulkWriteAndConcernErrors(c *C) {
+	err := mgo.BulkErrorFromReply(bson.M{
+		"ok": 1,
+		"n":  1,
+		"writeErrors": []bson.M{
+			{"index": 0, "code": 121, "errmsg": "Document failed validation"},
+			{"index": 2, "code": 11000, "errmsg": "E11000 duplicate key error"},
+		},
+		"writeConcernError": bson.M{"code": 64, "errmsg": "waiting for replication timed out"},
+	}, 3)
+
+	berr, ok := err.(*mgo.BulkError)
+	c.Assert(ok, Equals, true)
+	c.Assert(berr.WriteErrors, HasLen, 2)
+	c.Assert(berr.WriteErrors[0].Index, Equals, 0)
+	c.Assert(berr.WriteErrors[0].Err, ErrorMatches, "Document failed validation")
+	c.Assert(berr.WriteErrors[1].Index, Equals, 2)
+	c.Assert(berr.WriteErrors[1].Err, ErrorMatches, "E11000 duplicate key error")
+	c.Assert(berr.WriteConcernError, DeepEquals, &mgo.WriteConcernError{Code: 64, ErrMsg: "waiting for replication timed out"})
+	c.Assert(berr.Cases(), HasLen, 2)
+
+	// Only a write concern error.
+	err = mgo.BulkErrorFromReply(bson.M{
+		"ok":                1,
+		"n":                 2,
+		"writeConcernError": bson.M{"code": 64, "errmsg": "waiting for replication timed out"},
+	}, 2)
+
+	berr, ok = err.(*mgo.BulkError)
+	c.Assert(ok, Equals, true)
+	c.Assert(berr.WriteErrors, HasLen, 0)
+	c.Assert(berr.WriteConcernError, NotNil)
+	c.Assert(berr.WriteConcernError.Code, Equals, 64)
+	c.Assert(berr, ErrorMatches, "waiting for replication timed out")
+
+	// Only write errors.
+	err = mgo.BulkErrorFromReply(bson.M{
+		"ok": 1,
+		"n":  0,
+		"writeErrors": []bson.M{
+			{"index": 1, "code": 11000, "errmsg": "E11000 duplicate key error"},
+		},
+	}, 2)
+
+	berr, ok = err.(*mgo.BulkError)
+	c.Assert(ok, Equals, true)
+	c.Assert(berr.WriteErrors, HasLen, 1)
+	c.Assert(berr.WriteErrors[0].Index, Equals, 1)
+	c.Assert(berr.WriteConcernError, IsNil)
+
+	// No errors at all.
+	err = mgo.BulkErrorFromReply(bson.M{"ok": 1, "n": 2}, 2)
+	c.Assert(err, IsNil)
+}
+
 func (s *S) TestBulkErrorCases_2_4(c *C) {
 	if s.versionAtLeast(2, 6) {
 		c.Skip("2.6+ has better reporting")
@@ -448,12 +549,66 @@ func (s *S) TestBulkUpsert(c *C) {
 	r, err := bulk.Run()
 	c.Assert(err, IsNil)
 	c.Assert(r, FitsTypeOf, &mgo.BulkResult{})
+	c.Assert(r.Upserted, HasLen, 1)
+	c.Assert(r.Upserted[0].Index, Equals, 1)
+	c.Assert(r.Upserted[0].Id, FitsTypeOf, bson.ObjectId(""))
 
 	type doc struct{ N int }
 	var res []doc
 	err = coll.Find(nil).Sort("n").All(&res)
 	c.Assert(err, IsNil)
 	c.Assert(res, DeepEquals, []doc{{N: 1}, {N: 20}, {N: 30}, {N: 40}})
+
+	var upserted struct {
+		Id bson.ObjectId `bson:"_id"`
+	}
+	err = coll.Find(M{"n": 40}).One(&upserted)
+	c.Assert(err, IsNil)
+	c.Assert(upserted.Id, Equals, r.Upserted[0].Id)
+}
+
+func (s *S) TestBulkUpsertMany(c *C) {
+	if !s.versionAtLeast(2, 6) {
+		c.Skip("write commands depend on 2.6+")
+	}
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(M{"_id": 1}, M{"_id": 2001})
+	c.Assert(err, IsNil)
+
+	// More upserts than fit in a single write command, interleaved
+	// with other operations, still report their overall indexes.
+	bulk := coll.Bulk()
+	bulk.Unordered()
+	bulk.Insert(M{"_id": -1})
+	for i := 0; i < 2500; i++ {
+		bulk.Upsert(M{"_id": i}, M{"$set": M{"n": i}})
+		if i == 1500 {
+			bulk.Remove(M{"_id": -1})
+		}
+	}
+	r, err := bulk.Run()
+	c.Assert(err, IsNil)
+	c.Assert(r.Upserted, HasLen, 2498)
+	for _, upsert := range r.Upserted {
+		id := upsert.Id.(int)
+		c.Assert(id != 1 && id != 2001, Equals, true)
+		index := id + 1
+		if id > 1500 {
+			index++
+		}
+		c.Assert(upsert.Index, Equals, index)
+	}
+	for i := 1; i < len(r.Upserted); i++ {
+		c.Assert(r.Upserted[i-1].Index < r.Upserted[i].Index, Equals, true)
+	}
+
+	n, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2500)
 }
 
 func (s *S) TestBulkRemove(c *C) {
@@ -61,16 +61,23 @@ type mongoCluster struct {
 	cachedIndex  map[string]bool
 	sync         chan bool
 	dial         dialer
+	minPoolSize  int
+
+	changed   func(change TopologyChange)
+	changedMu sync.Mutex
+	handler   func(desc TopologyDescription)
 }
 
-func newCluster(userSeeds []string, direct, failFast bool, dial dialer, setName string) *mongoCluster {
+func newCluster(userSeeds []string, direct, failFast bool, dial dialer, setName string, minPoolSize int, changed func(change TopologyChange)) *mongoCluster {
 	cluster := &mongoCluster{
-		userSeeds:  userSeeds,
-		references: 1,
-		direct:     direct,
-		failFast:   failFast,
-		dial:       dial,
-		setName:    setName,
+		userSeeds:   userSeeds,
+		references:  1,
+		direct:      direct,
+		failFast:    failFast,
+		dial:        dial,
+		setName:     setName,
+		minPoolSize: minPoolSize,
+		changed:     changed,
 	}
 	cluster.serverSynced.L = cluster.RWMutex.RLocker()
 	cluster.sync = make(chan bool, 1)
@@ -83,7 +90,7 @@ func newCluster(userSeeds []string, direct, failFast bool, dial dialer, setName
 func (cluster *mongoCluster) Acquire() {
 	cluster.Lock()
 	cluster.references++
-	debugf("Cluster %p acquired (refs=%d)", cluster, cluster.references)
+	debugf(LogTopology, "Cluster %p acquired (refs=%d)", cluster, cluster.references)
 	cluster.Unlock()
 }
 
@@ -95,7 +102,7 @@ func (cluster *mongoCluster) Release() {
 		panic("cluster.Release() with references == 0")
 	}
 	cluster.references--
-	debugf("Cluster %p released (refs=%d)", cluster, cluster.references)
+	debugf(LogTopology, "Cluster %p released (refs=%d)", cluster, cluster.references)
 	if cluster.references == 0 {
 		for _, server := range cluster.servers.Slice() {
 			server.Close()
@@ -116,6 +123,17 @@ func (cluster *mongoCluster) LiveServers() (servers []string) {
 	return servers
 }
 
+// PoolStats returns the socket pool details of all known servers.
+func (cluster *mongoCluster) PoolStats() (stats []PoolStats) {
+	cluster.RLock()
+	servers := cluster.servers.Slice()
+	cluster.RUnlock()
+	for _, server := range servers {
+		stats = append(stats, server.PoolStats())
+	}
+	return stats
+}
+
 func (cluster *mongoCluster) removeServer(server *mongoServer) {
 	cluster.Lock()
 	cluster.masters.Remove(server)
@@ -123,11 +141,164 @@ func (cluster *mongoCluster) removeServer(server *mongoServer) {
 	cluster.Unlock()
 	if other != nil {
 		other.Close()
-		log("Removed server ", server.Addr, " from cluster.")
+		log(LogTopology, "Removed server ", server.Addr, " from cluster.")
+		cluster.notifyChange(ServerRemoved, server.Addr, false)
 	}
 	server.Close()
 }
 
+// ServerChangeKind identifies the kind of change reported in a
+// TopologyChange.
+type ServerChangeKind int
+
+const (
+	// ServerAdded reports a server that joined the cluster.
+	ServerAdded ServerChangeKind = iota
+
+	// ServerRemoved reports a server that left the cluster, either
+	// because it became unreachable or because it's no longer a member.
+	ServerRemoved
+
+	// ServerRoleChanged reports a server that became a master or
+	// stopped being one, as happens during elections.
+	ServerRoleChanged
+)
+
+func (kind ServerChangeKind) String() string {
+	switch kind {
+	case ServerAdded:
+		return "added"
+	case ServerRemoved:
+		return "removed"
+	case ServerRoleChanged:
+		return "role changed"
+	}
+	return fmt.Sprintf("ServerChangeKind(%d)", int(kind))
+}
+
+// TopologyChange describes a change in the servers of a cluster. See
+// DialInfo.TopologyChanged.
+type TopologyChange struct {
+	Kind ServerChangeKind
+
+	// Addr is the address of the server that changed.
+	Addr string
+
+	// Master reports whether the server is a master after the change.
+	// It is always false for removed servers.
+	Master bool
+
+	// LiveServers holds the addresses of the servers known to be alive
+	// right after the change, as returned by Session.LiveServers.
+	LiveServers []string
+}
+
+// ServerType is the role of a server within the cluster topology.
+type ServerType int
+
+const (
+	ServerStandalone ServerType = iota
+	ServerPrimary
+	ServerSecondary
+	ServerMongos
+)
+
+func (t ServerType) String() string {
+	switch t {
+	case ServerStandalone:
+		return "standalone"
+	case ServerPrimary:
+		return "primary"
+	case ServerSecondary:
+		return "secondary"
+	case ServerMongos:
+		return "mongos"
+	}
+	return fmt.Sprintf("ServerType(%d)", int(t))
+}
+
+// ServerDescription describes a server known to be alive in the cluster.
+type ServerDescription struct {
+	Addr string
+	Type ServerType
+
+	// Tags holds the replica set tags of the server, if any.
+	Tags bson.D
+
+	// Ping is the weighted average round-trip time to the server, or
+	// zero if it wasn't measured yet.
+	Ping time.Duration
+}
+
+// TopologyDescription describes the servers of a cluster at some point.
+// Arbiters are not part of it, as they never serve operations. See
+// Session.SetTopologyChangeHandler.
+type TopologyDescription struct {
+	// Primary is the address of the replica set primary, or empty if
+	// there is none or the cluster is not a replica set.
+	Primary string
+
+	Servers []ServerDescription
+}
+
+// Description returns the current description of the cluster topology.
+func (cluster *mongoCluster) Description() TopologyDescription {
+	cluster.RLock()
+	servers := cluster.servers.Slice()
+	cluster.RUnlock()
+	var desc TopologyDescription
+	for _, server := range servers {
+		server.Lock()
+		info := server.info
+		sd := ServerDescription{Addr: server.Addr, Tags: info.Tags}
+		if server.pingCount > 0 {
+			sd.Ping = server.pingValue
+		}
+		server.Unlock()
+		switch {
+		case info.Mongos:
+			sd.Type = ServerMongos
+		case info.Master && info.SetName != "":
+			sd.Type = ServerPrimary
+			desc.Primary = server.Addr
+		case info.Master:
+			sd.Type = ServerStandalone
+		default:
+			sd.Type = ServerSecondary
+		}
+		desc.Servers = append(desc.Servers, sd)
+	}
+	return desc
+}
+
+// SetTopologyChangeHandler sets the function called with the topology
+// description whenever the servers in the cluster change.
+func (cluster *mongoCluster) SetTopologyChangeHandler(handler func(desc TopologyDescription)) {
+	cluster.changedMu.Lock()
+	cluster.handler = handler
+	cluster.changedMu.Unlock()
+}
+
+// notifyChange reports a change of the server at addr to the callback
+// provided in DialInfo.TopologyChanged and to the topology change handler,
+// if any. It must not be called with the cluster lock held. Callbacks are
+// serialized, so that they observe the changes in order.
+func (cluster *mongoCluster) notifyChange(kind ServerChangeKind, addr string, master bool) {
+	cluster.changedMu.Lock()
+	defer cluster.changedMu.Unlock()
+	if cluster.changed != nil {
+		cluster.changed(TopologyChange{
+			Kind:        kind,
+			Addr:        addr,
+			Master:      master,
+			LiveServers: cluster.LiveServers(),
+		})
+	}
+	if cluster.handler != nil {
+		cluster.handler(cluster.Description())
+	}
+}
+
 type isMasterResult struct {
 	IsMaster       bool
 	Secondary      bool
@@ -138,13 +309,21 @@ type isMasterResult struct {
 	Msg            string
 	SetName        string `bson:"setName"`
 	MaxWireVersion int    `bson:"maxWireVersion"`
+	Compression    []string
+
+	MaxWriteBatchSize int `bson:"maxWriteBatchSize"`
 }
 
 func (cluster *mongoCluster) isMaster(socket *mongoSocket, result *isMasterResult) error {
 	// Monotonic let's it talk to a slave and still hold the socket.
 	session := newSession(Monotonic, cluster, 10*time.Second)
 	session.setSocket(socket)
-	err := session.Run("ismaster", result)
+	var cmd any = "ismaster"
+	if len(cluster.dial.compressors) > 0 {
+		// Compression is negotiated as part of the handshake.
+		cmd = bson.D{{Name: "ismaster", Value: 1}, {Name: "compression", Value: cluster.dial.compressors}}
+	}
+	err := session.Run(cmd, result)
 	session.Close()
 	return err
 }
@@ -167,7 +346,7 @@ func (cluster *mongoCluster) syncServer(server *mongoServer) (info *mongoServerI
 	}
 
 	addr := server.Addr
-	log("SYNC Processing ", addr, "...")
+	log(LogTopology, "SYNC Processing ", addr, "...")
 
 	// Retry a few times to avoid knocking a server down for a hiccup.
 	var result isMasterResult
@@ -182,7 +361,7 @@ func (cluster *mongoCluster) syncServer(server *mongoServer) (info *mongoServerI
 				// Give a chance for waiters to timeout as well.
 				cluster.serverSynced.Broadcast()
 			}
-			time.Sleep(syncShortDelay)
+			time.Sleep(cluster.dial.shortDelay())
 		}
 
 		// It's not clear what would be a good timeout here. Is it
@@ -190,38 +369,41 @@ func (cluster *mongoCluster) syncServer(server *mongoServer) (info *mongoServerI
 		socket, _, err := server.AcquireSocket(0, syncTimeout)
 		if err != nil {
 			tryerr = err
-			logf("SYNC Failed to get socket to %s: %v", addr, err)
+			warnf(LogTopology, "SYNC Failed to get socket to %s: %v", addr, err)
 			continue
 		}
+		start := time.Now()
 		err = cluster.isMaster(socket, &result)
+		rtt := time.Since(start)
 		socket.Release()
 		if err != nil {
 			tryerr = err
-			logf("SYNC Command 'ismaster' to %s failed: %v", addr, err)
+			warnf(LogTopology, "SYNC Command 'ismaster' to %s failed: %v", addr, err)
 			continue
 		}
-		debugf("SYNC Result of 'ismaster' from %s: %#v", addr, result)
+		server.addPingSample(rtt)
+		debugf(LogTopology, "SYNC Result of 'ismaster' from %s: %#v", addr, result)
 		break
 	}
 
 	if cluster.setName != "" && result.SetName != cluster.setName {
-		logf("SYNC Server %s is not a member of replica set %q", addr, cluster.setName)
+		logf(LogTopology, "SYNC Server %s is not a member of replica set %q", addr, cluster.setName)
 		return nil, nil, fmt.Errorf("server %s is not a member of replica set %q", addr, cluster.setName)
 	}
 
 	if result.IsMaster {
-		debugf("SYNC %s is a master.", addr)
+		debugf(LogTopology, "SYNC %s is a master.", addr)
 		if !server.info.Master {
 			// Made an incorrect assumption above, so fix stats.
 			stats.conn(-1, false)
 			stats.conn(+1, true)
 		}
 	} else if result.Secondary {
-		debugf("SYNC %s is a slave.", addr)
+		debugf(LogTopology, "SYNC %s is a slave.", addr)
 	} else if cluster.direct {
-		logf("SYNC %s in unknown state. Pretending it's a slave due to direct connection.", addr)
+		logf(LogTopology, "SYNC %s in unknown state. Pretending it's a slave due to direct connection.", addr)
 	} else {
-		logf("SYNC %s is neither a master nor a slave.", addr)
+		logf(LogTopology, "SYNC %s is neither a master nor a slave.", addr)
 		// Let stats track it as whatever was known before.
 		return nil, nil, errors.New(addr + " is not a master nor slave")
 	}
@@ -232,6 +414,9 @@ func (cluster *mongoCluster) syncServer(server *mongoServer) (info *mongoServerI
 		Tags:           result.Tags,
 		SetName:        result.SetName,
 		MaxWireVersion: result.MaxWireVersion,
+		Compressor:     agreedCompressor(cluster.dial.compressors, result.Compression),
+
+		MaxWriteBatchSize: result.MaxWriteBatchSize,
 	}
 
 	hosts = make([]string, 0, 1+len(result.Hosts)+len(result.Passives))
@@ -242,7 +427,7 @@ func (cluster *mongoCluster) syncServer(server *mongoServer) (info *mongoServerI
 	hosts = append(hosts, result.Hosts...)
 	hosts = append(hosts, result.Passives...)
 
-	debugf("SYNC %s knows about the following peers: %#v", addr, hosts)
+	debugf(LogTopology, "SYNC %s knows about the following peers: %#v", addr, hosts)
 	return info, hosts, nil
 }
 
@@ -254,40 +439,48 @@ const (
 )
 
 func (cluster *mongoCluster) addServer(server *mongoServer, info *mongoServerInfo, syncKind syncKind) {
+	changed := false
 	cluster.Lock()
 	current := cluster.servers.Search(server.ResolvedAddr)
+	kind := ServerAdded
 	if current == nil {
 		if syncKind == partialSync {
 			cluster.Unlock()
 			server.Close()
-			log("SYNC Discarding unknown server ", server.Addr, " due to partial sync.")
+			log(LogTopology, "SYNC Discarding unknown server ", server.Addr, " due to partial sync.")
 			return
 		}
 		cluster.servers.Add(server)
 		if info.Master {
 			cluster.masters.Add(server)
-			log("SYNC Adding ", server.Addr, " to cluster as a master.")
+			log(LogTopology, "SYNC Adding ", server.Addr, " to cluster as a master.")
 		} else {
-			log("SYNC Adding ", server.Addr, " to cluster as a slave.")
+			log(LogTopology, "SYNC Adding ", server.Addr, " to cluster as a slave.")
 		}
+		changed = true
 	} else {
 		if server != current {
 			panic("addServer attempting to add duplicated server")
 		}
 		if server.Info().Master != info.Master {
 			if info.Master {
-				log("SYNC Server ", server.Addr, " is now a master.")
+				log(LogTopology, "SYNC Server ", server.Addr, " is now a master.")
 				cluster.masters.Add(server)
 			} else {
-				log("SYNC Server ", server.Addr, " is now a slave.")
+				log(LogTopology, "SYNC Server ", server.Addr, " is now a slave.")
 				cluster.masters.Remove(server)
 			}
+			kind = ServerRoleChanged
+			changed = true
 		}
 	}
 	server.SetInfo(info)
-	debugf("SYNC Broadcasting availability of server %s", server.Addr)
+	debugf(LogTopology, "SYNC Broadcasting availability of server %s", server.Addr)
 	cluster.serverSynced.Broadcast()
 	cluster.Unlock()
+	if changed {
+		cluster.notifyChange(kind, server.Addr, info.Master)
+	}
 }
 
 func (cluster *mongoCluster) getKnownAddrs() []string {
@@ -327,13 +520,15 @@ func (cluster *mongoCluster) syncServers() {
 }
 
 // How long to wait for a checkup of the cluster topology if nothing
-// else kicks a synchronization before that.
+// else kicks a synchronization before that, and the minimum time between
+// consecutive checkups, unless overridden by DialInfo.HeartbeatInterval
+// and DialInfo.MinHeartbeatInterval.
 const syncServersDelay = 30 * time.Second
 const syncShortDelay = 500 * time.Millisecond
 
 // syncServersLoop loops while the cluster is alive to keep its idea of
 // the server topology up-to-date. It must be called just once from
-// newCluster.  The loop iterates once syncServersDelay has passed, or
+// newCluster.  The loop iterates once the heartbeat interval has passed, or
 // if somebody injects a value into the cluster.sync channel to force a
 // synchronization.  A loop iteration will contact all servers in
 // parallel, ask them about known peers and their own role within the
@@ -341,7 +536,7 @@ const syncShortDelay = 500 * time.Millisecond
 // retrieved.
 func (cluster *mongoCluster) syncServersLoop() {
 	for {
-		debugf("SYNC Cluster %p is starting a sync loop iteration.", cluster)
+		debugf(LogTopology, "SYNC Cluster %p is starting a sync loop iteration.", cluster)
 
 		cluster.Lock()
 		if cluster.references == 0 {
@@ -365,7 +560,7 @@ func (cluster *mongoCluster) syncServersLoop() {
 		// Hold off before allowing another sync. No point in
 		// burning CPU looking for down servers.
 		if !cluster.failFast {
-			time.Sleep(syncShortDelay)
+			time.Sleep(cluster.dial.shortDelay())
 		}
 
 		cluster.Lock()
@@ -382,34 +577,34 @@ func (cluster *mongoCluster) syncServersLoop() {
 		cluster.Unlock()
 
 		if restart {
-			log("SYNC No masters found. Will synchronize again.")
-			time.Sleep(syncShortDelay)
+			log(LogTopology, "SYNC No masters found. Will synchronize again.")
+			time.Sleep(cluster.dial.shortDelay())
 			continue
 		}
 
-		debugf("SYNC Cluster %p waiting for next requested or scheduled sync.", cluster)
+		debugf(LogTopology, "SYNC Cluster %p waiting for next requested or scheduled sync.", cluster)
 
 		// Hold off until somebody explicitly requests a synchronization
 		// or it's time to check for a cluster topology change again.
 		select {
 		case <-cluster.sync:
-		case <-time.After(syncServersDelay):
+		case <-time.After(cluster.dial.syncDelay()):
 		}
 	}
-	debugf("SYNC Cluster %p is stopping its sync loop.", cluster)
+	debugf(LogTopology, "SYNC Cluster %p is stopping its sync loop.", cluster)
 }
 
-func (cluster *mongoCluster) server(addr string, tcpaddr *net.TCPAddr) *mongoServer {
+func (cluster *mongoCluster) server(addr, resolvedAddr string, tcpaddr *net.TCPAddr) *mongoServer {
 	cluster.RLock()
-	server := cluster.servers.Search(tcpaddr.String())
+	server := cluster.servers.Search(resolvedAddr)
 	cluster.RUnlock()
 	if server != nil {
 		return server
 	}
-	return newServer(addr, tcpaddr, cluster.sync, cluster.dial)
+	return newServer(addr, resolvedAddr, tcpaddr, cluster.sync, cluster.dial, cluster.minPoolSize)
 }
 
-func resolveAddr(addr string) (*net.TCPAddr, error) {
+func resolveAddr(addr, network string) (*net.TCPAddr, error) {
 	// Simple cases that do not need actual resolution. Works with IPv4 and v6.
 	if host, port, err := net.SplitHostPort(addr); err == nil {
 		if port, _ := strconv.Atoi(port); port > 0 {
@@ -425,9 +620,16 @@ func resolveAddr(addr string) (*net.TCPAddr, error) {
 		}
 	}
 
-	// Attempt to resolve IPv4 and v6 concurrently.
+	// Attempt to resolve IPv4 and v6 concurrently, unless restricted to one of them.
+	networks := []string{"udp4", "udp6"}
+	switch network {
+	case "tcp4":
+		networks = networks[:1]
+	case "tcp6":
+		networks = networks[1:]
+	}
 	addrChan := make(chan *net.TCPAddr, 2)
-	for _, network := range []string{"udp4", "udp6"} {
+	for _, network := range networks {
 		network := network
 		go func() {
 			// The unfortunate UDP dialing hack allows having a timeout on address resolution.
@@ -443,7 +645,7 @@ func resolveAddr(addr string) (*net.TCPAddr, error) {
 
 	// Wait for the result of IPv4 and v6 resolution. Use IPv4 if available.
 	tcpaddr := <-addrChan
-	if tcpaddr == nil || len(tcpaddr.IP) != 4 {
+	if len(networks) > 1 && (tcpaddr == nil || len(tcpaddr.IP) != 4) {
 		var timeout <-chan time.Time
 		if tcpaddr != nil {
 			// Don't wait too long if an IPv6 address is known.
@@ -460,11 +662,11 @@ func resolveAddr(addr string) (*net.TCPAddr, error) {
 	}
 
 	if tcpaddr == nil {
-		log("SYNC Failed to resolve server address: ", addr)
+		warnf(LogTopology, "SYNC Failed to resolve server address: %s", addr)
 		return nil, errors.New("failed to resolve server address: " + addr)
 	}
 	if tcpaddr.String() != addr {
-		debug("SYNC Address ", addr, " resolved as ", tcpaddr.String())
+		debug(LogTopology, "SYNC Address ", addr, " resolved as ", tcpaddr.String())
 	}
 	return tcpaddr, nil
 }
@@ -475,7 +677,7 @@ type pendingAdd struct {
 }
 
 func (cluster *mongoCluster) syncServersIteration(direct bool) {
-	log("SYNC Starting full topology synchronization...")
+	log(LogTopology, "SYNC Starting full topology synchronization...")
 
 	var wg sync.WaitGroup
 	var m sync.Mutex
@@ -490,12 +692,20 @@ func (cluster *mongoCluster) syncServersIteration(direct bool) {
 		go func() {
 			defer wg.Done()
 
-			tcpaddr, err := resolveAddr(addr)
-			if err != nil {
-				log("SYNC Failed to start sync of ", addr, ": ", err.Error())
-				return
+			// Names may only be resolvable on the other side of a proxy,
+			// so servers reached through one are known by their address
+			// as provided.
+			var tcpaddr *net.TCPAddr
+			resolvedAddr := addr
+			if !cluster.dial.proxied() {
+				var err error
+				tcpaddr, err = resolveAddr(addr, cluster.dial.dialNetwork())
+				if err != nil {
+					warnf(LogTopology, "SYNC Failed to start sync of %s: %s", addr, err.Error())
+					return
+				}
+				resolvedAddr = tcpaddr.String()
 			}
-			resolvedAddr := tcpaddr.String()
 
 			m.Lock()
 			if byMaster {
@@ -514,7 +724,7 @@ func (cluster *mongoCluster) syncServersIteration(direct bool) {
 			seen[resolvedAddr] = true
 			m.Unlock()
 
-			server := cluster.server(addr, tcpaddr)
+			server := cluster.server(addr, resolvedAddr, tcpaddr)
 			info, hosts, err := cluster.syncServer(server)
 			if err != nil {
 				cluster.removeServer(server)
@@ -547,12 +757,12 @@ func (cluster *mongoCluster) syncServersIteration(direct bool) {
 	wg.Wait()
 
 	if syncKind == completeSync {
-		logf("SYNC Synchronization was complete (got data from primary).")
+		logf(LogTopology, "SYNC Synchronization was complete (got data from primary).")
 		for _, pending := range notYetAdded {
 			cluster.removeServer(pending.server)
 		}
 	} else {
-		logf("SYNC Synchronization was partial (cannot talk to primary).")
+		logf(LogTopology, "SYNC Synchronization was partial (cannot talk to primary).")
 		for _, pending := range notYetAdded {
 			cluster.addServer(pending.server, pending.info, partialSync)
 		}
@@ -560,7 +770,7 @@ func (cluster *mongoCluster) syncServersIteration(direct bool) {
 
 	cluster.Lock()
 	mastersLen := cluster.masters.Len()
-	logf("SYNC Synchronization completed: %d master(s) and %d slave(s) alive.", mastersLen, cluster.servers.Len()-mastersLen)
+	logf(LogTopology, "SYNC Synchronization completed: %d master(s) and %d slave(s) alive.", mastersLen, cluster.servers.Len()-mastersLen)
 
 	// Update dynamic seeds, but only if we have any good servers. Otherwise,
 	// leave them alone for better chances of a successful sync in the future.
@@ -570,15 +780,19 @@ func (cluster *mongoCluster) syncServersIteration(direct bool) {
 			dynaSeeds[i] = server.Addr
 		}
 		cluster.dynaSeeds = dynaSeeds
-		debugf("SYNC New dynamic seeds: %#v\n", dynaSeeds)
+		debugf(LogTopology, "SYNC New dynamic seeds: %#v\n", dynaSeeds)
 	}
 	cluster.Unlock()
 }
 
+// errNoReachableServers is returned by AcquireSocket when no suitable
+// server could be found within the sync timeout.
+var errNoReachableServers = errors.New("no reachable servers")
+
 // AcquireSocket returns a socket to a server in the cluster.  If slaveOk is
 // true, it will attempt to return a socket to a slave server.  If it is
 // false, the socket will necessarily be to a master server.
-func (cluster *mongoCluster) AcquireSocket(mode Mode, slaveOk bool, syncTimeout time.Duration, socketTimeout time.Duration, serverTags []bson.D, poolLimit int) (s *mongoSocket, err error) {
+func (cluster *mongoCluster) AcquireSocket(mode Mode, slaveOk bool, syncTimeout time.Duration, socketTimeout time.Duration, serverTags []bson.D, localThreshold time.Duration, poolLimit int) (s *mongoSocket, err error) {
 	var started time.Time
 	var syncCount uint
 	warnedLimit := false
@@ -587,7 +801,7 @@ func (cluster *mongoCluster) AcquireSocket(mode Mode, slaveOk bool, syncTimeout
 		for {
 			mastersLen := cluster.masters.Len()
 			slavesLen := cluster.servers.Len() - mastersLen
-			debugf("Cluster has %d known masters and %d known slaves.", mastersLen, slavesLen)
+			debugf(LogTopology, "Cluster has %d known masters and %d known slaves.", mastersLen, slavesLen)
 			if mastersLen > 0 && !(slaveOk && mode == Secondary) || slavesLen > 0 && slaveOk {
 				break
 			}
@@ -600,9 +814,9 @@ func (cluster *mongoCluster) AcquireSocket(mode Mode, slaveOk bool, syncTimeout
 				syncCount = cluster.syncCount
 			} else if syncTimeout != 0 && started.Before(time.Now().Add(-syncTimeout)) || cluster.failFast && cluster.syncCount != syncCount {
 				cluster.RUnlock()
-				return nil, errors.New("no reachable servers")
+				return nil, errNoReachableServers
 			}
-			log("Waiting for servers to synchronize...")
+			log(LogTopology, "Waiting for servers to synchronize...")
 			cluster.syncServers()
 
 			// Remember: this will release and reacquire the lock.
@@ -611,14 +825,22 @@ func (cluster *mongoCluster) AcquireSocket(mode Mode, slaveOk bool, syncTimeout
 
 		var server *mongoServer
 		if slaveOk {
-			server = cluster.servers.BestFit(mode, serverTags)
+			server = cluster.servers.BestFit(mode, serverTags, localThreshold)
 		} else {
-			server = cluster.masters.BestFit(mode, nil)
+			server = cluster.masters.BestFit(mode, nil, localThreshold)
+		}
+		if server == nil && started.IsZero() {
+			started = time.Now()
+			syncCount = cluster.syncCount
 		}
 		cluster.RUnlock()
 
 		if server == nil {
-			// Must have failed the requested tags. Sleep to avoid spinning.
+			// Must have failed the requested tags.
+			if syncTimeout != 0 && started.Before(time.Now().Add(-syncTimeout)) {
+				return nil, errNoReachableServers
+			}
+			// Sleep to avoid spinning.
 			time.Sleep(1e8)
 			continue
 		}
@@ -627,7 +849,7 @@ func (cluster *mongoCluster) AcquireSocket(mode Mode, slaveOk bool, syncTimeout
 		if err == errPoolLimit {
 			if !warnedLimit {
 				warnedLimit = true
-				log("WARNING: Per-server connection limit reached.")
+				warnf(LogConnections, "WARNING: Per-server connection limit reached.")
 			}
 			time.Sleep(100 * time.Millisecond)
 			continue
@@ -641,7 +863,7 @@ func (cluster *mongoCluster) AcquireSocket(mode Mode, slaveOk bool, syncTimeout
 			var result isMasterResult
 			err := cluster.isMaster(s, &result)
 			if err != nil || !result.IsMaster {
-				logf("Cannot confirm server %s as master (%v)", server.Addr, err)
+				logf(LogTopology, "Cannot confirm server %s as master (%v)", server.Addr, err)
 				s.Release()
 				cluster.syncServers()
 				time.Sleep(100 * time.Millisecond)
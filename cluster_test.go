@@ -27,9 +27,12 @@
 package mgo_test
 
 import (
+	"crypto/tls"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -815,6 +818,37 @@ func (s *S) TestModePrimaryPreferredFallover(c *C) {
 	c.Assert(supvName(result.Host), Equals, "rs1a")
 }
 
+func (s *S) TestReconnect(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	err = session.Reconnect(5 * time.Second)
+	c.Assert(err, IsNil)
+
+	session.SetMode(mgo.Secondary, true)
+
+	started := time.Now()
+	err = session.Reconnect(500 * time.Millisecond)
+	c.Assert(err, ErrorMatches, "no reachable servers after 500ms")
+	c.Assert(time.Since(started) < 5*time.Second, Equals, true)
+
+	// The session's own sync timeout is left untouched.
+	err = session.Ping()
+	c.Assert(err, ErrorMatches, "no reachable servers")
+
+	// It's used when no timeout is given, but only if it's bounded.
+	session.SetSyncTimeout(500 * time.Millisecond)
+	err = session.Reconnect(0)
+	c.Assert(err, ErrorMatches, "no reachable servers after 500ms")
+
+	session.SetSyncTimeout(0)
+	started = time.Now()
+	err = session.Reconnect(0)
+	c.Assert(err, ErrorMatches, "reconnect needs a timeout, and the session's sync timeout is unbounded")
+	c.Assert(time.Since(started) < time.Second, Equals, true)
+}
+
 func (s *S) TestModePrimaryFallover(c *C) {
 	if *fast {
 		c.Skip("-fast")
@@ -1477,6 +1511,58 @@ func (s *S) TestSecondaryModeWithMongosInsert(c *C) {
 	c.Assert(result.A, Equals, 1)
 }
 
+func (s *S) TestTransactionPinsMongos(c *C) {
+	if !s.versionAtLeast(4, 2) {
+		c.Skip("sharded transactions need 4.2+")
+	}
+	session, err := mgo.Dial("localhost:40201,localhost:40202")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Create(&mgo.CollectionInfo{})
+	c.Assert(err, IsNil)
+
+	err = session.StartTransaction(nil)
+	c.Assert(err, IsNil)
+	pinned, err := mgo.SessionServerAddr(session)
+	c.Assert(err, IsNil)
+
+	// Refreshing the session doesn't move the transaction to another mongos.
+	for i := 0; i < 10; i++ {
+		session.Refresh()
+		err = coll.Insert(M{"_id": i})
+		c.Assert(err, IsNil)
+		addr, err := mgo.SessionServerAddr(session)
+		c.Assert(err, IsNil)
+		c.Assert(addr, Equals, pinned)
+	}
+	err = session.CommitTransaction()
+	c.Assert(err, IsNil)
+
+	n, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 10)
+
+	// Once the transaction is over, the next one pins whichever mongos
+	// the session uses then.
+	for i := 0; i < 5; i++ {
+		session.Refresh()
+		err = session.StartTransaction(nil)
+		c.Assert(err, IsNil)
+		pinned, err := mgo.SessionServerAddr(session)
+		c.Assert(err, IsNil)
+		session.Refresh()
+		err = coll.Find(nil).All(&[]M{})
+		c.Assert(err, IsNil)
+		addr, err := mgo.SessionServerAddr(session)
+		c.Assert(err, IsNil)
+		c.Assert(addr, Equals, pinned)
+		err = session.AbortTransaction()
+		c.Assert(err, IsNil)
+	}
+}
+
 func (s *S) TestRemovalOfClusterMember(c *C) {
 	if *fast {
 		c.Skip("-fast")
@@ -1595,6 +1681,111 @@ func (s *S) TestPoolLimitSimple(c *C) {
 	}
 }
 
+func (s *S) TestMinPoolSize(c *C) {
+	for test := 0; test < 2; test++ {
+		var session *mgo.Session
+		var err error
+		if test == 0 {
+			info := &mgo.DialInfo{
+				Addrs:       []string{"localhost:40001"},
+				Timeout:     5 * time.Second,
+				MinPoolSize: 4,
+			}
+			session, err = mgo.DialWithInfo(info)
+			c.Assert(err, IsNil)
+		} else {
+			session, err = mgo.Dial("localhost:40001?minPoolSize=4")
+			c.Assert(err, IsNil)
+		}
+
+		waitAlive := func(n int) {
+			stats := mgo.GetStats()
+			for i := 0; stats.SocketsAlive < n; i++ {
+				c.Assert(i < 50, Equals, true, Commentf("Sockets alive: %d", stats.SocketsAlive))
+				time.Sleep(100 * time.Millisecond)
+				stats = mgo.GetStats()
+			}
+		}
+
+		// The pool warms up in the background without any operations.
+		waitAlive(4)
+
+		// Sockets that die are replaced.
+		mgo.KillUnusedSockets(session, 2)
+		waitAlive(4)
+
+		c.Assert(session.Ping(), IsNil)
+		session.Close()
+
+		// Closing the session closes the warm sockets as well.
+		stats := mgo.GetStats()
+		for i := 0; stats.SocketsAlive > 0; i++ {
+			c.Assert(i < 50, Equals, true, Commentf("Sockets alive: %d", stats.SocketsAlive))
+			time.Sleep(100 * time.Millisecond)
+			stats = mgo.GetStats()
+		}
+	}
+}
+
+func (s *S) TestMinPoolSizeLimits(c *C) {
+	_, err := mgo.ParseURL("localhost:40001?minPoolSize=-1")
+	c.Assert(err, ErrorMatches, "bad value for minPoolSize: -1")
+
+	_, err = mgo.DialWithInfo(&mgo.DialInfo{Addrs: []string{"localhost:40001"}, MinPoolSize: -1})
+	c.Assert(err, ErrorMatches, "invalid MinPoolSize: -1")
+
+	// The pool filler never goes over the pool limit.
+	session, err := mgo.DialWithInfo(&mgo.DialInfo{
+		Addrs:       []string{"localhost:40001"},
+		Timeout:     5 * time.Second,
+		PoolLimit:   2,
+		MinPoolSize: 4,
+	})
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	stats := mgo.GetStats()
+	for i := 0; stats.SocketsAlive < 2; i++ {
+		c.Assert(i < 50, Equals, true, Commentf("Sockets alive: %d", stats.SocketsAlive))
+		time.Sleep(100 * time.Millisecond)
+		stats = mgo.GetStats()
+	}
+	time.Sleep(500 * time.Millisecond)
+	c.Assert(mgo.GetStats().SocketsAlive, Equals, 2)
+}
+
+func (s *S) TestPoolStats(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	c.Assert(session.Ping(), IsNil)
+
+	stats := session.PoolStats()
+	c.Assert(stats, HasLen, 1)
+	c.Assert(stats[0].Addr, Equals, "localhost:40001")
+	c.Assert(stats[0].InUse, Equals, 1)
+	c.Assert(stats[0].Total, Equals, stats[0].InUse+stats[0].Available)
+
+	// Each copy reserves a socket of its own once used.
+	copy1 := session.Copy()
+	defer copy1.Close()
+	c.Assert(copy1.Ping(), IsNil)
+	copy2 := session.Copy()
+	c.Assert(copy2.Ping(), IsNil)
+
+	stats = session.PoolStats()
+	c.Assert(stats[0].InUse, Equals, 3)
+	c.Assert(stats[0].Total, Equals, stats[0].InUse+stats[0].Available)
+
+	// Releasing a socket makes it available again.
+	copy2.Close()
+	stats = session.PoolStats()
+	c.Assert(stats[0].InUse, Equals, 2)
+	c.Assert(stats[0].Available >= 1, Equals, true)
+	c.Assert(stats[0].Total, Equals, stats[0].InUse+stats[0].Available)
+}
+
 func (s *S) TestPoolLimitMany(c *C) {
 	if *fast {
 		c.Skip("-fast")
@@ -1681,6 +1872,53 @@ func (s *S) TestSetModeEventualIterBug(c *C) {
 	c.Assert(i, Equals, N)
 }
 
+func (s *S) TestIterServerAddrPinned(c *C) {
+	session, err := mgo.Dial("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll1 := session.DB("mydb").C("mycoll")
+
+	const N = 20
+	for i := 0; i < N; i++ {
+		err = coll1.Insert(M{"_id": i})
+		c.Assert(err, IsNil)
+	}
+
+	c.Logf("Waiting until secondary syncs")
+	for {
+		n, err := coll1.Count()
+		c.Assert(err, IsNil)
+		if n == N {
+			break
+		}
+	}
+
+	session2, err := mgo.Dial("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session2.Close()
+
+	session2.SetMode(mgo.Secondary, false)
+	coll2 := session2.DB("mydb").C("mycoll")
+
+	iter := coll2.Find(nil).Batch(2).Iter()
+	var result struct{}
+	c.Assert(iter.Next(&result), Equals, true)
+	addr := iter.ServerAddr()
+	c.Assert(addr, Not(Equals), "")
+	c.Assert(addr, Not(Equals), "localhost:40011")
+
+	// The session moving to the primary doesn't move the cursor.
+	session2.SetMode(mgo.Primary, true)
+	i := 1
+	for iter.Next(&result) {
+		c.Assert(iter.ServerAddr(), Equals, addr)
+		i++
+	}
+	c.Assert(iter.Close(), IsNil)
+	c.Assert(i, Equals, N)
+}
+
 func (s *S) TestCustomDialOld(c *C) {
 	dials := make(chan bool, 16)
 	dial := func(addr net.Addr) (net.Conn, error) {
@@ -1750,6 +1988,373 @@ func (s *S) TestCustomDialNew(c *C) {
 	}
 }
 
+func (s *S) TestDialTLSConfig(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	binfo, err := session.BuildInfo()
+	session.Close()
+	c.Assert(err, IsNil)
+	if binfo.OpenSSLVersion == "" {
+		c.Skip("server does not support SSL")
+	}
+
+	clientCertPEM, err := os.ReadFile("harness/certs/client.pem")
+	c.Assert(err, IsNil)
+	clientCert, err := tls.X509KeyPair(clientCertPEM, clientCertPEM)
+	c.Assert(err, IsNil)
+
+	var m sync.Mutex
+	var serverNames []string
+	tlsConfig := &tls.Config{
+		// Isolating tests to client certs, don't care about server validation.
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{clientCert},
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			m.Lock()
+			serverNames = append(serverNames, cs.ServerName)
+			m.Unlock()
+			return nil
+		},
+	}
+
+	session, err = mgo.DialWithInfo(&mgo.DialInfo{
+		Addrs:     []string{"localhost:40003"},
+		TLSConfig: tlsConfig,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(session.Ping(), IsNil)
+	session.Close()
+
+	// The server name is derived from the address without
+	// changing the provided configuration.
+	c.Assert(tlsConfig.ServerName, Equals, "")
+	m.Lock()
+	c.Assert(len(serverNames) > 0, Equals, true)
+	for _, name := range serverNames {
+		c.Assert(name, Equals, "localhost")
+	}
+	m.Unlock()
+
+	// DialServer takes precedence over TLSConfig.
+	dialed := false
+	session, err = mgo.DialWithInfo(&mgo.DialInfo{
+		Addrs:     []string{"localhost:40001"},
+		TLSConfig: tlsConfig,
+		DialServer: func(addr *mgo.ServerAddr) (net.Conn, error) {
+			m.Lock()
+			dialed = true
+			m.Unlock()
+			return net.Dial("tcp", addr.String())
+		},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(session.Ping(), IsNil)
+	session.Close()
+	m.Lock()
+	c.Assert(dialed, Equals, true)
+	m.Unlock()
+}
+
+func (s *S) TestCompressMessage(c *C) {
+	body := []byte(strings.Repeat("compressible ", 10000))
+	msg := make([]byte, 16, 16+len(body))
+	binary.LittleEndian.PutUint32(msg, uint32(16+len(body)))
+	binary.LittleEndian.PutUint32(msg[12:], 2013)
+	msg = append(msg, body...)
+	for _, compressor := range []string{"snappy", "zlib", "zstd"} {
+		opCode, out, err := mgo.CompressMessage(msg, compressor)
+		c.Assert(err, IsNil, Commentf("compressor %s", compressor))
+		c.Assert(opCode, Equals, int32(2013))
+		c.Assert(string(out), Equals, string(body))
+	}
+
+	// Oversized messages are rejected before allocating for them.
+	huge := make([]byte, 25)
+	binary.LittleEndian.PutUint32(huge, 100e6)
+	binary.LittleEndian.PutUint32(huge[12:], 2012)
+	_, _, err := mgo.ReadCompressed(huge)
+	c.Assert(err, ErrorMatches, "compressed message of 100000000 bytes exceeds the maximum message size")
+
+	binary.LittleEndian.PutUint32(huge, 25)
+	binary.LittleEndian.PutUint32(huge[16:], 2013)
+	binary.LittleEndian.PutUint32(huge[20:], 100e6)
+	_, _, err = mgo.ReadCompressed(huge)
+	c.Assert(err, ErrorMatches, "compressed message of 100000016 bytes uncompressed exceeds the maximum message size")
+}
+
+func (s *S) TestCompression(c *C) {
+	if !s.versionAtLeast(4, 2) {
+		c.Skip("zstd compression depends on 4.2")
+	}
+
+	_, err := mgo.DialWithInfo(&mgo.DialInfo{
+		Addrs:       []string{"localhost:40001"},
+		Compressors: []string{"lz4"},
+	})
+	c.Assert(err, ErrorMatches, "unsupported compressor: lz4")
+
+	for _, name := range []string{"snappy", "zlib", "zstd"} {
+		c.Logf("Testing the %s compressor", name)
+		info, err := mgo.ParseURL("localhost:40001?compressors=" + name)
+		c.Assert(err, IsNil)
+		c.Assert(info.Compressors, DeepEquals, []string{name})
+		info.Timeout = 5 * time.Second
+
+		session, err := mgo.DialWithInfo(info)
+		c.Assert(err, IsNil)
+
+		compressor, err := mgo.SessionCompressor(session)
+		c.Assert(err, IsNil)
+		c.Assert(compressor, Equals, name)
+
+		// Round trips are transparent, including for results spanning
+		// multiple batches.
+		coll := session.DB("mydb").C(name)
+		payload := strings.Repeat("compressible ", 10000)
+		for i := 0; i < 10; i++ {
+			err = coll.Insert(bson.M{"n": i, "payload": payload})
+			c.Assert(err, IsNil)
+		}
+		var docs []struct {
+			N       int
+			Payload string
+		}
+		err = coll.Find(nil).Sort("n").Batch(3).All(&docs)
+		c.Assert(err, IsNil)
+		c.Assert(docs, HasLen, 10)
+		for i, doc := range docs {
+			c.Assert(doc.N, Equals, i)
+			c.Assert(doc.Payload, Equals, payload)
+		}
+		session.Close()
+	}
+}
+
+func (s *S) TestAppName(c *C) {
+	if !s.versionAtLeast(3, 4) {
+		c.Skip("client metadata introduced in 3.4")
+	}
+
+	_, err := mgo.DialWithInfo(&mgo.DialInfo{
+		Addrs:   []string{"localhost:40001"},
+		AppName: strings.Repeat("x", 129),
+	})
+	c.Assert(err, ErrorMatches, "AppName must not exceed 128 bytes")
+
+	info, err := mgo.ParseURL("localhost:40001?appName=myapp")
+	c.Assert(err, IsNil)
+	c.Assert(info.AppName, Equals, "myapp")
+
+	session, err := mgo.DialWithInfo(info)
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	// The currentOp command reports itself, running on a connection
+	// established with the application name.
+	var result struct {
+		Inprog []struct {
+			AppName string `bson:"appName"`
+		}
+	}
+	err = session.Run("currentOp", &result)
+	c.Assert(err, IsNil)
+	found := false
+	for _, op := range result.Inprog {
+		if op.AppName == "myapp" {
+			found = true
+		}
+	}
+	c.Assert(found, Equals, true)
+}
+
+func (s *S) TestMsgCommand(c *C) {
+	docs := []any{bson.M{"n": 1}, bson.M{"n": 2}}
+	msg, err := mgo.MsgCommand("mydb", bson.D{
+		{Name: "insert", Value: "mycoll"},
+		{Name: "documents", Value: docs},
+		{Name: "ordered", Value: true},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(getInt32(msg, 12), Equals, int32(2013))
+
+	// Replies holding document sequences are rejected.
+	_, err = mgo.MsgReplyBody(msg)
+	c.Assert(err, ErrorMatches, "unexpected OP_MSG document sequence in reply")
+
+	data := msg[21 : 21+getInt32(msg, 21)]
+	var body bson.D
+	err = bson.Unmarshal(data, &body)
+	c.Assert(err, IsNil)
+	c.Assert(body, DeepEquals, bson.D{
+		{Name: "insert", Value: "mycoll"},
+		{Name: "ordered", Value: true},
+		{Name: "$db", Value: "mydb"},
+	})
+
+	// The documents follow the body in a document sequence.
+	pos := 16 + 4 + 1 + len(data)
+	c.Assert(msg[pos], Equals, byte(1))
+	c.Assert(int(getInt32(msg, pos+1)), Equals, len(msg)-pos-1)
+	pos += 5
+	c.Assert(string(msg[pos:pos+10]), Equals, "documents\x00")
+	pos += 10
+	for _, doc := range docs {
+		l := int(getInt32(msg, pos))
+		var m bson.M
+		err = bson.Unmarshal(msg[pos:pos+l], &m)
+		c.Assert(err, IsNil)
+		c.Assert(m, DeepEquals, doc)
+		pos += l
+	}
+	c.Assert(pos, Equals, len(msg))
+
+	// The documents are split off whatever the type holding them.
+	msg, err = mgo.MsgCommand("mydb", struct {
+		Delete  string `bson:"delete"`
+		Deletes []bson.M
+	}{"mycoll", []bson.M{{"q": bson.M{}, "limit": 0}}})
+	c.Assert(err, IsNil)
+	data = msg[21 : 21+getInt32(msg, 21)]
+	body = nil
+	c.Assert(bson.Unmarshal(data, &body), IsNil)
+	c.Assert(body, DeepEquals, bson.D{{Name: "delete", Value: "mycoll"}, {Name: "$db", Value: "mydb"}})
+	c.Assert(string(msg[21+len(data)+5:21+len(data)+13]), Equals, "deletes\x00")
+
+	// Other commands have a body section alone.
+	msg, err = mgo.MsgCommand("admin", bson.D{{Name: "ping", Value: 1}})
+	c.Assert(err, IsNil)
+	data, err = mgo.MsgReplyBody(msg)
+	c.Assert(err, IsNil)
+	c.Assert(16+4+1+len(data), Equals, len(msg))
+}
+
+func (s *S) TestMsgCommandOptions(c *C) {
+	cmdBody := func(msg []byte, err error) bson.D {
+		c.Assert(err, IsNil)
+		c.Assert(msg, NotNil)
+		data, err := mgo.MsgReplyBody(msg)
+		c.Assert(err, IsNil)
+		var body bson.D
+		c.Assert(bson.Unmarshal(data, &body), IsNil)
+		return body
+	}
+	count := bson.D{{Name: "count", Value: "mycoll"}}
+
+	// Legacy query options become command fields.
+	body := cmdBody(mgo.MsgCommandWithOptions("mydb", count, mgo.MsgOptions{
+		OrderBy:   bson.M{"n": 1},
+		Hint:      "n_1",
+		MaxTimeMS: 100,
+		Comment:   "hi",
+	}))
+	c.Assert(body, DeepEquals, bson.D{
+		{Name: "count", Value: "mycoll"},
+		{Name: "sort", Value: bson.D{{Name: "n", Value: 1}}},
+		{Name: "hint", Value: "n_1"},
+		{Name: "maxTimeMS", Value: 100},
+		{Name: "comment", Value: "hi"},
+		{Name: "$db", Value: "mydb"},
+	})
+
+	// Explain wraps the command.
+	body = cmdBody(mgo.MsgCommandWithOptions("mydb", count, mgo.MsgOptions{Explain: true, MaxTimeMS: 100}))
+	c.Assert(body, DeepEquals, bson.D{
+		{Name: "explain", Value: bson.D{{Name: "count", Value: "mycoll"}, {Name: "maxTimeMS", Value: 100}}},
+		{Name: "$db", Value: "mydb"},
+	})
+
+	// Options without a command counterpart fall back to OP_QUERY.
+	msg, err := mgo.MsgCommandWithOptions("mydb", count, mgo.MsgOptions{Snapshot: true})
+	c.Assert(err, IsNil)
+	c.Assert(msg, IsNil)
+
+	// The read preference is only sent when secondaries may serve the read.
+	body = cmdBody(mgo.MsgCommandWithOptions("mydb", count, mgo.MsgOptions{}))
+	c.Assert(body, DeepEquals, bson.D{{Name: "count", Value: "mycoll"}, {Name: "$db", Value: "mydb"}})
+	body = cmdBody(mgo.MsgCommandWithOptions("mydb", count, mgo.MsgOptions{SlaveOk: true}))
+	c.Assert(body, DeepEquals, bson.D{
+		{Name: "count", Value: "mycoll"},
+		{Name: "$db", Value: "mydb"},
+		{Name: "$readPreference", Value: bson.D{{Name: "mode", Value: "secondaryPreferred"}}},
+	})
+	body = cmdBody(mgo.MsgCommandWithOptions("mydb", count, mgo.MsgOptions{SlaveOk: true, Mongos: true}))
+	c.Assert(body[2], DeepEquals, bson.DocElem{Name: "$readPreference", Value: bson.D{{Name: "mode", Value: "secondaryPreferred"}}})
+}
+
+func (s *S) TestMsgLargeInsert(c *C) {
+	if !s.versionAtLeast(3, 6) {
+		c.Skip("OP_MSG depends on 3.6")
+	}
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	// The batch is larger than the maximum BSON document size, so it
+	// only fits in a single insert command as a document sequence.
+	payload := strings.Repeat("x", 20*1024)
+	docs := make([]any, 1000)
+	for i := range docs {
+		docs[i] = bson.M{"n": i, "payload": payload}
+	}
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(docs...)
+	c.Assert(err, IsNil)
+
+	n, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, len(docs))
+}
+
+func getInt32(b []byte, pos int) int32 {
+	return int32(b[pos]) | int32(b[pos+1])<<8 | int32(b[pos+2])<<16 | int32(b[pos+3])<<24
+}
+
+func (s *S) TestDialNetwork(c *C) {
+	var m sync.Mutex
+	var networks []string
+	restore := mgo.HackDialTimeout(func(network, addr string, timeout time.Duration) (net.Conn, error) {
+		m.Lock()
+		networks = append(networks, network)
+		m.Unlock()
+		return net.DialTimeout(network, addr, timeout)
+	})
+	defer restore()
+
+	for _, network := range []string{"", "tcp", "tcp4"} {
+		m.Lock()
+		networks = nil
+		m.Unlock()
+
+		info := mgo.DialInfo{
+			Addrs:       []string{"localhost:40001"},
+			DialNetwork: network,
+		}
+		session, err := mgo.DialWithInfo(&info)
+		c.Assert(err, IsNil)
+		err = session.Ping()
+		c.Assert(err, IsNil)
+		session.Close()
+
+		expected := network
+		if expected == "" {
+			expected = "tcp"
+		}
+		m.Lock()
+		c.Assert(len(networks) > 0, Equals, true)
+		for _, got := range networks {
+			c.Assert(got, Equals, expected)
+		}
+		m.Unlock()
+	}
+
+	info := mgo.DialInfo{
+		Addrs:       []string{"localhost:40001"},
+		DialNetwork: "udp",
+	}
+	_, err := mgo.DialWithInfo(&info)
+	c.Assert(err, ErrorMatches, "unsupported dial network: udp")
+}
+
 func (s *S) TestPrimaryShutdownOnAuthShard(c *C) {
 	if *fast {
 		c.Skip("-fast")
@@ -1929,6 +2534,139 @@ func (s *S) TestNearestServer(c *C) {
 	}
 }
 
+func (s *S) TestPingValue(c *C) {
+	c.Assert(mgo.PingValue(), Equals, time.Hour)
+	c.Assert(mgo.PingValue(10*time.Millisecond), Equals, 10*time.Millisecond)
+	c.Assert(mgo.PingValue(10*time.Millisecond, 60*time.Millisecond), Equals, 20*time.Millisecond)
+
+	// A single slow reply doesn't dominate for long.
+	samples := []time.Duration{10 * time.Millisecond, time.Second}
+	for i := 0; i < 20; i++ {
+		samples = append(samples, 10*time.Millisecond)
+	}
+	c.Assert(mgo.PingValue(samples...) < 25*time.Millisecond, Equals, true)
+}
+
+func (s *S) TestBestFitLocalThreshold(c *C) {
+	ms := time.Millisecond
+
+	// The nearest server is picked when the others are outside the window.
+	c.Assert(mgo.BestFitByPing(mgo.Nearest, 15*ms, 50*ms, 10*ms, 80*ms), Equals, 1)
+	c.Assert(mgo.BestFitByPing(mgo.Nearest, 0, 11*ms, 10*ms, 12*ms), Equals, 1)
+
+	// Servers within the window are equally near, so the first is kept
+	// as they have the same number of connections.
+	c.Assert(mgo.BestFitByPing(mgo.Nearest, 15*ms, 20*ms, 10*ms, 80*ms), Equals, 0)
+	c.Assert(mgo.BestFitByPing(mgo.Nearest, 100*ms, 80*ms, 10*ms), Equals, 0)
+	c.Assert(mgo.BestFitByPing(mgo.Secondary, 100*ms, 80*ms, 10*ms), Equals, 0)
+	c.Assert(mgo.BestFitByPing(mgo.Secondary, 15*ms, 80*ms, 10*ms), Equals, 1)
+}
+
+func (s *S) TestLocalThresholdURL(c *C) {
+	info, err := mgo.ParseURL("localhost:40011?localThresholdMS=50")
+	c.Assert(err, IsNil)
+	c.Assert(info.LocalThreshold, Equals, 50*time.Millisecond)
+
+	_, err = mgo.ParseURL("localhost:40011?localThresholdMS=near")
+	c.Assert(err, ErrorMatches, "bad value for localThresholdMS: near")
+}
+
+func (s *S) TestHeartbeatURL(c *C) {
+	info, err := mgo.ParseURL("localhost:40011?heartbeatFrequencyMS=2000")
+	c.Assert(err, IsNil)
+	c.Assert(info.HeartbeatInterval, Equals, 2*time.Second)
+
+	_, err = mgo.ParseURL("localhost:40011?heartbeatFrequencyMS=0")
+	c.Assert(err, ErrorMatches, "bad value for heartbeatFrequencyMS: 0")
+
+	info = &mgo.DialInfo{Addrs: []string{"localhost:40011"}, HeartbeatInterval: time.Second, MinHeartbeatInterval: 2 * time.Second}
+	_, err = mgo.DialWithInfo(info)
+	c.Assert(err, ErrorMatches, "HeartbeatInterval must not be shorter than MinHeartbeatInterval")
+}
+
+func (s *S) TestTopologyChanged(c *C) {
+	changes := make(chan mgo.TopologyChange, 10)
+	info := &mgo.DialInfo{
+		Addrs:             []string{"localhost:40011"},
+		Timeout:           5 * time.Second,
+		HeartbeatInterval: time.Second,
+		TopologyChanged: func(change mgo.TopologyChange) {
+			changes <- change
+		},
+	}
+	session, err := mgo.DialWithInfo(info)
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	// Wait for the whole replica set to be discovered.
+	err = session.Ping()
+	c.Assert(err, IsNil)
+	added := map[string]bool{}
+	masters := 0
+	timeout := time.After(10 * time.Second)
+	for len(added) < 3 {
+		select {
+		case change := <-changes:
+			c.Assert(change.Kind, Equals, mgo.ServerAdded)
+			c.Assert(change.LiveServers, Not(HasLen), 0)
+			added[change.Addr] = true
+			if change.Master {
+				masters++
+			}
+		case <-timeout:
+			c.Fatalf("got only %d servers added: %v", len(added), added)
+		}
+	}
+	c.Assert(masters, Equals, 1)
+}
+
+func (s *S) TestTopologyChangeHandler(c *C) {
+	if *fast {
+		c.Skip("-fast")
+	}
+
+	session, err := mgo.Dial("localhost:40021")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	descs := make(chan mgo.TopologyDescription, 10)
+	session.SetTopologyChangeHandler(func(desc mgo.TopologyDescription) {
+		descs <- desc
+	})
+
+	result := &struct{ Host string }{}
+	err = session.Run("serverStatus", result)
+	c.Assert(err, IsNil)
+	primary := result.Host
+
+	// Kill the primary, and wait for another one to be reported.
+	s.Stop(primary)
+	session.Refresh()
+	err = session.Ping()
+	c.Assert(err, IsNil)
+
+	timeout := time.After(30 * time.Second)
+	for {
+		select {
+		case desc := <-descs:
+			if desc.Primary == "" || hostPort(desc.Primary) == hostPort(primary) {
+				continue
+			}
+			found := false
+			for _, server := range desc.Servers {
+				if server.Addr == desc.Primary {
+					c.Assert(server.Type, Equals, mgo.ServerPrimary)
+					found = true
+				}
+			}
+			c.Assert(found, Equals, true)
+			return
+		case <-timeout:
+			c.Fatalf("no new primary reported after stepping down %s", primary)
+		}
+	}
+}
+
 func (s *S) TestConnectCloseConcurrency(c *C) {
 	restore := mgo.HackPingDelay(500 * time.Millisecond)
 	defer restore()
@@ -1975,6 +2713,41 @@ func (s *S) TestSelectServers(c *C) {
 	c.Assert(hostPort(result.Host), Equals, "40013")
 }
 
+func (s *S) TestServerSelectionTimeout(c *C) {
+	if !s.versionAtLeast(2, 2) {
+		c.Skip("read preferences introduced in 2.2")
+	}
+
+	info, err := mgo.ParseURL("localhost:40011?serverSelectionTimeoutMS=500")
+	c.Assert(err, IsNil)
+	c.Assert(info.ServerSelectionTimeout, Equals, 500*time.Millisecond)
+
+	_, err = mgo.ParseURL("localhost:40011?serverSelectionTimeoutMS=soon")
+	c.Assert(err, ErrorMatches, "bad value for serverSelectionTimeoutMS: soon")
+
+	session, err := mgo.Dial("localhost:40011?serverSelectionTimeoutMS=500")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	// No server matches the selected tags, so the operation fails
+	// once the selection timeout is exhausted.
+	session.SetMode(mgo.Secondary, true)
+	session.SelectServers(bson.D{{Name: "rs1", Value: "nonexistent"}})
+
+	started := time.Now()
+	err = session.Run("serverStatus", nil)
+	c.Assert(err, ErrorMatches, "no reachable servers")
+	c.Assert(time.Since(started) < 5*time.Second, Equals, true)
+
+	// Matching servers are still used.
+	session.Refresh()
+	session.SelectServers(bson.D{{Name: "rs1", Value: "b"}})
+	var result struct{ Host string }
+	err = session.Run("serverStatus", &result)
+	c.Assert(err, IsNil)
+	c.Assert(hostPort(result.Host), Equals, "40012")
+}
+
 func (s *S) TestSelectServersWithMongos(c *C) {
 	if !s.versionAtLeast(2, 2) {
 		c.Skip("read preferences introduced in 2.2")
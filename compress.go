@@ -0,0 +1,246 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2012 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Wire protocol message compression, as negotiated with each server
+// during the connection handshake.
+//
+// Relevant documentation:
+//
+//	https://github.com/mongodb/specifications/blob/master/source/compression/OP_COMPRESSED.rst
+
+const opCompressed = 2012
+
+// maxMessageSizeBytes is the largest message servers send or accept,
+// whether compressed or not.
+const maxMessageSizeBytes = 48000000
+
+// The zstd encoder and decoder are safe for concurrent use, and are only
+// created once needed since they hold sizable buffers.
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxMessageSizeBytes))
+	})
+	return zstdEncoder, zstdDecoder
+}
+
+// compressorIds maps the compressors available to their wire protocol ids.
+var compressorIds = map[string]byte{
+	"snappy": 1,
+	"zlib":   2,
+	"zstd":   3,
+}
+
+// checkCompressors returns an error if any of the named compressors
+// is not available.
+func checkCompressors(names []string) error {
+	for _, name := range names {
+		if _, ok := compressorIds[name]; !ok {
+			return errors.New("unsupported compressor: " + name)
+		}
+	}
+	return nil
+}
+
+// uncompressible holds the lowercased names of the commands that must
+// never be sent compressed.
+var uncompressible = map[string]bool{
+	"ismaster":        true,
+	"hello":           true,
+	"saslstart":       true,
+	"saslcontinue":    true,
+	"getnonce":        true,
+	"authenticate":    true,
+	"createuser":      true,
+	"updateuser":      true,
+	"copydbsaslstart": true,
+	"copydbgetnonce":  true,
+	"copydb":          true,
+}
+
+// mayCompressQuery returns whether the query document in doc, sent to
+// the collection coll, may be sent compressed.
+func mayCompressQuery(coll string, doc []byte) bool {
+	if !strings.HasSuffix(coll, ".$cmd") {
+		return true
+	}
+	kind, name, value := firstElem(doc)
+	if kind == 0x03 && name == "$query" {
+		_, name, _ = firstElem(value)
+	}
+	return !uncompressible[strings.ToLower(name)]
+}
+
+// firstElem returns the kind and name of the first element in the BSON
+// document doc, and the data following its name.
+func firstElem(doc []byte) (kind byte, name string, value []byte) {
+	if len(doc) < 6 {
+		return 0, "", nil
+	}
+	end := bytes.IndexByte(doc[5:], 0)
+	if end < 0 {
+		return 0, "", nil
+	}
+	return doc[4], string(doc[5 : 5+end]), doc[5+end+1:]
+}
+
+// agreedCompressor returns the first of the offered compressors that
+// the server agreed to use in its isMaster reply, or "" if none.
+func agreedCompressor(offered, agreed []string) string {
+	for _, name := range offered {
+		for _, other := range agreed {
+			if name == other {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// wireMsg records the position of a serialized message within a buffer
+// holding several of them, and whether it may be sent compressed.
+type wireMsg struct {
+	start    int
+	compress bool
+}
+
+// compressMessages returns a buffer holding the messages in buf wrapped
+// in OP_COMPRESSED messages with the named compressor, except for those
+// that must not be compressed.
+func compressMessages(buf []byte, msgs []wireMsg, compressor string) []byte {
+	out := bytes.NewBuffer(make([]byte, 0, len(buf)))
+	for i, msg := range msgs {
+		end := len(buf)
+		if i+1 < len(msgs) {
+			end = msgs[i+1].start
+		}
+		m := buf[msg.start:end]
+		if !msg.compress {
+			out.Write(m)
+			continue
+		}
+		start := out.Len()
+		header := make([]byte, 16, 25)
+		copy(header, m[:16])
+		setInt32(header, 12, opCompressed)
+		header = addInt32(header, getInt32(m, 12))
+		header = addInt32(header, int32(len(m)-16))
+		header = append(header, compressorIds[compressor])
+		switch compressor {
+		case "snappy":
+			out.Write(header)
+			out.Write(snappy.Encode(nil, m[16:]))
+		case "zstd":
+			enc, _ := zstdCodec()
+			out.Write(enc.EncodeAll(m[16:], header))
+		default:
+			out.Write(header)
+			w := zlib.NewWriter(out)
+			w.Write(m[16:])
+			w.Close()
+		}
+		setInt32(out.Bytes(), start, int32(out.Len()-start))
+	}
+	return out.Bytes()
+}
+
+// readCompressed reads from r the remainder of an OP_COMPRESSED message
+// with the given total length, and returns the opcode and the body of
+// the original message.
+func readCompressed(r io.Reader, totalLen int32) (opCode int32, body []byte, err error) {
+	if totalLen < 25 {
+		return 0, nil, errors.New("compressed message is too short, corrupted data?")
+	}
+	if totalLen > maxMessageSizeBytes {
+		return 0, nil, fmt.Errorf("compressed message of %d bytes exceeds the maximum message size", totalLen)
+	}
+	b := make([]byte, totalLen-16)
+	if err := fill(r, b); err != nil {
+		return 0, nil, err
+	}
+	opCode = getInt32(b, 0)
+	size := int(getInt32(b, 4))
+	if size < 0 {
+		return 0, nil, errors.New("compressed message has a negative size, corrupted data?")
+	}
+	if size > maxMessageSizeBytes-16 {
+		return 0, nil, fmt.Errorf("compressed message of %d bytes uncompressed exceeds the maximum message size", size+16)
+	}
+	switch b[8] {
+	case 0: // noop
+		body = b[9:]
+	case 1: // snappy
+		if n, err := snappy.DecodedLen(b[9:]); err != nil {
+			return 0, nil, err
+		} else if n != size {
+			return 0, nil, errors.New("compressed message size mismatch, corrupted data?")
+		}
+		if body, err = snappy.Decode(make([]byte, size), b[9:]); err != nil {
+			return 0, nil, err
+		}
+	case 2: // zlib
+		zr, err := zlib.NewReader(bytes.NewReader(b[9:]))
+		if err != nil {
+			return 0, nil, err
+		}
+		body = make([]byte, size)
+		if _, err := io.ReadFull(zr, body); err != nil {
+			return 0, nil, err
+		}
+	case 3: // zstd
+		_, dec := zstdCodec()
+		if body, err = dec.DecodeAll(b[9:], make([]byte, 0, size)); err != nil {
+			return 0, nil, err
+		}
+	default:
+		return 0, nil, fmt.Errorf("unsupported compressor id %d in reply", b[8])
+	}
+	if len(body) != size {
+		return 0, nil, errors.New("compressed message size mismatch, corrupted data?")
+	}
+	return opCode, body, nil
+}
@@ -1,7 +1,12 @@
 package mgo
 
 import (
+	"bytes"
+	"errors"
+	"net"
 	"time"
+
+	"github.com/3JoB/mgo/bson"
 )
 
 func HackPingDelay(newDelay time.Duration) (restore func()) {
@@ -31,3 +36,403 @@ func HackSyncSocketTimeout(newTimeout time.Duration) (restore func()) {
 	syncSocketTimeout = newTimeout
 	return
 }
+
+func HackDialTimeout(newDial func(network, addr string, timeout time.Duration) (net.Conn, error)) (restore func()) {
+	globalMutex.Lock()
+	defer globalMutex.Unlock()
+
+	oldDial := dialTimeout
+	restore = func() {
+		globalMutex.Lock()
+		dialTimeout = oldDial
+		globalMutex.Unlock()
+	}
+	dialTimeout = newDial
+	return
+}
+
+func HackLookupSRV(srv func(service, proto, name string) (string, []*net.SRV, error), txt func(name string) ([]string, error)) (restore func()) {
+	globalMutex.Lock()
+	defer globalMutex.Unlock()
+
+	oldSRV, oldTXT := lookupSRV, lookupTXT
+	restore = func() {
+		globalMutex.Lock()
+		lookupSRV, lookupTXT = oldSRV, oldTXT
+		globalMutex.Unlock()
+	}
+	lookupSRV, lookupTXT = srv, txt
+	return
+}
+
+// SessionCompressor returns the compressor agreed with the server of the
+// socket reserved for the session.
+func SessionCompressor(s *Session) (string, error) {
+	socket, err := s.acquireSocket(true)
+	if err != nil {
+		return "", err
+	}
+	defer socket.Release()
+	return socket.ServerInfo().Compressor, nil
+}
+
+// CompressMessage wraps the serialized message msg in an OP_COMPRESSED
+// message with the named compressor, and unwraps it back, returning the
+// opcode and the body read.
+func CompressMessage(msg []byte, compressor string) (opCode int32, body []byte, err error) {
+	compressed := compressMessages(msg, []wireMsg{{compress: true}}, compressor)
+	if getInt32(compressed, 12) != opCompressed {
+		return 0, nil, errors.New("message was not compressed")
+	}
+	return ReadCompressed(compressed)
+}
+
+// ReadCompressed unwraps the OP_COMPRESSED message msg, returning the
+// opcode and the body of the original message.
+func ReadCompressed(msg []byte) (opCode int32, body []byte, err error) {
+	return readCompressed(bytes.NewReader(msg[16:]), getInt32(msg, 0))
+}
+
+// MsgCommand returns the OP_MSG message sending cmd to the database db.
+func MsgCommand(db string, cmd any) ([]byte, error) {
+	return MsgCommandWithOptions(db, cmd, MsgOptions{})
+}
+
+// MsgOptions holds the legacy query options and read settings that
+// MsgCommandWithOptions sends a command with.
+type MsgOptions struct {
+	OrderBy   any
+	Hint      any
+	Explain   bool
+	MaxTimeMS int
+	Comment   string
+	Snapshot  bool
+	SlaveOk   bool
+	Mongos    bool
+}
+
+// MsgCommandWithOptions returns the OP_MSG message sending cmd to the
+// database db with opts, or nil if cmd must be sent as an OP_QUERY message.
+func MsgCommandWithOptions(db string, cmd any, opts MsgOptions) ([]byte, error) {
+	socket := &mongoSocket{serverInfo: &mongoServerInfo{MaxWireVersion: 6, Mongos: opts.Mongos}}
+	op := &queryOp{collection: db + ".$cmd", query: cmd, mode: Eventual}
+	op.options = queryWrapper{
+		OrderBy:   opts.OrderBy,
+		Hint:      opts.Hint,
+		Explain:   opts.Explain,
+		MaxTimeMS: opts.MaxTimeMS,
+		Comment:   opts.Comment,
+		Snapshot:  opts.Snapshot,
+	}
+	op.hasOptions = opts.OrderBy != nil || opts.Hint != nil || opts.Explain ||
+		opts.MaxTimeMS != 0 || opts.Comment != "" || opts.Snapshot
+	if opts.SlaveOk {
+		op.flags |= flagSlaveOk
+	}
+	if !socket.useMsg(op) {
+		return nil, nil
+	}
+	msg, _, err := addMsg(nil, op, socket)
+	if err == nil {
+		setInt32(msg, 0, int32(len(msg)))
+	}
+	return msg, err
+}
+
+// MsgReplyBody returns the body document of the OP_MSG message msg.
+func MsgReplyBody(msg []byte) ([]byte, error) {
+	return readMsg(bytes.NewReader(msg[16:]), len(msg)-16)
+}
+
+// QueryReadPreference returns the $readPreference document sent to mongos
+// for a query with the given settings.
+func QueryReadPreference(mode Mode, tags []bson.D, hedge bool) bson.D {
+	op := &queryOp{mode: mode, serverTags: tags, hedge: hedge}
+	return op.readPreference()
+}
+
+func ReshardCollectionCmd(ns string, key bson.D) bson.D {
+	return reshardCollectionCmd(ns, key)
+}
+
+func AbortReshardCollectionCmd(ns string) bson.D {
+	return abortReshardCollectionCmd(ns)
+}
+
+// PipeStages returns the pipeline p would send to the server.
+func PipeStages(p *Pipe) any {
+	return p.stages()
+}
+
+// CheckProjection returns the error reported for queries selecting fields
+// with selector before they're sent.
+func CheckProjection(selector any) error {
+	return checkProjection(selector)
+}
+
+// UnmarshalDistinct unmarshals values as the values array of a distinct
+// command result into result.
+func UnmarshalDistinct(values bson.Raw, result any) error {
+	return unmarshalDistinct(values, result)
+}
+
+// CheckPipeline returns the error reported for aggregating with pipeline
+// before it's sent.
+func CheckPipeline(pipeline any) error {
+	return checkPipeline(pipeline)
+}
+
+// KillUnusedSockets abruptly closes up to n unused sockets in each of the
+// servers the session is connected to, as if the connections had died.
+func KillUnusedSockets(session *Session, n int) {
+	var sockets []*mongoSocket
+	cluster := session.cluster()
+	cluster.RLock()
+	for _, server := range cluster.servers.Slice() {
+		server.RLock()
+		unused := server.unusedSockets
+		if len(unused) > n {
+			unused = unused[:n]
+		}
+		sockets = append(sockets, unused...)
+		server.RUnlock()
+	}
+	cluster.RUnlock()
+	for _, socket := range sockets {
+		socket.kill(errors.New("killed by test"), true)
+	}
+}
+
+// FsyncLockStatusFromReplies returns the lock status for the given
+// currentOp reply and the reply to the last fsync or fsyncUnlock command.
+func FsyncLockStatusFromReplies(currentOp, fsync bson.M) (locked bool, count int, err error) {
+	var info fsyncLockInfo
+	var result fsyncResult
+	for _, r := range []struct {
+		reply  bson.M
+		result any
+	}{{currentOp, &info}, {fsync, &result}} {
+		data, err := bson.Marshal(r.reply)
+		if err != nil {
+			return false, 0, err
+		}
+		if err := bson.Unmarshal(data, r.result); err != nil {
+			return false, 0, err
+		}
+	}
+	reported := 0
+	if result.LockCount != nil {
+		reported = int(*result.LockCount)
+	}
+	locked, count = fsyncLockStatus(&info, reported)
+	return locked, count, nil
+}
+
+// BulkErrorFromReply returns the error reported by running a bulk
+// operation with n queued operations that got reply from the server.
+func BulkErrorFromReply(reply bson.M, n int) error {
+	data, err := bson.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	var result writeCmdResult
+	if err := bson.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	lerr, err := result.lastError()
+	action := &bulkAction{op: bulkInsert}
+	for i := 0; i < n; i++ {
+		action.idxs = append(action.idxs, i)
+	}
+	var b Bulk
+	var berr BulkError
+	if b.checkSuccess(action, &berr, lerr, err) {
+		return nil
+	}
+	return &berr
+}
+
+// KillOplogTailCursor kills the cursor currently used by t in the server,
+// behind the back of the iterator, as if it had been reaped.
+func KillOplogTailCursor(t *OplogTail) error {
+	if t.iter == nil {
+		return nil
+	}
+	return KillIterCursor(t.iter)
+}
+
+// KillIterCursor kills the cursor currently used by iter in the server,
+// behind the back of the iterator, as if it had been reaped.
+func KillIterCursor(iter *Iter) error {
+	iter.m.Lock()
+	cursorId := iter.op.cursorId
+	iter.m.Unlock()
+	socket, err := iter.acquireSocket()
+	if err != nil {
+		return err
+	}
+	defer socket.Release()
+	return socket.Query(&killCursorsOp{cursorIds: []int64{cursorId}})
+}
+
+// TransactionFinishCmd returns the command a transaction with the given
+// options is committed or aborted with.
+func TransactionFinishCmd(cmdName string, opts TransactionOptions) bson.D {
+	return finishTransactionCmd(cmdName, &opts, &getLastError{W: "majority"})
+}
+
+// TransactionCmds returns the commands cmds as sent in turn as part of
+// a transaction using the given read concern level.
+func TransactionCmds(readConcern string, cmds ...any) ([]bson.D, error) {
+	txn := &transaction{
+		sessionId:   bson.Binary{Kind: 0x04, Data: make([]byte, 16)},
+		txnNumber:   7,
+		readConcern: readConcern,
+	}
+	var sent []bson.D
+	for _, cmd := range cmds {
+		data, err := bson.Marshal(cmd)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = txn.txnCmd(data); err != nil {
+			return nil, err
+		}
+		var d bson.D
+		if err = bson.Unmarshal(data, &d); err != nil {
+			return nil, err
+		}
+		sent = append(sent, d)
+	}
+	return sent, nil
+}
+
+// IsUnknownCommitResult returns whether a commit may be retried after
+// failing with err.
+func IsUnknownCommitResult(err error) bool {
+	return isUnknownCommitResult(err)
+}
+
+// SessionServerAddr returns the address of the server the session
+// sends its operations to.
+func SessionServerAddr(s *Session) (string, error) {
+	socket, err := s.acquireSocket(false)
+	if err != nil {
+		return "", err
+	}
+	defer socket.Release()
+	return socket.Server().Addr, nil
+}
+
+// AbortTransactionReplyErr returns the error reported when aborting a
+// transaction obtains the given reply from the server.
+func AbortTransactionReplyErr(reply any) error {
+	data, err := bson.Marshal(reply)
+	if err != nil {
+		panic(err)
+	}
+	return abortTransactionErr(checkQueryError("admin.$cmd", data))
+}
+
+// IsRetryableError reports whether a write failing with err is retried.
+func IsRetryableError(err error) bool {
+	return isRetryableError(err)
+}
+
+// NewWriteConcernLastError returns a LastError as produced by a write
+// command reply carrying the given code and write concern error code.
+func NewWriteConcernLastError(code, wcCode int) error {
+	return &LastError{Code: code, Err: "failed", wcerr: &WriteConcernError{Code: wcCode, ErrMsg: "failed"}}
+}
+
+// TailResumeQuery returns the query a tailable iterator with the given
+// tail key reopens its cursor with after seeing last.
+func TailResumeQuery(query any, key string, last any) any {
+	t := &tailResume{op: queryOp{query: query}, key: key, last: last, seen: true}
+	return t.resumeOp().query
+}
+
+// GridFSMetaQuery returns the files query FindMeta runs for metadata.
+func GridFSMetaQuery(metadata bson.D) (bson.D, error) {
+	data, err := bson.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return metaQuery(doc)
+}
+
+// MaxTimeCmd returns the command RunWithMaxTime runs for cmd and d.
+func MaxTimeCmd(cmd any, d time.Duration) (any, error) {
+	return maxTimeCmd(cmd, d)
+}
+
+// BestFitByPing returns the index of the server BestFit selects in mode
+// among secondaries with the given ping values.
+func BestFitByPing(mode Mode, localThreshold time.Duration, pings ...time.Duration) int {
+	var servers mongoServers
+	for _, ping := range pings {
+		servers.slice = append(servers.slice, &mongoServer{info: &mongoServerInfo{}, pingValue: ping, pingCount: 1})
+	}
+	best := servers.BestFit(mode, nil, localThreshold)
+	for i, server := range servers.slice {
+		if server == best {
+			return i
+		}
+	}
+	return -1
+}
+
+// PingValue returns the ping value of a server after the given round-trip
+// time samples.
+func PingValue(samples ...time.Duration) time.Duration {
+	server := &mongoServer{pingValue: time.Hour}
+	for _, rtt := range samples {
+		server.addPingSample(rtt)
+	}
+	return server.pingValue
+}
+
+func TailMaxAwait(timeout, sockTimeout time.Duration) time.Duration {
+	return tailMaxAwait(timeout, sockTimeout)
+}
+
+func CreateCmd(name string, info *CollectionInfo) (bson.D, error) {
+	return createCmd(name, info)
+}
+
+// LogMessage logs msg at the given level and category, as the driver
+// does internally.
+func LogMessage(level LogLevel, category LogCategory, msg string) {
+	switch level {
+	case LevelDebug:
+		debugf(category, "%s", msg)
+	case LevelInfo:
+		logf(category, "%s", msg)
+	case LevelWarn:
+		warnf(category, "%s", msg)
+	default:
+		errorf(category, "%s", msg)
+	}
+}
+
+func RedactCommand(cmd any) any {
+	return redactCommand(cmd)
+}
+
+// MonitorCommand delivers to monitor the events for cmd being sent to the
+// database db and then answered with reply, or failing with replyErr.
+func MonitorCommand(monitor CommandMonitor, db string, cmd any, reply []byte, replyErr error) {
+	socket := &mongoSocket{addr: "localhost:40001", id: 42}
+	req := newMonitoredRequest(monitor, socket, &queryOp{collection: db + ".$cmd", query: cmd})
+	replyFunc := req.wrap(func(error, *replyOp, int, []byte) {})
+	req.start(7)
+	replyFunc(replyErr, &replyOp{replyDocs: 1}, 0, reply)
+}
+
+func SOCKS5Handshake(conn net.Conn, addr, username, password string) error {
+	return socks5Handshake(conn, addr, username, password)
+}
@@ -1,12 +1,13 @@
 module github.com/3JoB/mgo
 
-go 1.20
+go 1.22
 
 require (
 	github.com/3JoB/go-json v0.10.2
 	github.com/3JoB/go-reflect v1.0.0
 	github.com/goccy/go-reflect v1.2.0
 	github.com/grafana/regexp v0.0.0-20221122212121-6b5c0a4cb7fd
+	github.com/klauspost/compress v1.18.0
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c
 	gopkg.in/tomb.v2 v2.0.0-20161208151619-d5d1b5820637
 	gopkg.in/yaml.v2 v2.4.0
@@ -33,6 +33,7 @@ import (
 	"hash"
 	"io"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -308,6 +309,107 @@ func (gfs *GridFS) Find(query any) *Query {
 	return gfs.Files.Find(query)
 }
 
+// FindMeta runs a query on GridFS's files collection matching files by
+// the user-defined "metadata" field set via GridFile.SetMeta, and returns
+// the resulting Query. Each top-level key in the metadata query document
+// is matched against the respective key under the metadata field, so any
+// query operators may be used in the values. For example:
+//
+//	gfs := db.GridFS("fs")
+//	query, err := gfs.FindMeta(bson.M{"owner": "joe", "tags": bson.M{"$in": tags}})
+//
+// Is equivalent to:
+//
+//	query := gfs.Find(bson.M{"metadata.owner": "joe", "metadata.tags": bson.M{"$in": tags}})
+//
+// Top-level $and, $or and $nor operators have the documents they hold
+// handled in the same way, while other top-level operators such as $where
+// or $expr are passed through unchanged.
+//
+// The resulting files may be opened with OpenNext or OpenAll.
+func (gfs *GridFS) FindMeta(metadata any) (*Query, error) {
+	data, err := bson.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	query, err := metaQuery(doc)
+	if err != nil {
+		return nil, err
+	}
+	return gfs.Files.Find(query), nil
+}
+
+// metaQuery returns doc with its field names moved under the metadata field.
+func metaQuery(doc bson.D) (bson.D, error) {
+	query := make(bson.D, len(doc))
+	for i, elem := range doc {
+		if !strings.HasPrefix(elem.Name, "$") {
+			query[i] = bson.DocElem{Name: "metadata." + elem.Name, Value: elem.Value}
+			continue
+		}
+		switch elem.Name {
+		case "$and", "$or", "$nor":
+			clauses, ok := elem.Value.([]any)
+			if !ok {
+				return nil, errors.New(elem.Name + " must be an array of documents")
+			}
+			metaClauses := make([]any, len(clauses))
+			for j, clause := range clauses {
+				clauseDoc, ok := clause.(bson.D)
+				if !ok {
+					return nil, errors.New(elem.Name + " must be an array of documents")
+				}
+				metaClause, err := metaQuery(clauseDoc)
+				if err != nil {
+					return nil, err
+				}
+				metaClauses[j] = metaClause
+			}
+			query[i] = bson.DocElem{Name: elem.Name, Value: metaClauses}
+		default:
+			query[i] = elem
+		}
+	}
+	return query, nil
+}
+
+// OpenAll opens for reading all the files in the GridFS's files collection
+// matching the provided query. Files are only read from when requested,
+// so opening many of them is cheap, but they should all be closed after use.
+//
+// For example:
+//
+//	files, err := gfs.OpenAll(bson.M{"metadata.owner": "joe"})
+//	if err != nil {
+//	    return err
+//	}
+//	for _, f := range files {
+//	    fmt.Printf("Filename: %s\n", f.Name())
+//	    f.Close()
+//	}
+func (gfs *GridFS) OpenAll(query any) (files []*GridFile, err error) {
+	iter := gfs.Find(query).Iter()
+	var doc gfsFile
+	for iter.Next(&doc) {
+		f := gfs.newFile()
+		f.mode = gfsReading
+		f.doc = doc
+		files = append(files, f)
+		doc = gfsFile{}
+	}
+	if err = iter.Close(); err != nil {
+		for _, f := range files {
+			f.Close()
+		}
+		return nil, err
+	}
+	return files, nil
+}
+
 // RemoveId deletes the file with the provided id from the GridFS.
 func (gfs *GridFS) RemoveId(id any) error {
 	err := gfs.Files.Remove(bson.M{"_id": id})
@@ -356,14 +458,33 @@ func (file *GridFile) assertMode(mode gfsFileMode) {
 // will be split in blocks of that size and each block saved into an
 // independent chunk document.  The default chunk size is 255kb.
 //
-// It is a runtime error to call this function once the file has started
-// being written to.
+// The chunk size is stored in the chunkSize field of the file document,
+// and files are always read back using the chunk size they were saved
+// with. Larger chunks reduce the number of round trips for big files,
+// while smaller chunks waste less space for tiny ones.
+//
+// Calling this function once the file has started being written to, or
+// with a size that is not positive, is an error that causes the file
+// to be aborted and the error to be reported by Write and Close, as
+// done for other write errors.
+//
+// It is a runtime error to call this function when the file is not open
+// for writing.
 func (file *GridFile) SetChunkSize(bytes int) {
 	file.assertMode(gfsWriting)
-	debugf("GridFile %p: setting chunk size to %d", file, bytes)
+	debugf(LogCommands, "GridFile %p: setting chunk size to %d", file, bytes)
 	file.m.Lock()
-	file.doc.ChunkSize = bytes
-	file.m.Unlock()
+	defer file.m.Unlock()
+	if file.err != nil {
+		return
+	}
+	if bytes <= 0 {
+		file.err = errors.New("GridFile chunk size must be positive")
+	} else if file.chunk > 0 || len(file.wbuf) > 0 {
+		file.err = errors.New("GridFile chunk size must be set before writing")
+	} else {
+		file.doc.ChunkSize = bytes
+	}
 }
 
 // Id returns the current file Id.
@@ -506,13 +627,13 @@ func (file *GridFile) Close() (err error) {
 		file.rcache = nil
 	}
 	file.mode = gfsClosed
-	debugf("GridFile %p: closed", file)
+	debugf(LogCommands, "GridFile %p: closed", file)
 	return file.err
 }
 
 func (file *GridFile) completeWrite() {
 	for file.wpending > 0 {
-		debugf("GridFile %p: waiting for %d pending chunks to complete file write", file, file.wpending)
+		debugf(LogCommands, "GridFile %p: waiting for %d pending chunks to complete file write", file, file.wpending)
 		file.c.Wait()
 	}
 	if file.err == nil {
@@ -562,7 +683,7 @@ func (file *GridFile) Abort() {
 func (file *GridFile) Write(data []byte) (n int, err error) {
 	file.assertMode(gfsWriting)
 	file.m.Lock()
-	debugf("GridFile %p: writing %d bytes", file, len(data))
+	debugf(LogCommands, "GridFile %p: writing %d bytes", file, len(data))
 	defer file.m.Unlock()
 
 	if file.err != nil {
@@ -609,7 +730,7 @@ func (file *GridFile) Write(data []byte) (n int, err error) {
 func (file *GridFile) insertChunk(data []byte) {
 	n := file.chunk
 	file.chunk++
-	debugf("GridFile %p: adding to checksum: %q", file, string(data))
+	debugf(LogCommands, "GridFile %p: adding to checksum: %q", file, string(data))
 	file.wsum.Write(data)
 
 	for file.doc.ChunkSize*file.wpending >= 1024*1024 {
@@ -622,7 +743,7 @@ func (file *GridFile) insertChunk(data []byte) {
 
 	file.wpending++
 
-	debugf("GridFile %p: inserting chunk %d with %d bytes", file, n, len(data))
+	debugf(LogCommands, "GridFile %p: inserting chunk %d with %d bytes", file, n, len(data))
 
 	// We may not own the memory of data, so rather than
 	// simply copying it, we'll marshal the document ahead of time.
@@ -651,7 +772,7 @@ func (file *GridFile) insertChunk(data []byte) {
 // an error, if any.
 func (file *GridFile) Seek(offset int64, whence int) (pos int64, err error) {
 	file.m.Lock()
-	debugf("GridFile %p: seeking for %s (whence=%d)", file, offset, whence)
+	debugf(LogCommands, "GridFile %p: seeking for %s (whence=%d)", file, offset, whence)
 	defer file.m.Unlock()
 	switch whence {
 	case os.SEEK_SET:
@@ -699,7 +820,7 @@ func (file *GridFile) Seek(offset int64, whence int) (pos int64, err error) {
 func (file *GridFile) Read(b []byte) (n int, err error) {
 	file.assertMode(gfsReading)
 	file.m.Lock()
-	debugf("GridFile %p: reading at offset %d into buffer of length %d", file, file.offset, len(b))
+	debugf(LogCommands, "GridFile %p: reading at offset %d into buffer of length %d", file, file.offset, len(b))
 	defer file.m.Unlock()
 	if file.offset == file.doc.Length {
 		return 0, io.EOF
@@ -718,15 +839,81 @@ func (file *GridFile) Read(b []byte) (n int, err error) {
 	return n, err
 }
 
+// ReadAt reads len(b) bytes from the file starting at byte offset off,
+// and returns the number of bytes read and an error in case something
+// wrong happened. If fewer than len(b) bytes are available before the
+// end of the file, err is set to io.EOF.
+//
+// Unlike Read, ReadAt does not read the file sequentially. Only the chunks
+// holding the requested range are fetched from the database, with a single
+// query using the chunks index, which makes serving byte ranges of large
+// files practical. ReadAt does not affect nor is affected by the offset
+// used by Read and Seek, and may be called concurrently with them.
+//
+// The parameters and behavior of this function turn the file
+// into an io.ReaderAt.
+func (file *GridFile) ReadAt(b []byte, off int64) (n int, err error) {
+	file.assertMode(gfsReading)
+	debugf(LogCommands, "GridFile %p: reading at offset %d into buffer of length %d", file, off, len(b))
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	file.m.Lock()
+	id, length, chunkSize := file.doc.Id, file.doc.Length, int64(file.doc.ChunkSize)
+	file.m.Unlock()
+	if off >= length {
+		return 0, io.EOF
+	}
+	end := off + int64(len(b))
+	if end > length {
+		end = length
+	}
+	if end == off {
+		return 0, nil
+	}
+	if chunkSize <= 0 {
+		return 0, errors.New("corrupted file: invalid chunk size")
+	}
+
+	first := int(off / chunkSize)
+	last := int((end - 1) / chunkSize)
+	query := bson.D{
+		{Name: "files_id", Value: id},
+		{Name: "n", Value: bson.D{{Name: "$gte", Value: first}, {Name: "$lte", Value: last}}},
+	}
+	iter := file.gfs.Chunks.Find(query).Sort("n").Iter()
+	want := first
+	var doc gfsChunk
+	for iter.Next(&doc) {
+		start := off + int64(n) - int64(doc.N)*chunkSize
+		if doc.N != want || start < 0 || start > int64(len(doc.Data)) {
+			iter.Close()
+			return n, errors.New("corrupted file: chunk data doesn't match file length")
+		}
+		n += copy(b[n:end-off], doc.Data[start:])
+		want++
+	}
+	if err = iter.Close(); err != nil {
+		return n, err
+	}
+	if want != last+1 || off+int64(n) != end {
+		return n, errors.New("corrupted file: chunk data doesn't match file length")
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
 func (file *GridFile) getChunk() (data []byte, err error) {
 	cache := file.rcache
 	file.rcache = nil
 	if cache != nil && cache.n == file.chunk {
-		debugf("GridFile %p: Getting chunk %d from cache", file, file.chunk)
+		debugf(LogCommands, "GridFile %p: Getting chunk %d from cache", file, file.chunk)
 		cache.wait.Lock()
 		data, err = cache.data, cache.err
 	} else {
-		debugf("GridFile %p: Fetching chunk %d", file, file.chunk)
+		debugf(LogCommands, "GridFile %p: Fetching chunk %d", file, file.chunk)
 		var doc gfsChunk
 		err = file.gfs.Chunks.Find(bson.D{{Name: "files_id", Value: file.doc.Id}, {Name: "n", Value: file.chunk}}).One(&doc)
 		data = doc.Data
@@ -736,7 +923,7 @@ func (file *GridFile) getChunk() (data []byte, err error) {
 		// Read the next one in background.
 		cache = &gfsCachedChunk{n: file.chunk}
 		cache.wait.Lock()
-		debugf("GridFile %p: Scheduling chunk %d for background caching", file, file.chunk)
+		debugf(LogCommands, "GridFile %p: Scheduling chunk %d for background caching", file, file.chunk)
 		// Clone the session to avoid having it closed in between.
 		chunks := file.gfs.Chunks
 		session := chunks.Database.Session.Clone()
@@ -750,6 +937,6 @@ func (file *GridFile) getChunk() (data []byte, err error) {
 		}(file.doc.Id, file.chunk)
 		file.rcache = cache
 	}
-	debugf("Returning err: %#v", err)
+	debugf(LogCommands, "Returning err: %#v", err)
 	return
 }
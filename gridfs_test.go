@@ -27,8 +27,10 @@
 package mgo_test
 
 import (
+	"fmt"
 	"io"
 	"os"
+	"sort"
 	"time"
 
 	. "gopkg.in/check.v1"
@@ -412,6 +414,150 @@ func (s *S) TestGridFSReadAll(c *C) {
 	c.Assert(err, IsNil)
 }
 
+func (s *S) TestGridFSReadAt(c *C) {
+	session, err := mgo.Dial("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+	file, err := gfs.Create("")
+	c.Assert(err, IsNil)
+	id := file.Id()
+
+	file.SetChunkSize(5)
+
+	n, err := file.Write([]byte("abcdefghijklmnopqrstuv"))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 22)
+
+	err = file.Close()
+	c.Assert(err, IsNil)
+
+	file, err = gfs.OpenId(id)
+	c.Assert(err, IsNil)
+	defer file.Close()
+
+	b := make([]byte, 30)
+
+	// Within a single chunk.
+	n, err = file.ReadAt(b[:3], 6)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+	c.Assert(b[:3], DeepEquals, []byte("ghi"))
+
+	// Spanning several chunks.
+	n, err = file.ReadAt(b[:12], 3)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 12)
+	c.Assert(b[:12], DeepEquals, []byte("defghijklmno"))
+
+	// Aligned to chunk boundaries.
+	n, err = file.ReadAt(b[:5], 10)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 5)
+	c.Assert(b[:5], DeepEquals, []byte("klmno"))
+
+	// Up to the end of the file.
+	n, err = file.ReadAt(b[:4], 18)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 4)
+	c.Assert(b[:4], DeepEquals, []byte("stuv"))
+
+	// Past the end of the file.
+	n, err = file.ReadAt(b[:10], 18)
+	c.Assert(err, Equals, io.EOF)
+	c.Assert(n, Equals, 4)
+	c.Assert(b[:4], DeepEquals, []byte("stuv"))
+
+	n, err = file.ReadAt(b, 22)
+	c.Assert(err, Equals, io.EOF)
+	c.Assert(n, Equals, 0)
+
+	_, err = file.ReadAt(b, -1)
+	c.Assert(err, ErrorMatches, "negative offset")
+
+	// The sequential reading offset is unaffected.
+	n, err = file.Read(b[:3])
+	c.Assert(err, IsNil)
+	c.Assert(b[:3], DeepEquals, []byte("abc"))
+
+	// A files document with a broken chunk size is reported as such.
+	err = gfs.Files.UpdateId(id, M{"$set": M{"chunkSize": 0}})
+	c.Assert(err, IsNil)
+	broken, err := gfs.OpenId(id)
+	c.Assert(err, IsNil)
+	defer broken.Close()
+	_, err = broken.ReadAt(b[:3], 6)
+	c.Assert(err, ErrorMatches, "corrupted file: invalid chunk size")
+}
+
+func (s *S) TestGridFSSetChunkSize(c *C) {
+	session, err := mgo.Dial("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+	gfs := db.GridFS("fs")
+
+	data := []byte("abcdefghijklmnopqrstuvwxyz")
+	var ids []any
+	for _, size := range []int{1, 7, 26, 1024} {
+		file, err := gfs.Create("")
+		c.Assert(err, IsNil)
+		file.SetChunkSize(size)
+		_, err = file.Write(data)
+		c.Assert(err, IsNil)
+
+		err = file.Close()
+		c.Assert(err, IsNil)
+		ids = append(ids, file.Id())
+
+		var doc bson.M
+		err = db.C("fs.files").FindId(file.Id()).One(&doc)
+		c.Assert(err, IsNil)
+		c.Assert(doc["chunkSize"], Equals, size)
+
+		count, err := db.C("fs.chunks").Find(M{"files_id": file.Id()}).Count()
+		c.Assert(err, IsNil)
+		c.Assert(count, Equals, (len(data)+size-1)/size)
+	}
+
+	// Each file is read with its own chunk size.
+	for _, id := range ids {
+		file, err := gfs.OpenId(id)
+		c.Assert(err, IsNil)
+		b, err := io.ReadAll(file)
+		c.Assert(err, IsNil)
+		c.Assert(string(b), Equals, string(data))
+
+		_, err = file.Seek(20, 0)
+		c.Assert(err, IsNil)
+		b, err = io.ReadAll(file)
+		c.Assert(err, IsNil)
+		c.Assert(string(b), Equals, "uvwxyz")
+		c.Assert(file.Close(), IsNil)
+	}
+
+	// Misuse is reported when closing the file, which is then discarded.
+	file, err := gfs.Create("")
+	c.Assert(err, IsNil)
+	file.SetChunkSize(0)
+	c.Assert(file.Close(), ErrorMatches, "GridFile chunk size must be positive")
+
+	file, err = gfs.Create("")
+	c.Assert(err, IsNil)
+	_, err = file.Write(data)
+	c.Assert(err, IsNil)
+	file.SetChunkSize(5)
+	_, err = file.Write(data)
+	c.Assert(err, ErrorMatches, "GridFile chunk size must be set before writing")
+	c.Assert(file.Close(), ErrorMatches, "GridFile chunk size must be set before writing")
+	_, err = gfs.OpenId(file.Id())
+	c.Assert(err, Equals, mgo.ErrNotFound)
+}
+
 func (s *S) TestGridFSReadChunking(c *C) {
 	session, err := mgo.Dial("localhost:40011")
 	c.Assert(err, IsNil)
@@ -649,6 +795,101 @@ func (s *S) TestGridFSRemove(c *C) {
 	c.Assert(n, Equals, 0)
 }
 
+func (s *S) TestGridFSFindMeta(c *C) {
+	session, err := mgo.Dial("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+
+	type meta struct {
+		Owner string
+		Tags  []string
+	}
+	metas := []meta{
+		{Owner: "joe", Tags: []string{"a", "b"}},
+		{Owner: "ann", Tags: []string{"b"}},
+		{Owner: "joe", Tags: []string{"c"}},
+	}
+	for i, m := range metas {
+		file, err := gfs.Create(fmt.Sprintf("myfile%d.txt", i))
+		c.Assert(err, IsNil)
+		file.SetMeta(m)
+		_, err = file.Write([]byte{byte('0' + i)})
+		c.Assert(err, IsNil)
+		c.Assert(file.Close(), IsNil)
+	}
+
+	query, err := gfs.FindMeta(bson.M{"owner": "joe"})
+	c.Assert(err, IsNil)
+	iter := query.Sort("filename").Iter()
+	var f *mgo.GridFile
+	var names []string
+	for gfs.OpenNext(iter, &f) {
+		names = append(names, f.Name())
+		var m meta
+		c.Assert(f.GetMeta(&m), IsNil)
+		c.Assert(m.Owner, Equals, "joe")
+	}
+	c.Assert(iter.Close(), IsNil)
+	c.Assert(names, DeepEquals, []string{"myfile0.txt", "myfile2.txt"})
+
+	files, err := gfs.OpenAll(bson.M{"metadata.tags": "b"})
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 2)
+	names = nil
+	for _, f := range files {
+		var m meta
+		c.Assert(f.GetMeta(&m), IsNil)
+		c.Assert(m.Tags, DeepEquals, metas[f.Name()[6]-'0'].Tags)
+		var b [1]byte
+		_, err = f.Read(b[:])
+		c.Assert(err, IsNil)
+		c.Assert(b[0], Equals, f.Name()[6])
+		names = append(names, f.Name())
+		c.Assert(f.Close(), IsNil)
+	}
+	sort.Strings(names)
+	c.Assert(names, DeepEquals, []string{"myfile0.txt", "myfile1.txt"})
+
+	query, err = gfs.FindMeta(bson.D{{Name: "owner", Value: "joe"}, {Name: "tags", Value: bson.M{"$in": []string{"c", "z"}}}})
+	c.Assert(err, IsNil)
+	n, err := query.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	// Logical operators are kept at the top level.
+	query, err = gfs.FindMeta(bson.M{"$or": []bson.M{{"owner": "ann"}, {"tags": "c"}}})
+	c.Assert(err, IsNil)
+	n, err = query.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+
+	_, err = gfs.FindMeta(bson.M{"$or": "bogus"})
+	c.Assert(err, ErrorMatches, `\$or must be an array of documents`)
+	_, err = gfs.FindMeta(bson.M{"owner": make(chan int)})
+	c.Assert(err, ErrorMatches, "Can't marshal chan int in a BSON document")
+}
+
+func (s *S) TestGridFSFindMetaQuery(c *C) {
+	query, err := mgo.GridFSMetaQuery(bson.D{
+		{Name: "owner", Value: "joe"},
+		{Name: "$and", Value: []bson.M{{"$nor": []bson.M{{"a": 1}}}, {"b": M{"$gt": 2}}}},
+		{Name: "$where", Value: "true"},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(query, DeepEquals, bson.D{
+		{Name: "metadata.owner", Value: "joe"},
+		{Name: "$and", Value: []any{
+			bson.D{{Name: "$nor", Value: []any{bson.D{{Name: "metadata.a", Value: 1}}}}},
+			bson.D{{Name: "metadata.b", Value: bson.D{{Name: "$gt", Value: 2}}}},
+		}},
+		{Name: "$where", Value: "true"},
+	})
+}
+
 func (s *S) TestGridFSOpenNext(c *C) {
 	session, err := mgo.Dial("localhost:40011")
 	c.Assert(err, IsNil)
@@ -132,7 +132,7 @@ func (c *Client) step1(in []byte) error {
 		const nonceLen = 6
 		buf := make([]byte, nonceLen+b64.EncodedLen(nonceLen))
 		if _, err := rand.Read(buf[:nonceLen]); err != nil {
-			return fmt.Errorf("cannot read random SCRAM-SHA-1 nonce from operating system: %v", err)
+			return fmt.Errorf("cannot read random SCRAM nonce from operating system: %v", err)
 		}
 		c.clientNonce = buf[nonceLen:]
 		b64.Encode(c.clientNonce, buf[:nonceLen])
@@ -155,32 +155,32 @@ func (c *Client) step2(in []byte) error {
 
 	fields := bytes.Split(in, []byte(","))
 	if len(fields) != 3 {
-		return fmt.Errorf("expected 3 fields in first SCRAM-SHA-1 server message, got %d: %q", len(fields), in)
+		return fmt.Errorf("expected 3 fields in first SCRAM server message, got %d: %q", len(fields), in)
 	}
 	if !bytes.HasPrefix(fields[0], []byte("r=")) || len(fields[0]) < 2 {
-		return fmt.Errorf("server sent an invalid SCRAM-SHA-1 nonce: %q", fields[0])
+		return fmt.Errorf("server sent an invalid SCRAM nonce: %q", fields[0])
 	}
 	if !bytes.HasPrefix(fields[1], []byte("s=")) || len(fields[1]) < 6 {
-		return fmt.Errorf("server sent an invalid SCRAM-SHA-1 salt: %q", fields[1])
+		return fmt.Errorf("server sent an invalid SCRAM salt: %q", fields[1])
 	}
 	if !bytes.HasPrefix(fields[2], []byte("i=")) || len(fields[2]) < 6 {
-		return fmt.Errorf("server sent an invalid SCRAM-SHA-1 iteration count: %q", fields[2])
+		return fmt.Errorf("server sent an invalid SCRAM iteration count: %q", fields[2])
 	}
 
 	c.serverNonce = fields[0][2:]
 	if !bytes.HasPrefix(c.serverNonce, c.clientNonce) {
-		return fmt.Errorf("server SCRAM-SHA-1 nonce is not prefixed by client nonce: got %q, want %q+\"...\"", c.serverNonce, c.clientNonce)
+		return fmt.Errorf("server SCRAM nonce is not prefixed by client nonce: got %q, want %q+\"...\"", c.serverNonce, c.clientNonce)
 	}
 
 	salt := make([]byte, b64.DecodedLen(len(fields[1][2:])))
 	n, err := b64.Decode(salt, fields[1][2:])
 	if err != nil {
-		return fmt.Errorf("cannot decode SCRAM-SHA-1 salt sent by server: %q", fields[1])
+		return fmt.Errorf("cannot decode SCRAM salt sent by server: %q", fields[1])
 	}
 	salt = salt[:n]
 	iterCount, err := strconv.Atoi(string(fields[2][2:]))
 	if err != nil {
-		return fmt.Errorf("server sent an invalid SCRAM-SHA-1 iteration count: %q", fields[2])
+		return fmt.Errorf("server sent an invalid SCRAM iteration count: %q", fields[2])
 	}
 	c.saltPassword(salt, iterCount)
 
@@ -202,12 +202,12 @@ func (c *Client) step3(in []byte) error {
 		ise = bytes.HasPrefix(fields[0], []byte("e="))
 	}
 	if ise {
-		return fmt.Errorf("SCRAM-SHA-1 authentication error: %s", fields[0][2:])
+		return fmt.Errorf("SCRAM authentication error: %s", fields[0][2:])
 	} else if !isv {
-		return fmt.Errorf("unsupported SCRAM-SHA-1 final message from server: %q", in)
+		return fmt.Errorf("unsupported SCRAM final message from server: %q", in)
 	}
 	if !bytes.Equal(c.serverSignature(), fields[0][2:]) {
-		return fmt.Errorf("cannot authenticate SCRAM-SHA-1 server signature: %q", fields[0][2:])
+		return fmt.Errorf("cannot authenticate SCRAM server signature: %q", fields[0][2:])
 	}
 	return nil
 }
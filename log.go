@@ -28,7 +28,10 @@ package mgo
 
 import (
 	"fmt"
+	"strings"
 	"sync"
+
+	"github.com/3JoB/mgo/bson"
 )
 
 // ---------------------------------------------------------------------------
@@ -41,10 +44,66 @@ type log_Logger interface {
 	Output(calldepth int, s string) error
 }
 
+// LogLevel is the severity of a driver log message.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// LogCategory identifies the part of the driver a log message comes from.
+// Categories may be combined with | when passed to SetLogCategories.
+type LogCategory uint
+
+const (
+	// LogTopology covers cluster discovery, server monitoring and
+	// server selection.
+	LogTopology LogCategory = 1 << iota
+
+	// LogCommands covers the operations and commands sent on behalf of
+	// sessions, along with their results. Credentials are redacted.
+	LogCommands
+
+	// LogConnections covers establishing, authenticating and closing
+	// connections to servers.
+	LogConnections
+
+	// LogAll enables every category.
+	LogAll = LogTopology | LogCommands | LogConnections
+)
+
+// String returns the lowercase name of the category, such as "topology".
+func (c LogCategory) String() string {
+	switch c {
+	case LogTopology:
+		return "topology"
+	case LogCommands:
+		return "commands"
+	case LogConnections:
+		return "connections"
+	}
+	return fmt.Sprintf("LogCategory(%d)", uint(c))
+}
+
+// Logger receives leveled driver log messages, each tagged with the
+// category it belongs to. It allows routing driver output into an
+// application's logging system. See SetLeveledLogger.
+type Logger interface {
+	Debug(category LogCategory, msg string)
+	Info(category LogCategory, msg string)
+	Warn(category LogCategory, msg string)
+	Error(category LogCategory, msg string)
+}
+
 var (
-	globalLogger log_Logger
-	globalDebug  bool
-	globalMutex  sync.Mutex
+	globalLogger     log_Logger
+	globalLeveled    Logger
+	globalLevel      = LevelInfo
+	globalCategories = LogAll
+	globalMutex      sync.Mutex
 )
 
 // RACE WARNING: There are known data races when logging, which are manually
@@ -54,6 +113,8 @@ var (
 // should elide the locks altogether in actual use.
 
 // Specify the *log.Logger object where log messages should be sent to.
+// Messages are written without their level or category; use
+// SetLeveledLogger to receive those too.
 func SetLogger(logger log_Logger) {
 	if raceDetector {
 		globalMutex.Lock()
@@ -62,72 +123,189 @@ func SetLogger(logger log_Logger) {
 	globalLogger = logger
 }
 
-// Enable the delivery of debug messages to the logger.  Only meaningful
-// if a logger is also set.
-func SetDebug(debug bool) {
+// SetLeveledLogger specifies the Logger where log messages should be sent
+// to. When set, it takes precedence over the logger provided to SetLogger.
+func SetLeveledLogger(logger Logger) {
 	if raceDetector {
 		globalMutex.Lock()
 		defer globalMutex.Unlock()
 	}
-	globalDebug = debug
+	globalLeveled = logger
+}
+
+// Enable the delivery of debug messages to the logger.  Only meaningful
+// if a logger is also set. This is the same as calling SetLogLevel with
+// LevelDebug, or with LevelInfo to disable them again.
+func SetDebug(debug bool) {
+	if debug {
+		SetLogLevel(LevelDebug)
+	} else {
+		SetLogLevel(LevelInfo)
+	}
 }
 
-func log(v ...any) {
+// SetLogLevel sets the minimum level of the messages delivered to the
+// logger. The default is LevelInfo.
+func SetLogLevel(level LogLevel) {
 	if raceDetector {
 		globalMutex.Lock()
 		defer globalMutex.Unlock()
 	}
-	if globalLogger != nil {
-		globalLogger.Output(2, fmt.Sprint(v...))
-	}
+	globalLevel = level
 }
 
-func logln(v ...any) {
+// SetLogCategories restricts the messages delivered to the logger to the
+// given categories. The default is LogAll.
+//
+// For example, to only see topology changes and connection activity:
+//
+//	mgo.SetLogCategories(mgo.LogTopology | mgo.LogConnections)
+func SetLogCategories(categories LogCategory) {
 	if raceDetector {
 		globalMutex.Lock()
 		defer globalMutex.Unlock()
 	}
-	if globalLogger != nil {
-		globalLogger.Output(2, fmt.Sprintln(v...))
-	}
+	globalCategories = categories
+}
+
+// logEnabled reports whether messages of the given level and category
+// would be delivered anywhere. It must be called with globalMutex held
+// when the race detector is in use.
+func logEnabled(level LogLevel, category LogCategory) bool {
+	return level >= globalLevel && globalCategories&category != 0 && (globalLeveled != nil || globalLogger != nil)
 }
 
-func logf(format string, v ...any) {
+// debugEnabled reports whether debug messages of the given category would
+// be delivered, so that costly debug output may be skipped otherwise.
+func debugEnabled(category LogCategory) bool {
 	if raceDetector {
 		globalMutex.Lock()
 		defer globalMutex.Unlock()
 	}
-	if globalLogger != nil {
-		globalLogger.Output(2, fmt.Sprintf(format, v...))
-	}
+	return logEnabled(LevelDebug, category)
 }
 
-func debug(v ...any) {
+// output delivers the message built by msg to the configured logger, if
+// its level and category are enabled. Building the message is deferred so
+// that disabled messages are not formatted at all.
+func output(level LogLevel, category LogCategory, msg func() string) {
 	if raceDetector {
 		globalMutex.Lock()
 		defer globalMutex.Unlock()
 	}
-	if globalDebug && globalLogger != nil {
-		globalLogger.Output(2, fmt.Sprint(v...))
+	if !logEnabled(level, category) {
+		return
+	}
+	if globalLeveled == nil {
+		globalLogger.Output(3, msg())
+		return
+	}
+	switch level {
+	case LevelDebug:
+		globalLeveled.Debug(category, msg())
+	case LevelInfo:
+		globalLeveled.Info(category, msg())
+	case LevelWarn:
+		globalLeveled.Warn(category, msg())
+	default:
+		globalLeveled.Error(category, msg())
 	}
 }
 
-func debugln(v ...any) {
-	if raceDetector {
-		globalMutex.Lock()
-		defer globalMutex.Unlock()
+func log(category LogCategory, v ...any) {
+	output(LevelInfo, category, func() string { return fmt.Sprint(v...) })
+}
+
+func logln(category LogCategory, v ...any) {
+	output(LevelInfo, category, func() string { return fmt.Sprintln(v...) })
+}
+
+func logf(category LogCategory, format string, v ...any) {
+	output(LevelInfo, category, func() string { return fmt.Sprintf(format, v...) })
+}
+
+func warnf(category LogCategory, format string, v ...any) {
+	output(LevelWarn, category, func() string { return fmt.Sprintf(format, v...) })
+}
+
+func errorf(category LogCategory, format string, v ...any) {
+	output(LevelError, category, func() string { return fmt.Sprintf(format, v...) })
+}
+
+func debug(category LogCategory, v ...any) {
+	output(LevelDebug, category, func() string { return fmt.Sprint(v...) })
+}
+
+func debugln(category LogCategory, v ...any) {
+	output(LevelDebug, category, func() string { return fmt.Sprintln(v...) })
+}
+
+func debugf(category LogCategory, format string, v ...any) {
+	output(LevelDebug, category, func() string { return fmt.Sprintf(format, v...) })
+}
+
+// sensitiveCommands holds the lowercased names of the commands whose
+// documents carry credentials, and which are thus never logged verbatim.
+var sensitiveCommands = map[string]bool{
+	"authenticate":    true,
+	"saslstart":       true,
+	"saslcontinue":    true,
+	"getnonce":        true,
+	"copydb":          true,
+	"copydbgetnonce":  true,
+	"copydbsaslstart": true,
+	"createuser":      true,
+	"updateuser":      true,
+}
+
+// sensitiveCommand returns the name of the credential-carrying command in
+// cmd, or "" if cmd isn't one. All top-level keys are checked since the
+// key order of maps is unspecified.
+func sensitiveCommand(cmd any) string {
+	if cmd == nil {
+		return ""
+	}
+	data, err := bson.Marshal(cmd)
+	if err != nil {
+		return ""
 	}
-	if globalDebug && globalLogger != nil {
-		globalLogger.Output(2, fmt.Sprintln(v...))
+	var doc bson.RawD
+	if bson.Unmarshal(data, &doc) != nil {
+		return ""
 	}
+	for _, elem := range doc {
+		if sensitiveCommands[strings.ToLower(elem.Name)] {
+			return elem.Name
+		}
+	}
+	return ""
 }
 
-func debugf(format string, v ...any) {
-	if raceDetector {
-		globalMutex.Lock()
-		defer globalMutex.Unlock()
+// isSensitiveCommand reports whether cmd carries credentials.
+func isSensitiveCommand(cmd any) bool {
+	return sensitiveCommand(cmd) != ""
+}
+
+// redactCommand returns cmd as it may be logged, replacing commands that
+// carry credentials with a placeholder holding just the command name.
+func redactCommand(cmd any) any {
+	if name := sensitiveCommand(cmd); name != "" {
+		return bson.D{{Name: name, Value: "<redacted>"}}
+	}
+	return cmd
+}
+
+// redactOp returns op as it may be logged, with the command of a query
+// operation redacted as done by redactCommand.
+func redactOp(op any) any {
+	qop, ok := op.(*queryOp)
+	if !ok || !isSensitiveCommand(qop.query) {
+		return op
 	}
-	if globalDebug && globalLogger != nil {
-		globalLogger.Output(2, fmt.Sprintf(format, v...))
+	redacted := *qop
+	redacted.query = redactCommand(qop.query)
+	if redacted.options.Query != nil {
+		redacted.options.Query = redacted.query
 	}
+	return &redacted
 }
@@ -0,0 +1,226 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2012 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/3JoB/mgo/bson"
+)
+
+// CommandMonitor receives an event when a command or query is sent to a
+// server, and another one when its reply arrives or it fails. The methods
+// are called from the goroutines doing the I/O, so they must return quickly
+// and must not use the driver. See SetCommandMonitor.
+type CommandMonitor interface {
+	Started(event *CommandStartedEvent)
+	Succeeded(event *CommandSucceededEvent)
+	Failed(event *CommandFailedEvent)
+}
+
+// CommandEvent holds the details shared by all command monitoring events.
+type CommandEvent struct {
+	// CommandName is the name of the command, such as "insert" or
+	// "getMore". Queries sent without a command are named "find".
+	CommandName string
+
+	// DatabaseName is the database the command was sent to.
+	DatabaseName string
+
+	// RequestId is the wire protocol id of the request, and may be used
+	// to match the started event with the one that ends the command.
+	RequestId int32
+
+	// ConnectionId identifies the connection the command was sent
+	// through. It is unique within the process.
+	ConnectionId int64
+
+	// Address is the address of the server the command was sent to.
+	Address string
+}
+
+// CommandStartedEvent is delivered when a command is sent to a server.
+type CommandStartedEvent struct {
+	CommandEvent
+
+	// Command is the command document as provided to the driver. The
+	// arguments of commands carrying credentials, such as authenticate
+	// and saslStart, are redacted.
+	Command any
+}
+
+// CommandSucceededEvent is delivered when a command completes successfully.
+type CommandSucceededEvent struct {
+	CommandEvent
+
+	// Duration is the time elapsed between sending the command and
+	// receiving its reply.
+	Duration time.Duration
+}
+
+// CommandFailedEvent is delivered when a command fails, either because the
+// server reported an error or because the connection was lost.
+type CommandFailedEvent struct {
+	CommandEvent
+
+	// Duration is the time elapsed between sending the command and
+	// observing the failure.
+	Duration time.Duration
+
+	// Failure is the error the command failed with.
+	Failure error
+}
+
+type monitorHolder struct {
+	monitor CommandMonitor
+}
+
+var globalMonitor atomic.Value // monitorHolder
+
+// SetCommandMonitor sets the monitor to be notified of every command,
+// query and getMore sent to servers by the driver, including write
+// commands and the commands used internally to monitor servers.
+// Provide nil to stop monitoring.
+func SetCommandMonitor(monitor CommandMonitor) {
+	globalMonitor.Store(monitorHolder{monitor})
+}
+
+func commandMonitor() CommandMonitor {
+	holder, _ := globalMonitor.Load().(monitorHolder)
+	return holder.monitor
+}
+
+var lastConnectionId int64
+
+func nextConnectionId() int64 {
+	return atomic.AddInt64(&lastConnectionId, 1)
+}
+
+// monitoredRequest tracks a request on its way to the server, delivering
+// its monitoring events.
+type monitoredRequest struct {
+	monitor CommandMonitor
+	event   CommandEvent
+	command any
+	ns      string
+	started time.Time
+	done    bool
+}
+
+// newMonitoredRequest returns the monitoredRequest for op sent through
+// socket, or nil if op is not monitored.
+func newMonitoredRequest(monitor CommandMonitor, socket *mongoSocket, op any) *monitoredRequest {
+	req := &monitoredRequest{monitor: monitor}
+	switch op := op.(type) {
+	case *queryOp:
+		req.ns = op.collection
+		if strings.HasSuffix(op.collection, ".$cmd") {
+			req.event.CommandName = commandDocName(op.query)
+			req.command = redactCommand(op.query)
+		} else {
+			req.event.CommandName = "find"
+			req.command = op.query
+		}
+	case *getMoreOp:
+		req.ns = op.collection
+		req.event.CommandName = "getMore"
+		req.command = bson.D{
+			{Name: "getMore", Value: op.cursorId},
+			{Name: "collection", Value: op.collection[strings.Index(op.collection, ".")+1:]},
+		}
+	default:
+		return nil
+	}
+	if i := strings.Index(req.ns, "."); i >= 0 {
+		req.event.DatabaseName = req.ns[:i]
+	} else {
+		req.event.DatabaseName = req.ns
+	}
+	req.event.ConnectionId = socket.id
+	req.event.Address = socket.addr
+	return req
+}
+
+// commandDocName returns the name of the command in cmd, which is the
+// first key of the document.
+func commandDocName(cmd any) string {
+	if d, ok := cmd.(bson.D); ok {
+		if len(d) > 0 {
+			return d[0].Name
+		}
+		return ""
+	}
+	data, err := bson.Marshal(cmd)
+	if err != nil {
+		return ""
+	}
+	var doc bson.RawD
+	if bson.Unmarshal(data, &doc) != nil || len(doc) == 0 {
+		return ""
+	}
+	return doc[0].Name
+}
+
+// start delivers the started event for the request sent with requestId.
+func (req *monitoredRequest) start(requestId uint32) {
+	req.event.RequestId = int32(requestId)
+	req.started = time.Now()
+	req.monitor.Started(&CommandStartedEvent{CommandEvent: req.event, Command: req.command})
+}
+
+// wrap returns a replyFunc that delivers the event ending the request
+// before handing the reply over to replyFunc.
+func (req *monitoredRequest) wrap(replyFunc replyFunc) replyFunc {
+	return func(err error, reply *replyOp, docNum int, docData []byte) {
+		if !req.done && docNum <= 0 {
+			req.done = true
+			req.finish(err, reply, docData)
+		}
+		replyFunc(err, reply, docNum, docData)
+	}
+}
+
+func (req *monitoredRequest) finish(err error, reply *replyOp, docData []byte) {
+	if req.started.IsZero() {
+		// Never sent, as the socket was already dead.
+		return
+	}
+	duration := time.Since(req.started)
+	if err == nil && reply != nil && reply.flags&1 != 0 {
+		err = ErrCursor
+	}
+	if err == nil && docData != nil {
+		err = checkQueryError(req.ns, docData)
+	}
+	if err != nil {
+		req.monitor.Failed(&CommandFailedEvent{CommandEvent: req.event, Duration: duration, Failure: err})
+	} else {
+		req.monitor.Succeeded(&CommandSucceededEvent{CommandEvent: req.event, Duration: duration})
+	}
+}
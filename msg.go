@@ -0,0 +1,293 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2012 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/3JoB/mgo/bson"
+)
+
+// Command execution with the OP_MSG wire protocol message, which servers
+// with a maxWireVersion of 6 (MongoDB 3.6) or later support in place of
+// commands sent as OP_QUERY messages against the "$cmd" collection.
+//
+// Relevant documentation:
+//
+//	https://github.com/mongodb/specifications/blob/master/source/message/OP_MSG.rst
+
+const opMsg = 2013
+
+const (
+	msgFlagChecksumPresent = 1 << 0
+	msgFlagMoreToCome      = 1 << 1
+)
+
+// docSeqFields maps the write commands to the field holding the documents
+// they operate on. These documents are sent as a document sequence
+// (section kind 1) rather than within the command body, so that a batch
+// is only bounded by the maximum message size rather than by the maximum
+// BSON document size.
+var docSeqFields = map[string]string{
+	"insert": "documents",
+	"update": "updates",
+	"delete": "deletes",
+}
+
+// useMsg returns whether op should be sent to the server as an OP_MSG
+// message rather than as an OP_QUERY one.
+func (socket *mongoSocket) useMsg(op *queryOp) bool {
+	if !strings.HasSuffix(op.collection, ".$cmd") || op.selector != nil {
+		return false
+	}
+	if info := socket.ServerInfo(); info == nil || info.MaxWireVersion < 6 {
+		return false
+	}
+	// The handshake goes over OP_QUERY, as servers accept it for these
+	// commands regardless of their version.
+	if cmd, ok := op.query.(bson.D); ok && len(cmd) > 0 {
+		switch strings.ToLower(cmd[0].Name) {
+		case "ismaster", "hello":
+			return false
+		}
+	}
+	// Snapshot and MaxScan have no OP_MSG counterpart. The other legacy
+	// query options are turned into command fields by addMsg.
+	if op.hasOptions && (op.options.Snapshot || op.options.MaxScan != 0) {
+		return false
+	}
+	return true
+}
+
+// msgFields returns the command fields matching the legacy query options
+// in o, as understood by the find command.
+func (o *queryWrapper) msgFields() bson.D {
+	var fields bson.D
+	if o.OrderBy != nil {
+		fields = append(fields, bson.DocElem{Name: "sort", Value: o.OrderBy})
+	}
+	if o.Hint != nil {
+		fields = append(fields, bson.DocElem{Name: "hint", Value: o.Hint})
+	}
+	if o.MaxTimeMS != 0 {
+		fields = append(fields, bson.DocElem{Name: "maxTimeMS", Value: o.MaxTimeMS})
+	}
+	if o.Comment != "" {
+		fields = append(fields, bson.DocElem{Name: "comment", Value: o.Comment})
+	}
+	return fields
+}
+
+// msgReadPreference returns the $readPreference document to send along
+// with op, or nil if none should be sent. OP_MSG has no slaveOk flag, so
+// a replica set member only serves the command when not primary if it is
+// told so by a non-primary read preference. Other servers were already
+// picked by mode and tags, so only mongos gets the full document.
+// Transactions always run on the primary, which rejects any other mode.
+func (op *queryOp) msgReadPreference(socket *mongoSocket) bson.D {
+	if op.flags&flagSlaveOk == 0 || op.txn != nil {
+		return nil
+	}
+	rp := op.readPreference()
+	if socket.ServerInfo().Mongos {
+		return rp
+	}
+	mode := rp[0]
+	if mode.Value == "primary" {
+		mode.Value = "primaryPreferred"
+	}
+	return bson.D{mode}
+}
+
+// addMsg appends to b the OP_MSG message for the command in op, and
+// reports whether the message may be sent compressed.
+func addMsg(b []byte, op *queryOp, socket *mongoSocket) (buf []byte, compress bool, err error) {
+	if debugEnabled(LogCommands) {
+		debugf(LogCommands, "Socket %p to %s: serializing command: %#v", socket, socket.addr, redactCommand(op.query))
+	}
+	cmd, err := addBSON(nil, op.query)
+	if err != nil {
+		return b, false, err
+	}
+
+	var seqName string
+	var seqDocs []bson.Raw
+	if op.hasOptions {
+		if cmd, err = appendFields(cmd, op.options.msgFields()); err != nil {
+			return b, false, err
+		}
+	}
+	if op.hasOptions && op.options.Explain {
+		cmd, err = bson.Marshal(bson.D{{Name: "explain", Value: bson.Raw{Kind: 0x03, Data: cmd}}})
+	} else {
+		cmd, seqName, seqDocs, err = splitDocSeq(cmd)
+	}
+	if err == nil && op.txn != nil {
+		cmd, err = op.txn.txnCmd(cmd)
+	}
+	if err != nil {
+		return b, false, err
+	}
+
+	extra := bson.D{{Name: "$db", Value: strings.TrimSuffix(op.collection, ".$cmd")}}
+	if rp := op.msgReadPreference(socket); rp != nil {
+		extra = append(extra, bson.DocElem{Name: "$readPreference", Value: rp})
+	}
+	if cmd, err = appendFields(cmd, extra); err != nil {
+		return b, false, err
+	}
+
+	b = addHeader(b, opMsg)
+	b = addInt32(b, 0) // Flag bits
+
+	b = append(b, 0) // Body section
+	b = append(b, cmd...)
+	_, name, _ := firstElem(cmd)
+	compress = !uncompressible[strings.ToLower(name)]
+
+	if seqName != "" {
+		b = append(b, 1) // Document sequence section
+		seqStart := len(b)
+		b = addInt32(b, 0)
+		b = addCString(b, seqName)
+		for _, doc := range seqDocs {
+			b = append(b, doc.Data...)
+		}
+		setInt32(b, seqStart, int32(len(b)-seqStart))
+	}
+	return b, compress, nil
+}
+
+// appendFields returns the serialized document doc with fields appended.
+func appendFields(doc []byte, fields bson.D) ([]byte, error) {
+	if len(fields) == 0 {
+		return doc, nil
+	}
+	data, err := bson.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(doc)+len(data)-5)
+	out = append(out, doc[:len(doc)-1]...)
+	out = append(out, data[4:]...)
+	setInt32(out, 0, int32(len(out)))
+	return out, nil
+}
+
+// splitDocSeq returns the serialized write command cmd without the field
+// holding the documents it operates on, along with the field name and the
+// documents. Other commands are returned unchanged.
+func splitDocSeq(cmd []byte) (body []byte, seqName string, seqDocs []bson.Raw, err error) {
+	var d bson.RawD
+	if err := bson.Unmarshal(cmd, &d); err != nil {
+		return nil, "", nil, err
+	}
+	if len(d) == 0 {
+		return cmd, "", nil, nil
+	}
+	field, ok := docSeqFields[d[0].Name]
+	if !ok {
+		return cmd, "", nil, nil
+	}
+	for i, elem := range d {
+		if elem.Name != field {
+			continue
+		}
+		if elem.Value.Kind != 0x04 {
+			return cmd, "", nil, nil
+		}
+		if err := elem.Value.Unmarshal(&seqDocs); err != nil {
+			return nil, "", nil, err
+		}
+		for _, doc := range seqDocs {
+			if doc.Kind != 0x03 {
+				return cmd, "", nil, nil
+			}
+		}
+		rest := make(bson.RawD, 0, len(d)-1)
+		rest = append(rest, d[:i]...)
+		rest = append(rest, d[i+1:]...)
+		body, err = bson.Marshal(rest)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		return body, field, seqDocs, nil
+	}
+	return cmd, "", nil, nil
+}
+
+// readMsg reads from r the remainder of an OP_MSG message with the given
+// length, not including the message header, and returns its body document.
+func readMsg(r io.Reader, length int) (body []byte, err error) {
+	if length < 5 {
+		return nil, errors.New("OP_MSG message is too short, corrupted data?")
+	}
+	b := make([]byte, length)
+	if err := fill(r, b); err != nil {
+		return nil, err
+	}
+	flags := uint32(getInt32(b, 0))
+	if flags&msgFlagMoreToCome != 0 {
+		return nil, errors.New("unexpected OP_MSG moreToCome flag in reply")
+	}
+	end := len(b)
+	if flags&msgFlagChecksumPresent != 0 {
+		end -= 4
+	}
+	for pos := 4; pos < end; {
+		kind := b[pos]
+		pos++
+		if pos+4 > end {
+			return nil, errors.New("OP_MSG section is truncated, corrupted data?")
+		}
+		size := int(getInt32(b, pos))
+		if size < 5 || pos+size > end {
+			return nil, errors.New("OP_MSG section has a bad size, corrupted data?")
+		}
+		switch kind {
+		case 0:
+			if body != nil {
+				return nil, errors.New("OP_MSG reply has multiple body sections")
+			}
+			body = b[pos : pos+size]
+		case 1:
+			// The driver never asks for replies holding document
+			// sequences, so their documents would be silently lost.
+			return nil, errors.New("unexpected OP_MSG document sequence in reply")
+		default:
+			return nil, fmt.Errorf("unknown OP_MSG section kind %d in reply", kind)
+		}
+		pos += size
+	}
+	if body == nil {
+		return nil, errors.New("OP_MSG reply has no body section")
+	}
+	return body, nil
+}
@@ -0,0 +1,170 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2012 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"errors"
+	"time"
+
+	"github.com/3JoB/mgo/bson"
+)
+
+// OplogTail follows the replica set oplog, yielding its entries in order
+// as they are appended. Unlike a plain tailable iterator obtained via
+// Query.Tail, an OplogTail keeps track of the timestamp of the last entry
+// seen, and transparently reestablishes the underlying cursor from that
+// point whenever it dies. See Query.TailKey.
+//
+// The last seen timestamp may be obtained via LastTimestamp and persisted,
+// so that a later OplogTail may resume right after it even across process
+// restarts, as long as the entry is still present in the oplog.
+//
+// An OplogTail is not safe for concurrent use.
+//
+// Relevant documentation:
+//
+//	https://docs.mongodb.com/manual/core/replica-set-oplog/
+type OplogTail struct {
+	session  *Session
+	iter     *Iter
+	last     bson.MongoTimestamp
+	timeout  time.Duration
+	timedout bool
+	failed   bool
+	err      error
+}
+
+// TailOplog returns an OplogTail that yields the entries in the local.oplog.rs
+// collection with a timestamp after the provided one. If after is zero, the
+// whole oplog is yielded. The timeout parameter has the same semantics as
+// in Query.Tail.
+//
+// The OplogTail uses its own copy of the session, which is closed when
+// the OplogTail is closed.
+func (s *Session) TailOplog(after bson.MongoTimestamp, timeout time.Duration) *OplogTail {
+	return &OplogTail{
+		session: s.Copy(),
+		last:    after,
+		timeout: timeout,
+	}
+}
+
+func (t *OplogTail) tail() *Iter {
+	var query any
+	if t.last != 0 {
+		query = bson.M{"ts": bson.M{"$gt": t.last}}
+	}
+	oplog := t.session.DB("local").C("oplog.rs")
+	return oplog.Find(query).Sort("$natural").LogReplay().TailKey("ts").Tail(t.timeout)
+}
+
+// Next unmarshals the next oplog entry into result, which may be a
+// *bson.Raw value or any other value accepted by bson.Unmarshal, and
+// returns true. If no entry is available within the timeout, or if an
+// error happens, Next returns false and Timeout or Err may be used to
+// tell the cases apart. After a timeout, Next may be called again.
+//
+// If the underlying cursor dies, it is reestablished right after the last
+// seen entry. If the cursor fails with an error, the session is refreshed
+// before trying again, and the error is only reported if the new cursor
+// also fails before yielding any entries.
+func (t *OplogTail) Next(result any) bool {
+	t.timedout = false
+	for t.err == nil {
+		if t.iter == nil {
+			t.iter = t.tail()
+		}
+		var raw bson.Raw
+		if t.iter.Next(&raw) {
+			var ts bson.MongoTimestamp
+			if elem, ok := raw.Lookup("ts"); !ok {
+				t.err = errors.New("oplog entry has no ts field")
+				return false
+			} else if err := elem.Unmarshal(&ts); err != nil {
+				t.err = err
+				return false
+			}
+			if err := raw.Unmarshal(result); err != nil {
+				t.err = err
+				return false
+			}
+			t.last = ts
+			t.failed = false
+			return true
+		}
+		if t.iter.Timeout() {
+			t.timedout = true
+			return false
+		}
+		err := t.iter.Close()
+		t.iter = nil
+		if err == nil {
+			// Cursors that die are reopened by the iterator itself,
+			// but should it stop anyway, just query again.
+			continue
+		}
+		if t.failed {
+			t.err = err
+			return false
+		}
+		debugf(LogCommands, "Oplog tail cursor failed, reestablishing: %v", err)
+		t.failed = true
+		t.session.Refresh()
+	}
+	return false
+}
+
+// LastTimestamp returns the timestamp of the last oplog entry yielded by
+// Next, or the timestamp provided to TailOplog if no entries were yielded.
+func (t *OplogTail) LastTimestamp() bson.MongoTimestamp {
+	return t.last
+}
+
+// Timeout returns true if Next returned false due to a timeout.
+func (t *OplogTail) Timeout() bool {
+	return t.timedout
+}
+
+// Err returns nil if no errors happened while tailing the oplog,
+// or the actual error otherwise.
+func (t *OplogTail) Err() error {
+	return t.err
+}
+
+// Close kills the underlying cursor, if any, and closes the session used
+// by the OplogTail. It returns the error that stopped the tail, if any.
+func (t *OplogTail) Close() error {
+	if t.iter != nil {
+		err := t.iter.Close()
+		t.iter = nil
+		if t.err == nil {
+			t.err = err
+		}
+	}
+	t.session.Close()
+	return t.err
+}
@@ -0,0 +1,130 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2015 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo_test
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/3JoB/mgo"
+	"github.com/3JoB/mgo/bson"
+)
+
+type oplogEntry struct {
+	Ts bson.MongoTimestamp `bson:"ts"`
+	Op string              `bson:"op"`
+	Ns string              `bson:"ns"`
+	O  bson.M              `bson:"o"`
+}
+
+func (s *S) TestOplogTail(c *C) {
+	session, err := mgo.Dial("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	// Start right after the most recent entry.
+	var last oplogEntry
+	err = session.DB("local").C("oplog.rs").Find(nil).Sort("-$natural").One(&last)
+	c.Assert(err, IsNil)
+
+	coll := session.DB("mydb").C("mycoll")
+	for i := 0; i < 3; i++ {
+		err = coll.Insert(M{"n": i})
+		c.Assert(err, IsNil)
+	}
+
+	tail := session.TailOplog(last.Ts, 2*time.Second)
+	defer tail.Close()
+
+	var entries []oplogEntry
+	var entry oplogEntry
+	for len(entries) < 3 && tail.Next(&entry) {
+		if entry.Ns == "mydb.mycoll" {
+			entries = append(entries, entry)
+		}
+		c.Assert(tail.LastTimestamp(), Equals, entry.Ts)
+	}
+	c.Assert(tail.Err(), IsNil)
+	c.Assert(entries, HasLen, 3)
+	for i, entry := range entries {
+		c.Assert(entry.Op, Equals, "i")
+		c.Assert(entry.O["n"], Equals, i)
+		c.Assert(entry.Ts > last.Ts, Equals, true)
+	}
+
+	// Nothing else to see.
+	var raw bson.Raw
+	for tail.Next(&raw) {
+	}
+	c.Assert(tail.Timeout(), Equals, true)
+	c.Assert(tail.Err(), IsNil)
+
+	// Kill the cursor under the tail and check it resumes where it stopped.
+	err = mgo.KillOplogTailCursor(tail)
+	c.Assert(err, IsNil)
+
+	err = coll.Insert(M{"n": 3})
+	c.Assert(err, IsNil)
+
+	found := false
+	for !found && tail.Next(&entry) {
+		found = entry.Ns == "mydb.mycoll" && entry.O["n"] == 3
+	}
+	c.Assert(tail.Err(), IsNil)
+	c.Assert(found, Equals, true)
+
+	// A new tail may resume from a persisted timestamp.
+	resume := session.TailOplog(entries[1].Ts, 2*time.Second)
+	defer resume.Close()
+	for resume.Next(&entry) && entry.Ns != "mydb.mycoll" {
+	}
+	c.Assert(resume.Err(), IsNil)
+	c.Assert(entry.Ts, Equals, entries[2].Ts)
+	c.Assert(entry.O["n"], Equals, 2)
+}
+
+func (s *S) TestOplogTailResumeQuery(c *C) {
+	ts := bson.MongoTimestamp(42)
+	tests := []struct {
+		query, resume any
+	}{
+		{nil, bson.D{{Name: "ts", Value: bson.D{{Name: "$gt", Value: ts}}}}},
+		// The top-level range on ts required by oplog replay is kept.
+		{bson.M{"ts": bson.M{"$gt": bson.MongoTimestamp(1)}}, bson.M{"ts": bson.D{{Name: "$gt", Value: ts}}}},
+		{bson.D{{Name: "ns", Value: "a.b"}, {Name: "ts", Value: bson.D{{Name: "$gte", Value: bson.MongoTimestamp(1)}}}},
+			bson.D{{Name: "ns", Value: "a.b"}, {Name: "ts", Value: bson.D{{Name: "$gt", Value: ts}}}}},
+		// Other conditions on ts are combined with the new one.
+		{bson.M{"ts": bson.M{"$lt": bson.MongoTimestamp(100)}}, bson.D{{Name: "$and", Value: []any{
+			bson.M{"ts": bson.M{"$lt": bson.MongoTimestamp(100)}},
+			bson.D{{Name: "ts", Value: bson.D{{Name: "$gt", Value: ts}}}},
+		}}}},
+	}
+	for _, test := range tests {
+		c.Assert(mgo.TailResumeQuery(test.query, "ts", ts), DeepEquals, test.resume)
+	}
+}
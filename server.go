@@ -27,8 +27,11 @@
 package mgo
 
 import (
+	"crypto/tls"
 	"errors"
 	"net"
+	"runtime"
+	debugpkg "runtime/debug"
 	"sort"
 	"sync"
 	"time"
@@ -50,46 +53,115 @@ type mongoServer struct {
 	abended       bool
 	sync          chan bool
 	dial          dialer
-	pingValue     time.Duration
-	pingIndex     int
+	pingValue     time.Duration // Weighted average of the round-trip times.
 	pingCount     uint32
-	pingWindow    [6]time.Duration
 	info          *mongoServerInfo
+	buildInfo     *BuildInfo // Cached by Session.BuildInfo until a socket abends.
+	minPoolSize   int
+	poolFill      chan bool
 }
 
 type dialer struct {
-	old func(addr net.Addr) (net.Conn, error)
-	new func(addr *ServerAddr) (net.Conn, error)
+	old         func(addr net.Addr) (net.Conn, error)
+	new         func(addr *ServerAddr) (net.Conn, error)
+	network     string
+	tls         *tls.Config
+	compressors []string
+	appName     string
+	timeout     time.Duration
+
+	proxy         string
+	proxyUsername string
+	proxyPassword string
+
+	heartbeat    time.Duration
+	minHeartbeat time.Duration
 }
 
+// syncDelay returns how long to wait for a checkup of the cluster topology
+// if nothing else kicks a synchronization before that.
+func (dial dialer) syncDelay() time.Duration {
+	if dial.heartbeat > 0 {
+		return dial.heartbeat
+	}
+	return syncServersDelay
+}
+
+// shortDelay returns the minimum time between consecutive checks of the
+// cluster topology.
+func (dial dialer) shortDelay() time.Duration {
+	if dial.minHeartbeat > 0 {
+		return dial.minHeartbeat
+	}
+	return syncShortDelay
+}
+
+// dialNetwork returns the network to dial servers and resolve addresses with.
+func (dial dialer) dialNetwork() string {
+	if dial.network == "" {
+		return "tcp"
+	}
+	return dial.network
+}
+
+var dialTimeout = net.DialTimeout
+
 func (dial dialer) isSet() bool {
 	return dial.old != nil || dial.new != nil
 }
 
+// proxied returns whether connections go through a SOCKS5 proxy, which
+// resolves the server addresses on its side of the network.
+func (dial dialer) proxied() bool {
+	return dial.proxy != "" && !dial.isSet()
+}
+
 type mongoServerInfo struct {
 	Master         bool
 	Mongos         bool
 	Tags           bson.D
 	MaxWireVersion int
 	SetName        string
+	Compressor     string // Agreed with the server, if any
+
+	MaxWriteBatchSize int // Operations accepted per write command, if known
 }
 
 var defaultServerInfo mongoServerInfo
 
-func newServer(addr string, tcpaddr *net.TCPAddr, sync chan bool, dial dialer) *mongoServer {
+func newServer(addr, resolvedAddr string, tcpaddr *net.TCPAddr, sync chan bool, dial dialer, minPoolSize int) *mongoServer {
 	server := &mongoServer{
 		Addr:         addr,
-		ResolvedAddr: tcpaddr.String(),
+		ResolvedAddr: resolvedAddr,
 		tcpaddr:      tcpaddr,
 		sync:         sync,
 		dial:         dial,
 		info:         &defaultServerInfo,
 		pingValue:    time.Hour, // Push it back before an actual ping.
+		minPoolSize:  minPoolSize,
 	}
 	go server.pinger(true)
+	if minPoolSize > 0 {
+		server.poolFill = make(chan bool, 1)
+		go server.poolFiller()
+	}
 	return server
 }
 
+// PoolStats returns the number of sockets established with the server,
+// and how many of them are in use or available for reuse.
+func (server *mongoServer) PoolStats() PoolStats {
+	server.RLock()
+	stats := PoolStats{
+		Addr:      server.Addr,
+		Total:     len(server.liveSockets),
+		Available: len(server.unusedSockets),
+	}
+	server.RUnlock()
+	stats.InUse = stats.Total - stats.Available
+	return stats
+}
+
 var errPoolLimit = errors.New("per-server connection limit reached")
 var errServerClosed = errors.New("server was closed")
 
@@ -122,6 +194,11 @@ func (server *mongoServer) AcquireSocket(poolLimit int, timeout time.Duration) (
 			server.Unlock()
 			err = socket.InitialAcquire(info, timeout)
 			if err != nil {
+				// Socket died while cached. Forget about it.
+				server.Lock()
+				server.liveSockets = removeSocket(server.liveSockets, socket)
+				server.Unlock()
+				server.fillPool()
 				continue
 			}
 		} else {
@@ -154,19 +231,37 @@ func (server *mongoServer) Connect(timeout time.Duration) (*mongoSocket, error)
 	dial := server.dial
 	server.RUnlock()
 
-	logf("Establishing new connection to %s (timeout=%s)...", server.Addr, timeout)
+	logf(LogConnections, "Establishing new connection to %s (timeout=%s)...", server.Addr, timeout)
 	var conn net.Conn
 	var err error
 	switch {
 	case !dial.isSet():
 		// Cannot do this because it lacks timeout support. :-(
 		// conn, err = net.DialTCP("tcp", nil, server.tcpaddr)
-		conn, err = net.DialTimeout("tcp", server.ResolvedAddr, timeout)
+		var dialf func(network, address string, timeout time.Duration) (net.Conn, error)
+		if raceDetector {
+			// This variable is only ever touched by tests.
+			globalMutex.Lock()
+			dialf = dialTimeout
+			globalMutex.Unlock()
+		} else {
+			dialf = dialTimeout
+		}
+		if dial.proxy != "" {
+			// The proxy is handed the address as provided, so that
+			// it may resolve names on its side of the network.
+			conn, err = dialSOCKS5(dialf, dial, server.Addr, timeout)
+		} else {
+			conn, err = dialf(dial.dialNetwork(), server.ResolvedAddr, timeout)
+		}
 		if tcpconn, ok := conn.(*net.TCPConn); ok {
 			tcpconn.SetKeepAlive(true)
 		} else if err == nil {
 			panic("internal error: obtained TCP connection is not a *net.TCPConn!?")
 		}
+		if err == nil && dial.tls != nil {
+			conn, err = tlsHandshake(conn, server.Addr, dial.tls, timeout)
+		}
 	case dial.old != nil:
 		conn, err = dial.old(server.tcpaddr)
 	case dial.new != nil:
@@ -175,13 +270,113 @@ func (server *mongoServer) Connect(timeout time.Duration) (*mongoSocket, error)
 		panic("dialer is set, but both dial.old and dial.new are nil")
 	}
 	if err != nil {
-		logf("Connection to %s failed: %v", server.Addr, err.Error())
+		warnf(LogConnections, "Connection to %s failed: %v", server.Addr, err.Error())
 		return nil, err
 	}
-	logf("Connection to %s established.", server.Addr)
+	logf(LogConnections, "Connection to %s established.", server.Addr)
 
 	stats.conn(+1, master)
-	return newSocket(server, conn, timeout), nil
+	socket := newSocket(server, conn, timeout)
+	if dial.appName != "" {
+		if err := socket.handshake(dial.appName); err != nil {
+			warnf(LogConnections, "Handshake with %s failed: %v", server.Addr, err)
+			socket.Close()
+			socket.Release()
+			return nil, err
+		}
+	}
+	return socket, nil
+}
+
+// handshake sends the first isMaster command on the socket together with
+// the client metadata, which the server only accepts at that point and
+// reports in currentOp and in its logs for the life of the connection.
+func (socket *mongoSocket) handshake(appName string) error {
+	cmd := bson.D{
+		{Name: "isMaster", Value: 1},
+		{Name: "client", Value: clientMetadata(appName)},
+	}
+	op := queryOp{
+		collection: "admin.$cmd",
+		query:      cmd,
+		flags:      flagSlaveOk,
+		limit:      -1,
+	}
+	data, err := socket.SimpleQuery(&op)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		Ok     bool
+		Errmsg string
+		Code   int
+	}
+	if err := bson.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	if !result.Ok {
+		return &QueryError{Code: result.Code, Message: result.Errmsg}
+	}
+	return nil
+}
+
+// maxAppNameLen is the longest application name servers accept in the
+// client metadata.
+const maxAppNameLen = 128
+
+// clientMetadata returns the client document sent in the handshake.
+func clientMetadata(appName string) bson.D {
+	return bson.D{
+		{Name: "application", Value: bson.D{{Name: "name", Value: appName}}},
+		{Name: "driver", Value: bson.D{{Name: "name", Value: "mgo"}, {Name: "version", Value: driverVersion()}}},
+		{Name: "os", Value: bson.D{{Name: "type", Value: runtime.GOOS}, {Name: "architecture", Value: runtime.GOARCH}}},
+		{Name: "platform", Value: runtime.Version()},
+	}
+}
+
+// driverVersion returns the version of this package as recorded in the
+// build information of the running binary, or "devel" if unknown.
+func driverVersion() string {
+	const path = "github.com/3JoB/mgo"
+	if bi, ok := debugpkg.ReadBuildInfo(); ok {
+		if bi.Main.Path == path && bi.Main.Version != "" {
+			return bi.Main.Version
+		}
+		for _, dep := range bi.Deps {
+			if dep.Path == path {
+				if dep.Replace != nil && dep.Replace.Version != "" {
+					return dep.Replace.Version
+				}
+				return dep.Version
+			}
+		}
+	}
+	return "devel"
+}
+
+// tlsHandshake wraps conn in a TLS client connection with the provided
+// configuration and performs the handshake within timeout. Unless the
+// configuration sets ServerName, the host in addr is used for SNI and
+// for verifying the server certificate.
+func tlsHandshake(conn net.Conn, addr string, config *tls.Config, timeout time.Duration) (net.Conn, error) {
+	if config.ServerName == "" {
+		config = config.Clone()
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			config.ServerName = host
+		} else {
+			config.ServerName = addr
+		}
+	}
+	tlsConn := tls.Client(conn, config)
+	if timeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
 }
 
 // Close forces closing all sockets that are alive, whether
@@ -194,7 +389,8 @@ func (server *mongoServer) Close() {
 	server.liveSockets = nil
 	server.unusedSockets = nil
 	server.Unlock()
-	logf("Connections to %s closing (%d live sockets).", server.Addr, len(liveSockets))
+	server.fillPool() // Wake up the pool filler so it can die.
+	logf(LogConnections, "Connections to %s closing (%d live sockets).", server.Addr, len(liveSockets))
 	for i, s := range liveSockets {
 		s.Close()
 		liveSockets[i] = nil
@@ -231,6 +427,7 @@ func removeSocket(sockets []*mongoSocket, socket *mongoSocket) []*mongoSocket {
 func (server *mongoServer) AbendSocket(socket *mongoSocket) {
 	server.Lock()
 	server.abended = true
+	server.buildInfo = nil // The server may be restarting with a new version.
 	if server.closed {
 		server.Unlock()
 		return
@@ -238,6 +435,7 @@ func (server *mongoServer) AbendSocket(socket *mongoSocket) {
 	server.liveSockets = removeSocket(server.liveSockets, socket)
 	server.unusedSockets = removeSocket(server.unusedSockets, socket)
 	server.Unlock()
+	server.fillPool()
 	// Maybe just a timeout, but suggest a cluster sync up just in case.
 	select {
 	case server.sync <- true:
@@ -245,10 +443,75 @@ func (server *mongoServer) AbendSocket(socket *mongoSocket) {
 	}
 }
 
+// How long to wait between checks of the minimum pool size if nothing
+// else kicks the pool filler before that, and how long to wait for each
+// connection it establishes when no dial timeout was provided.
+const poolFillDelay = 15 * time.Second
+const poolFillTimeout = 10 * time.Second
+
+// fillPool injects a value into the server.poolFill channel to force an
+// iteration of the poolFiller function. It does nothing if no minimum
+// pool size was requested for the server.
+func (server *mongoServer) fillPool() {
+	if server.poolFill == nil {
+		return
+	}
+	select {
+	case server.poolFill <- true:
+	default:
+	}
+}
+
+// poolFiller loops while the server is open to keep at least minPoolSize
+// sockets established with it, dialing new connections in the background
+// whenever the pool shrinks below that. It must be called just once from
+// newServer. Nothing is dialed before the server is first synchronized,
+// so that connections are accounted for with the correct server role.
+func (server *mongoServer) poolFiller() {
+	for {
+		select {
+		case <-server.poolFill:
+		case <-time.After(poolFillDelay):
+		}
+		for {
+			server.RLock()
+			closed := server.closed
+			missing := server.minPoolSize - len(server.liveSockets)
+			synced := server.info != &defaultServerInfo
+			server.RUnlock()
+			if closed {
+				return
+			}
+			if missing <= 0 || !synced {
+				break
+			}
+			timeout := server.dial.timeout
+			if timeout <= 0 {
+				timeout = poolFillTimeout
+			}
+			socket, err := server.Connect(timeout)
+			if err != nil {
+				break
+			}
+			server.Lock()
+			if server.closed {
+				server.Unlock()
+				socket.Release()
+				socket.Close()
+				return
+			}
+			server.liveSockets = append(server.liveSockets, socket)
+			server.Unlock()
+			socket.Release()
+		}
+	}
+}
+
 func (server *mongoServer) SetInfo(info *mongoServerInfo) {
 	server.Lock()
 	server.info = info
 	server.Unlock()
+	server.fillPool()
 }
 
 func (server *mongoServer) Info() *mongoServerInfo {
@@ -258,6 +521,21 @@ func (server *mongoServer) Info() *mongoServerInfo {
 	return info
 }
 
+// BuildInfo returns the build details cached with SetBuildInfo, or nil if
+// there are none.
+func (server *mongoServer) BuildInfo() *BuildInfo {
+	server.Lock()
+	info := server.buildInfo
+	server.Unlock()
+	return info
+}
+
+func (server *mongoServer) SetBuildInfo(info *BuildInfo) {
+	server.Lock()
+	server.buildInfo = info
+	server.Unlock()
+}
+
 func (server *mongoServer) hasTags(serverTags []bson.D) bool {
 NextTagSet:
 	for _, tags := range serverTags {
@@ -290,6 +568,11 @@ func (server *mongoServer) pinger(loop bool) {
 	} else {
 		delay = pingDelay
 	}
+	server.RLock()
+	if server.dial.heartbeat > 0 {
+		delay = server.dial.heartbeat
+	}
+	server.RUnlock()
 	op := queryOp{
 		collection: "admin.$cmd",
 		query:      bson.D{{Name: "ping", Value: 1}},
@@ -306,24 +589,14 @@ func (server *mongoServer) pinger(loop bool) {
 			start := time.Now()
 			_, _ = socket.SimpleQuery(&op)
 			delay := time.Since(start)
-
-			server.pingWindow[server.pingIndex] = delay
-			server.pingIndex = (server.pingIndex + 1) % len(server.pingWindow)
-			server.pingCount++
-			var max time.Duration
-			for i := 0; i < len(server.pingWindow) && uint32(i) < server.pingCount; i++ {
-				if server.pingWindow[i] > max {
-					max = server.pingWindow[i]
-				}
-			}
 			socket.Release()
+			ping := server.addPingSample(delay)
 			server.Lock()
 			if server.closed {
 				loop = false
 			}
-			server.pingValue = max
 			server.Unlock()
-			logf("Ping for %s is %d ms", server.Addr, max/time.Millisecond)
+			logf(LogTopology, "Ping for %s is %d ms", server.Addr, ping/time.Millisecond)
 		} else if err == errServerClosed {
 			return
 		}
@@ -333,6 +606,25 @@ func (server *mongoServer) pinger(loop bool) {
 	}
 }
 
+// pingWeight is the weight given to each new round-trip time sample in the
+// exponentially weighted average kept as the server ping value.
+const pingWeight = 0.2
+
+// addPingSample incorporates the round-trip time of a ping or isMaster
+// command into the server ping value, and returns the new value.
+func (server *mongoServer) addPingSample(rtt time.Duration) time.Duration {
+	server.Lock()
+	if server.pingCount == 0 {
+		server.pingValue = rtt
+	} else {
+		server.pingValue = time.Duration(pingWeight*float64(rtt) + (1-pingWeight)*float64(server.pingValue))
+	}
+	server.pingCount++
+	ping := server.pingValue
+	server.Unlock()
+	return ping
+}
+
 type mongoServerSlice []*mongoServer
 
 func (s mongoServerSlice) Len() int {
@@ -412,30 +704,46 @@ func (servers *mongoServers) HasMongos() bool {
 }
 
 // BestFit returns the best guess of what would be the most interesting
-// server to perform operations on at this point in time.
-func (servers *mongoServers) BestFit(mode Mode, serverTags []bson.D) *mongoServer {
+// server to perform operations on at this point in time. Servers whose
+// ping values are within localThreshold of each other are considered
+// equally near. In the Nearest mode, only servers within localThreshold
+// of the nearest one are eligible.
+func (servers *mongoServers) BestFit(mode Mode, serverTags []bson.D, localThreshold time.Duration) *mongoServer {
+	nearest := time.Duration(-1)
+	if mode == Nearest {
+		for _, next := range servers.slice {
+			next.RLock()
+			if (serverTags == nil || next.info.Mongos || next.hasTags(serverTags)) && (nearest < 0 || next.pingValue < nearest) {
+				nearest = next.pingValue
+			}
+			next.RUnlock()
+		}
+	}
 	var best *mongoServer
 	for _, next := range servers.slice {
+		next.RLock()
+		switch {
+		case serverTags != nil && !next.info.Mongos && !next.hasTags(serverTags):
+			// Must have requested tags.
+			next.RUnlock()
+			continue
+		case nearest >= 0 && next.pingValue > nearest+localThreshold:
+			// Must be within the latency window.
+			next.RUnlock()
+			continue
+		}
 		if best == nil {
 			best = next
-			best.RLock()
-			if serverTags != nil && !next.info.Mongos && !best.hasTags(serverTags) {
-				best.RUnlock()
-				best = nil
-			}
 			continue
 		}
-		next.RLock()
 		swap := false
 		switch {
-		case serverTags != nil && !next.info.Mongos && !next.hasTags(serverTags):
-			// Must have requested tags.
 		case mode == Secondary && next.info.Master && !next.info.Mongos:
 			// Must be a secondary or mongos.
 		case next.info.Master != best.info.Master && mode != Nearest:
 			// Prefer slaves, unless the mode is PrimaryPreferred.
 			swap = (mode == PrimaryPreferred) != best.info.Master
-		case absDuration(next.pingValue-best.pingValue) > 15*time.Millisecond:
+		case absDuration(next.pingValue-best.pingValue) > localThreshold:
 			// Prefer nearest server.
 			swap = next.pingValue < best.pingValue
 		case len(next.liveSockets)-len(next.unusedSockets) < len(best.liveSockets)-len(best.unusedSockets):
@@ -27,8 +27,10 @@
 package mgo
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"sync"
 	"time"
@@ -44,12 +46,14 @@ type mongoSocket struct {
 	conn          net.Conn
 	timeout       time.Duration
 	addr          string // For debugging only.
+	id            int64  // For command monitoring.
 	nextRequestId uint32
 	replyFuncs    map[uint32]replyFunc
 	references    int
 	creds         []Credential
 	logout        []Credential
 	cachedNonce   string
+	mechanisms    map[string]string // Negotiated per source.user
 	gotNonce      sync.Cond
 	dead          error
 	serverInfo    *mongoServerInfo
@@ -79,6 +83,11 @@ type queryOp struct {
 	options    queryWrapper
 	hasOptions bool
 	serverTags []bson.D
+	hedge      bool
+
+	explainVerbosity string
+	readConcern      string
+	txn              *transaction
 }
 
 type queryWrapper struct {
@@ -93,31 +102,43 @@ type queryWrapper struct {
 	Comment        string "$comment,omitempty"
 }
 
+// readPreference returns the $readPreference document matching the
+// read mode and server tags of op, as understood by mongos.
+func (op *queryOp) readPreference() bson.D {
+	var modeName string
+	switch op.mode {
+	case Strong:
+		modeName = "primary"
+	case Monotonic, Eventual:
+		modeName = "secondaryPreferred"
+	case PrimaryPreferred:
+		modeName = "primaryPreferred"
+	case Secondary:
+		modeName = "secondary"
+	case SecondaryPreferred:
+		modeName = "secondaryPreferred"
+	case Nearest:
+		modeName = "nearest"
+	default:
+		panic(fmt.Sprintf("unsupported read mode: %d", op.mode))
+	}
+	rp := make(bson.D, 0, 3)
+	rp = append(rp, bson.DocElem{Name: "mode", Value: modeName})
+	if len(op.serverTags) > 0 {
+		rp = append(rp, bson.DocElem{Name: "tags", Value: op.serverTags})
+	}
+	if op.hedge && modeName != "primary" {
+		// Hedged reads are only meaningful when secondaries may serve
+		// the read, and mongos rejects them for the primary mode.
+		rp = append(rp, bson.DocElem{Name: "hedge", Value: bson.D{{Name: "enabled", Value: true}}})
+	}
+	return rp
+}
+
 func (op *queryOp) finalQuery(socket *mongoSocket) any {
 	if op.flags&flagSlaveOk != 0 && socket.ServerInfo().Mongos {
-		var modeName string
-		switch op.mode {
-		case Strong:
-			modeName = "primary"
-		case Monotonic, Eventual:
-			modeName = "secondaryPreferred"
-		case PrimaryPreferred:
-			modeName = "primaryPreferred"
-		case Secondary:
-			modeName = "secondary"
-		case SecondaryPreferred:
-			modeName = "secondaryPreferred"
-		case Nearest:
-			modeName = "nearest"
-		default:
-			panic(fmt.Sprintf("unsupported read mode: %d", op.mode))
-		}
 		op.hasOptions = true
-		op.options.ReadPreference = make(bson.D, 0, 2)
-		op.options.ReadPreference = append(op.options.ReadPreference, bson.DocElem{Name: "mode", Value: modeName})
-		if len(op.serverTags) > 0 {
-			op.options.ReadPreference = append(op.options.ReadPreference, bson.DocElem{Name: "tags", Value: op.serverTags})
-		}
+		op.options.ReadPreference = op.readPreference()
 	}
 	if op.hasOptions {
 		if op.query == nil {
@@ -126,7 +147,7 @@ func (op *queryOp) finalQuery(socket *mongoSocket) any {
 		} else {
 			op.options.Query = op.query
 		}
-		debugf("final query is %#v\n", &op.options)
+		debugf(LogCommands, "final query is %#v\n", &op.options)
 		return &op.options
 	}
 	return op.query
@@ -159,6 +180,8 @@ type updateOp struct {
 	Flags      uint32 `bson:"-"`
 	Multi      bool   `bson:"multi,omitempty"`
 	Upsert     bool   `bson:"upsert,omitempty"`
+
+	ArrayFilters []any `bson:"arrayFilters,omitempty"`
 }
 
 type deleteOp struct {
@@ -175,12 +198,14 @@ type killCursorsOp struct {
 type requestInfo struct {
 	bufferPos int
 	replyFunc replyFunc
+	monitored *monitoredRequest
 }
 
 func newSocket(server *mongoServer, conn net.Conn, timeout time.Duration) *mongoSocket {
 	socket := &mongoSocket{
 		conn:       conn,
 		addr:       server.Addr,
+		id:         nextConnectionId(),
 		server:     server,
 		replyFuncs: make(map[uint32]replyFunc),
 	}
@@ -189,7 +214,7 @@ func newSocket(server *mongoServer, conn net.Conn, timeout time.Duration) *mongo
 		panic("newSocket: InitialAcquire returned error: " + err.Error())
 	}
 	stats.socketsAlive(+1)
-	debugf("Socket %p to %s: initialized", socket, socket.addr)
+	debugf(LogConnections, "Socket %p to %s: initialized", socket, socket.addr)
 	socket.resetNonce()
 	go socket.readLoop()
 	return socket
@@ -308,7 +333,7 @@ func (socket *mongoSocket) updateDeadline(which deadlineType) {
 	default:
 		panic("invalid parameter to updateDeadline")
 	}
-	debugf("Socket %p to %s: updated %s deadline to %s ahead (%s)", socket, socket.addr, whichstr, socket.timeout, when)
+	debugf(LogConnections, "Socket %p to %s: updated %s deadline to %s ahead (%s)", socket, socket.addr, whichstr, socket.timeout, when)
 }
 
 // Close terminates the socket use.
@@ -319,11 +344,15 @@ func (socket *mongoSocket) Close() {
 func (socket *mongoSocket) kill(err error, abend bool) {
 	socket.Lock()
 	if socket.dead != nil {
-		debugf("Socket %p to %s: killed again: %s (previously: %s)", socket, socket.addr, err.Error(), socket.dead.Error())
+		debugf(LogConnections, "Socket %p to %s: killed again: %s (previously: %s)", socket, socket.addr, err.Error(), socket.dead.Error())
 		socket.Unlock()
 		return
 	}
-	logf("Socket %p to %s: closing: %s (abend=%v)", socket, socket.addr, err.Error(), abend)
+	if abend {
+		warnf(LogConnections, "Socket %p to %s: closing: %s (abend=%v)", socket, socket.addr, err.Error(), abend)
+	} else {
+		logf(LogConnections, "Socket %p to %s: closing: %s (abend=%v)", socket, socket.addr, err.Error(), abend)
+	}
 	socket.dead = err
 	socket.conn.Close()
 	stats.socketsAlive(-1)
@@ -334,7 +363,7 @@ func (socket *mongoSocket) kill(err error, abend bool) {
 	socket.gotNonce.Broadcast()
 	socket.Unlock()
 	for _, replyFunc := range replyFuncs {
-		logf("Socket %p to %s: notifying replyFunc of closed socket: %s", socket, socket.addr, err.Error())
+		logf(LogConnections, "Socket %p to %s: notifying replyFunc of closed socket: %s", socket, socket.addr, err.Error())
 		replyFunc(err, nil, -1, nil)
 	}
 	if abend {
@@ -385,15 +414,20 @@ func (socket *mongoSocket) Query(ops ...any) (err error) {
 	// ids at once later with the lock already held.
 	requests := make([]requestInfo, len(ops))
 	requestCount := 0
+	msgs := make([]wireMsg, 0, len(ops))
+	monitor := commandMonitor()
 
 	for _, op := range ops {
-		debugf("Socket %p to %s: serializing op: %#v", socket, socket.addr, op)
-		if qop, ok := op.(*queryOp); ok {
-			if cmd, ok := qop.query.(*findCmd); ok {
-				debugf("Socket %p to %s: find command: %#v", socket, socket.addr, cmd)
+		if debugEnabled(LogCommands) {
+			debugf(LogCommands, "Socket %p to %s: serializing op: %#v", socket, socket.addr, redactOp(op))
+			if qop, ok := op.(*queryOp); ok {
+				if cmd, ok := qop.query.(*findCmd); ok {
+					debugf(LogCommands, "Socket %p to %s: find command: %#v", socket, socket.addr, cmd)
+				}
 			}
 		}
 		start := len(buf)
+		compress := true
 		var replyFunc replyFunc
 		switch op := op.(type) {
 		case *updateOp:
@@ -401,12 +435,12 @@ func (socket *mongoSocket) Query(ops ...any) (err error) {
 			buf = addInt32(buf, 0) // Reserved
 			buf = addCString(buf, op.Collection)
 			buf = addInt32(buf, int32(op.Flags))
-			debugf("Socket %p to %s: serializing selector document: %#v", socket, socket.addr, op.Selector)
+			debugf(LogCommands, "Socket %p to %s: serializing selector document: %#v", socket, socket.addr, op.Selector)
 			buf, err = addBSON(buf, op.Selector)
 			if err != nil {
 				return err
 			}
-			debugf("Socket %p to %s: serializing update document: %#v", socket, socket.addr, op.Update)
+			debugf(LogCommands, "Socket %p to %s: serializing update document: %#v", socket, socket.addr, op.Update)
 			buf, err = addBSON(buf, op.Update)
 			if err != nil {
 				return err
@@ -417,7 +451,7 @@ func (socket *mongoSocket) Query(ops ...any) (err error) {
 			buf = addInt32(buf, int32(op.flags))
 			buf = addCString(buf, op.collection)
 			for _, doc := range op.documents {
-				debugf("Socket %p to %s: serializing document for insertion: %#v", socket, socket.addr, doc)
+				debugf(LogCommands, "Socket %p to %s: serializing document for insertion: %#v", socket, socket.addr, doc)
 				buf, err = addBSON(buf, doc)
 				if err != nil {
 					return err
@@ -425,15 +459,28 @@ func (socket *mongoSocket) Query(ops ...any) (err error) {
 			}
 
 		case *queryOp:
+			if socket.useMsg(op) {
+				buf, compress, err = addMsg(buf, op, socket)
+				if err != nil {
+					return err
+				}
+				replyFunc = op.replyFunc
+				break
+			}
+			if op.txn != nil {
+				return errors.New("operation not supported within a transaction")
+			}
 			buf = addHeader(buf, 2004)
 			buf = addInt32(buf, int32(op.flags))
 			buf = addCString(buf, op.collection)
 			buf = addInt32(buf, op.skip)
 			buf = addInt32(buf, op.limit)
+			docStart := len(buf)
 			buf, err = addBSON(buf, op.finalQuery(socket))
 			if err != nil {
 				return err
 			}
+			compress = mayCompressQuery(op.collection, buf[docStart:])
 			if op.selector != nil {
 				buf, err = addBSON(buf, op.selector)
 				if err != nil {
@@ -455,7 +502,7 @@ func (socket *mongoSocket) Query(ops ...any) (err error) {
 			buf = addInt32(buf, 0) // Reserved
 			buf = addCString(buf, op.Collection)
 			buf = addInt32(buf, int32(op.Flags))
-			debugf("Socket %p to %s: serializing selector document: %#v", socket, socket.addr, op.Selector)
+			debugf(LogCommands, "Socket %p to %s: serializing selector document: %#v", socket, socket.addr, op.Selector)
 			buf, err = addBSON(buf, op.Selector)
 			if err != nil {
 				return err
@@ -474,9 +521,16 @@ func (socket *mongoSocket) Query(ops ...any) (err error) {
 		}
 
 		setInt32(buf, start, int32(len(buf)-start))
+		msgs = append(msgs, wireMsg{start: start, compress: compress})
 
 		if replyFunc != nil {
 			request := &requests[requestCount]
+			if monitor != nil {
+				request.monitored = newMonitoredRequest(monitor, socket, op)
+				if request.monitored != nil {
+					replyFunc = request.monitored.wrap(replyFunc)
+				}
+			}
 			request.replyFunc = replyFunc
 			request.bufferPos = start
 			requestCount++
@@ -489,7 +543,7 @@ func (socket *mongoSocket) Query(ops ...any) (err error) {
 	if socket.dead != nil {
 		dead := socket.dead
 		socket.Unlock()
-		debugf("Socket %p to %s: failing query, already closed: %s", socket, socket.addr, socket.dead.Error())
+		debugf(LogConnections, "Socket %p to %s: failing query, already closed: %s", socket, socket.addr, socket.dead.Error())
 		// XXX This seems necessary in case the session is closed concurrently
 		// with a query being performed, but it's not yet tested:
 		for i := 0; i != requestCount; i++ {
@@ -513,10 +567,17 @@ func (socket *mongoSocket) Query(ops ...any) (err error) {
 		request := &requests[i]
 		setInt32(buf, request.bufferPos+4, int32(requestId))
 		socket.replyFuncs[requestId] = request.replyFunc
+		if request.monitored != nil {
+			request.monitored.start(requestId)
+		}
 		requestId++
 	}
 
-	debugf("Socket %p to %s: sending %d op(s) (%d bytes)", socket, socket.addr, len(ops), len(buf))
+	if socket.serverInfo != nil && socket.serverInfo.Compressor != "" {
+		buf = compressMessages(buf, msgs, socket.serverInfo.Compressor)
+	}
+
+	debugf(LogConnections, "Socket %p to %s: sending %d op(s) (%d bytes)", socket, socket.addr, len(ops), len(buf))
 	stats.sentOps(len(ops))
 
 	socket.updateDeadline(writeDeadline)
@@ -528,7 +589,7 @@ func (socket *mongoSocket) Query(ops ...any) (err error) {
 	return err
 }
 
-func fill(r net.Conn, b []byte) error {
+func fill(r io.Reader, b []byte) error {
 	l := len(b)
 	n, err := r.Read(b)
 	for n != l && err == nil {
@@ -546,7 +607,7 @@ func (socket *mongoSocket) readLoop() {
 	s := make([]byte, 4)
 	conn := socket.conn // No locking, conn never changes.
 	for {
-		err := fill(conn, p)
+		err := fill(conn, p[:16])
 		if err != nil {
 			socket.kill(err, true)
 			return
@@ -558,15 +619,55 @@ func (socket *mongoSocket) readLoop() {
 
 		// Don't use socket.server.Addr here.  socket is not
 		// locked and socket.server may go away.
-		debugf("Socket %p to %s: got reply (%d bytes)", socket, socket.addr, totalLen)
+		debugf(LogConnections, "Socket %p to %s: got reply (%d bytes)", socket, socket.addr, totalLen)
+
+		var r io.Reader = conn
+		bodyLen := int(totalLen) - 16
+		if opCode == opCompressed {
+			var body []byte
+			opCode, body, err = readCompressed(conn, totalLen)
+			if err != nil {
+				socket.kill(err, true)
+				return
+			}
+			r = bytes.NewReader(body)
+			bodyLen = len(body)
+		}
 
-		_ = totalLen
+		if opCode == opMsg {
+			b, err := readMsg(r, bodyLen)
+			if err != nil {
+				socket.kill(err, true)
+				return
+			}
+			stats.receivedOps(+1)
+			stats.receivedDocs(1)
+
+			socket.Lock()
+			replyFunc, ok := socket.replyFuncs[uint32(responseTo)]
+			if ok {
+				delete(socket.replyFuncs, uint32(responseTo))
+			}
+			socket.Unlock()
+
+			if replyFunc != nil {
+				replyFunc(nil, &replyOp{replyDocs: 1}, 0, b)
+			}
+			socket.resetReadDeadline()
+			continue
+		}
 
 		if opCode != 1 {
 			socket.kill(errors.New("opcode != 1, corrupted data?"), true)
 			return
 		}
 
+		err = fill(r, p[16:])
+		if err != nil {
+			socket.kill(err, true)
+			return
+		}
+
 		reply := replyOp{
 			flags:     uint32(getInt32(p, 16)),
 			cursorId:  getInt64(p, 20),
@@ -588,7 +689,7 @@ func (socket *mongoSocket) readLoop() {
 			replyFunc(nil, &reply, -1, nil)
 		} else {
 			for i := 0; i != int(reply.replyDocs); i++ {
-				err := fill(conn, s)
+				err := fill(r, s)
 				if err != nil {
 					if replyFunc != nil {
 						replyFunc(err, nil, -1, nil)
@@ -605,7 +706,7 @@ func (socket *mongoSocket) readLoop() {
 				b[2] = s[2]
 				b[3] = s[3]
 
-				err = fill(conn, b[4:])
+				err = fill(r, b[4:])
 				if err != nil {
 					if replyFunc != nil {
 						replyFunc(err, nil, -1, nil)
@@ -614,10 +715,10 @@ func (socket *mongoSocket) readLoop() {
 					return
 				}
 
-				if globalDebug && globalLogger != nil {
+				if debugEnabled(LogCommands) {
 					m := bson.M{}
 					if err := bson.Unmarshal(b, m); err == nil {
-						debugf("Socket %p to %s: received document: %#v", socket, socket.addr, m)
+						debugf(LogCommands, "Socket %p to %s: received document: %#v", socket, socket.addr, m)
 					}
 				}
 
@@ -629,19 +730,25 @@ func (socket *mongoSocket) readLoop() {
 			}
 		}
 
-		socket.Lock()
-		if len(socket.replyFuncs) == 0 {
-			// Nothing else to read for now. Disable deadline.
-			socket.conn.SetReadDeadline(time.Time{})
-		} else {
-			socket.updateDeadline(readDeadline)
-		}
-		socket.Unlock()
+		socket.resetReadDeadline()
 
 		// XXX Do bound checking against totalLen.
 	}
 }
 
+// resetReadDeadline updates the read deadline after a reply was handled,
+// disabling it if no further replies are expected.
+func (socket *mongoSocket) resetReadDeadline() {
+	socket.Lock()
+	if len(socket.replyFuncs) == 0 {
+		// Nothing else to read for now. Disable deadline.
+		socket.conn.SetReadDeadline(time.Time{})
+	} else {
+		socket.updateDeadline(readDeadline)
+	}
+	socket.Unlock()
+}
+
 var emptyHeader = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
 
 func addHeader(b []byte, opcode int) []byte {
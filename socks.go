@@ -0,0 +1,186 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2012 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 support, as defined in RFC 1928, with the username and password
+// authentication of RFC 1929.
+
+const (
+	socks5Version       = 5
+	socks5NoAuth        = 0
+	socks5UserPass      = 2
+	socks5NoAcceptable  = 0xff
+	socks5Connect       = 1
+	socks5AddrIPv4      = 1
+	socks5AddrDomain    = 3
+	socks5AddrIPv6      = 4
+	socks5UserPassValid = 1
+)
+
+var socks5Failures = []string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// dialSOCKS5 connects to addr through the SOCKS5 proxy set in dial.
+func dialSOCKS5(dialf func(network, address string, timeout time.Duration) (net.Conn, error), dial dialer, addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := dialf(dial.dialNetwork(), dial.proxy, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := socks5Handshake(conn, addr, dial.proxyUsername, dial.proxyPassword); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SOCKS5 proxy %s: %v", dial.proxy, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// socks5Handshake asks the SOCKS5 proxy at the other end of conn to connect
+// it to addr. The host in addr is resolved by the proxy unless it's an IP.
+func socks5Handshake(conn net.Conn, addr, username, password string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 0xffff {
+		return errors.New("bad port in address " + addr)
+	}
+
+	methods := []byte{socks5NoAuth}
+	if username != "" {
+		methods = []byte{socks5NoAuth, socks5UserPass}
+	}
+	b := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(b); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unexpected protocol version %d", reply[0])
+	}
+	switch reply[1] {
+	case socks5NoAuth:
+	case socks5UserPass:
+		if username == "" {
+			return errors.New("proxy requires authentication")
+		}
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("proxy username or password is too long")
+		}
+		b = []byte{socks5UserPassValid, byte(len(username))}
+		b = append(b, username...)
+		b = append(b, byte(len(password)))
+		b = append(b, password...)
+		if _, err := conn.Write(b); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("proxy authentication failed")
+		}
+	case socks5NoAcceptable:
+		return errors.New("no acceptable authentication methods")
+	default:
+		return fmt.Errorf("unsupported authentication method %d", reply[1])
+	}
+
+	b = []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("host name is too long: " + host)
+		}
+		b = append(b, socks5AddrDomain, byte(len(host)))
+		b = append(b, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socks5AddrIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socks5AddrIPv6)
+		b = append(b, ip...)
+	}
+	b = append(b, byte(port>>8), byte(port))
+	if _, err := conn.Write(b); err != nil {
+		return err
+	}
+
+	// The reply carries the address bound by the proxy, which is of
+	// no interest but must be consumed.
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != socks5Version {
+		return fmt.Errorf("unexpected protocol version %d", header[0])
+	}
+	if code := int(header[1]); code != 0 {
+		if code < len(socks5Failures) {
+			return errors.New("cannot connect to " + addr + ": " + socks5Failures[code])
+		}
+		return fmt.Errorf("cannot connect to %s: failure code %d", addr, code)
+	}
+	var bound int
+	switch header[3] {
+	case socks5AddrIPv4:
+		bound = net.IPv4len
+	case socks5AddrIPv6:
+		bound = net.IPv6len
+	case socks5AddrDomain:
+		if _, err := io.ReadFull(conn, header[:1]); err != nil {
+			return err
+		}
+		bound = int(header[0])
+	default:
+		return fmt.Errorf("unknown address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, bound+2))
+	return err
+}
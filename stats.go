@@ -54,7 +54,7 @@ func GetStats() (snapshot Stats) {
 
 func ResetStats() {
 	statsMutex.Lock()
-	debug("Resetting stats")
+	debug(LogCommands, "Resetting stats")
 	old := stats
 	stats = &Stats{}
 	// These are absolute values:
@@ -145,3 +145,12 @@ func (stats *Stats) socketRefs(delta int) {
 		statsMutex.Unlock()
 	}
 }
+
+// PoolStats holds details about the socket pool of a single server.
+// See Session.PoolStats.
+type PoolStats struct {
+	Addr      string // Address of the server, as provided or discovered
+	InUse     int    // Sockets currently reserved for use by sessions
+	Available int    // Sockets idle in the pool, ready to be reused
+	Total     int    // All sockets established with the server
+}
@@ -0,0 +1,344 @@
+// mgo - MongoDB driver for Go
+//
+// Copyright (c) 2010-2012 - Gustavo Niemeyer <gustavo@niemeyer.net>
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/3JoB/mgo/bson"
+)
+
+// Multi-document transactions, as supported by MongoDB 4.0 and later on
+// replica sets and by MongoDB 4.2 and later on sharded clusters. These run
+// on the server within a logical session, unlike the client-side
+// transactions implemented by the txn package.
+//
+// Relevant documentation:
+//
+//	https://github.com/mongodb/specifications/blob/master/source/transactions/transactions.rst
+
+// TransactionOptions holds the options for a multi-document transaction.
+type TransactionOptions struct {
+	// MaxCommitTime bounds the time the server may spend committing or
+	// aborting the transaction. When a commit exceeds it, the outcome of
+	// the commit is unknown and the commit may be retried. Defaults to no
+	// limit.
+	MaxCommitTime time.Duration
+}
+
+// finishTransactionCmd returns the command committing or aborting a
+// transaction with the given options. Commits carry the write concern wc.
+func finishTransactionCmd(cmdName string, opts *TransactionOptions, wc *getLastError) bson.D {
+	cmd := bson.D{{Name: cmdName, Value: 1}}
+	if cmdName == "commitTransaction" && wc != nil {
+		cmd = append(cmd, bson.DocElem{Name: "writeConcern", Value: wc})
+	}
+	if opts.MaxCommitTime > 0 {
+		cmd = append(cmd, bson.DocElem{Name: "maxTimeMS", Value: int64(opts.MaxCommitTime / time.Millisecond)})
+	}
+	return cmd
+}
+
+// transaction holds the state of the transaction in progress in a session,
+// which the operations sent as part of it refer to.
+type transaction struct {
+	opts        TransactionOptions
+	sessionId   bson.Binary
+	txnNumber   int64
+	readConcern string
+	started     int32 // Non-zero once the first operation was sent.
+}
+
+var errNoTransaction = errors.New("no transaction in progress")
+
+// hasStarted returns whether any operation was sent as part of txn, and
+// so whether the server knows about it.
+func (txn *transaction) hasStarted() bool {
+	return atomic.LoadInt32(&txn.started) != 0
+}
+
+// txnCmd returns the serialized command cmd adjusted to run as part of
+// txn. The read and write concerns of the transaction as a whole apply,
+// so those in cmd are dropped, except for the write concern of commits.
+// The first command sent also starts the transaction on the server.
+func (txn *transaction) txnCmd(cmd []byte) ([]byte, error) {
+	var d bson.RawD
+	if err := bson.Unmarshal(cmd, &d); err != nil {
+		return nil, err
+	}
+	finish := len(d) > 0 && (d[0].Name == "commitTransaction" || d[0].Name == "abortTransaction")
+	rest := make(bson.RawD, 0, len(d))
+	for _, elem := range d {
+		if elem.Name == "readConcern" || elem.Name == "writeConcern" && !finish {
+			continue
+		}
+		rest = append(rest, elem)
+	}
+	fields := bson.D{
+		{Name: "lsid", Value: bson.D{{Name: "id", Value: txn.sessionId}}},
+		{Name: "txnNumber", Value: txn.txnNumber},
+	}
+	if !finish && atomic.CompareAndSwapInt32(&txn.started, 0, 1) {
+		fields = append(fields, bson.DocElem{Name: "startTransaction", Value: true})
+		if rc := readConcernDoc(txn.readConcern); rc != nil {
+			fields = append(fields, bson.DocElem{Name: "readConcern", Value: rc})
+		}
+	}
+	fields = append(fields, bson.DocElem{Name: "autocommit", Value: false})
+	body, err := bson.Marshal(rest)
+	if err != nil {
+		return nil, err
+	}
+	return appendFields(body, fields)
+}
+
+// StartTransaction starts a multi-document transaction in the session.
+// The operations made with the session are then part of the transaction,
+// and have their effects made visible to other sessions all at once when
+// CommitTransaction is called, or discarded when AbortTransaction is called
+// instead. The read concern set in the session applies to the transaction
+// as a whole, and the write concern of the session to its commit. The
+// session must be in the Strong or Primary mode, and opts may be nil.
+//
+// Transactions require MongoDB 4.0 or later and a replica set. Operations
+// failing with an error holding the TransientTransactionError label leave
+// the transaction aborted, in which case it may be retried from the start.
+// See WithTransaction for doing that automatically.
+func (s *Session) StartTransaction(opts *TransactionOptions) error {
+	retry, err := s.nextRetryTxn()
+	if err != nil {
+		return err
+	}
+	s.m.Lock()
+	if s.txn != nil {
+		s.m.Unlock()
+		return errors.New("transaction already in progress")
+	}
+	if s.consistency != Strong && s.consistency != Primary {
+		s.m.Unlock()
+		return errors.New("transactions require the Strong or Primary session mode")
+	}
+	txn := &transaction{
+		sessionId:   retry.sessionId,
+		txnNumber:   retry.txnNumber,
+		readConcern: s.queryConfig.op.readConcern,
+	}
+	if opts != nil {
+		txn.opts = *opts
+	}
+	s.txn = txn
+	s.m.Unlock()
+
+	if err := s.pinMongos(); err != nil {
+		s.endTransaction(txn)
+		return err
+	}
+	return nil
+}
+
+// transaction returns the transaction in progress in the session.
+func (s *Session) transaction() (*transaction, error) {
+	s.m.RLock()
+	txn := s.txn
+	s.m.RUnlock()
+	if txn == nil {
+		return nil, errNoTransaction
+	}
+	return txn, nil
+}
+
+// endTransaction ends txn in the session, so that further operations
+// are no longer part of it and may go through any mongos again.
+func (s *Session) endTransaction(txn *transaction) {
+	s.m.Lock()
+	if s.txn == txn {
+		s.txn = nil
+		s.mongos = nil
+	}
+	s.m.Unlock()
+}
+
+// CommitTransaction commits the transaction in progress in the session.
+// When the outcome of the commit is unknown, as it timed out or the
+// connection failed, it's retried once, waiting for the commit to reach
+// a majority of the replica set.
+func (s *Session) CommitTransaction() error {
+	txn, err := s.transaction()
+	if err != nil {
+		return err
+	}
+	err = s.commitTransaction(txn)
+	s.endTransaction(txn)
+	return err
+}
+
+// commitTransaction commits txn, retrying once if the outcome is unknown.
+func (s *Session) commitTransaction(txn *transaction) error {
+	if !txn.hasStarted() {
+		return nil
+	}
+	var wc *getLastError
+	s.m.RLock()
+	if s.safeOp != nil {
+		wc = s.safeOp.query.(*getLastError)
+	}
+	s.m.RUnlock()
+	err := s.Run(finishTransactionCmd("commitTransaction", &txn.opts, wc), nil)
+	if err == nil || !isUnknownCommitResult(err) {
+		return err
+	}
+	debugf(LogCommands, "Retrying transaction commit after error: %v", err)
+	if isRetryableError(err) {
+		s.Refresh()
+	}
+	return s.Run(finishTransactionCmd("commitTransaction", &txn.opts, majorityWriteConcern(wc)), nil)
+}
+
+// majorityWriteConcern returns wc modified to wait for a majority of the
+// replica set, as needed for retrying commits.
+func majorityWriteConcern(wc *getLastError) *getLastError {
+	majority := getLastError{WTimeout: 10000}
+	if wc != nil {
+		majority = *wc
+	}
+	majority.W = "majority"
+	if majority.WTimeout == 0 {
+		majority.WTimeout = 10000
+	}
+	return &majority
+}
+
+// AbortTransaction aborts the transaction in progress in the session,
+// discarding the effects of its operations. Aborting a transaction the
+// server already aborted, such as after an operation failed, succeeds.
+func (s *Session) AbortTransaction() error {
+	txn, err := s.transaction()
+	if err != nil {
+		return err
+	}
+	if txn.hasStarted() {
+		err = abortTransactionErr(s.Run(finishTransactionCmd("abortTransaction", &txn.opts, nil), nil))
+	}
+	s.endTransaction(txn)
+	return err
+}
+
+// withTransactionTimeout bounds the time WithTransaction spends retrying.
+const withTransactionTimeout = 120 * time.Second
+
+// WithTransaction runs fn within a transaction started in the session with
+// opts, and commits the transaction if fn returns nil or aborts it
+// otherwise. When the transaction fails with an error holding the
+// TransientTransactionError label, it's retried from the start by calling
+// fn again, and when the outcome of the commit is unknown, the commit is
+// retried, for up to two minutes overall. fn must therefore be safe to call
+// multiple times, and should return the errors of the session operations
+// it makes so that these can be told apart.
+func (s *Session) WithTransaction(opts *TransactionOptions, fn func() error) error {
+	deadline := time.Now().Add(withTransactionTimeout)
+	for {
+		if err := s.StartTransaction(opts); err != nil {
+			return err
+		}
+		txn, err := s.transaction()
+		if err != nil {
+			return err
+		}
+		err = fn()
+		if err != nil {
+			s.AbortTransaction()
+		} else {
+			err = s.commitTransaction(txn)
+			for err != nil && isUnknownCommitResult(err) && time.Now().Before(deadline) {
+				err = s.commitTransaction(txn)
+			}
+			s.endTransaction(txn)
+		}
+		if err != nil && hasErrorLabel(err, "TransientTransactionError") && time.Now().Before(deadline) {
+			debugf(LogCommands, "Retrying transaction after error: %v", err)
+			continue
+		}
+		return err
+	}
+}
+
+// pinMongos pins the session to the mongos it sends its operations to,
+// so that they all keep going through it until the transaction in
+// progress ends, even if the session is refreshed in the meantime. Sharded transactions
+// must run entirely through the mongos they started on. The session is
+// left as is when it isn't connected to a mongos.
+func (s *Session) pinMongos() error {
+	socket, err := s.acquireSocket(false)
+	if err != nil {
+		return err
+	}
+	server := socket.Server()
+	mongos := socket.ServerInfo().Mongos
+	socket.Release()
+	if mongos {
+		s.m.Lock()
+		s.mongos = server
+		s.m.Unlock()
+	}
+	return nil
+}
+
+func hasErrorLabel(err error, label string) bool {
+	e, ok := err.(*QueryError)
+	return ok && e.HasErrorLabel(label)
+}
+
+// isUnknownCommitResult returns whether a commit that failed with err
+// may have been applied, and so may be retried. That includes commits
+// exceeding MaxCommitTime, which fail with MaxTimeMSExpired (50).
+func isUnknownCommitResult(err error) bool {
+	if e, ok := err.(*QueryError); ok && e.Code == 50 {
+		return true
+	}
+	return hasErrorLabel(err, "UnknownTransactionCommitResult") || isRetryableError(err)
+}
+
+// isNoSuchTransaction returns whether err reports that the server has no
+// record of the transaction, as it is already over.
+func isNoSuchTransaction(err error) bool {
+	e, ok := err.(*QueryError)
+	return ok && e.Code == 251
+}
+
+// abortTransactionErr returns the error to report for an abortTransaction
+// command that failed with err. Aborting a transaction the server no
+// longer knows about, such as one it already aborted after an error,
+// succeeds, as there's nothing left to discard. That keeps deferred
+// aborts from reporting spurious errors.
+func abortTransactionErr(err error) error {
+	if isNoSuchTransaction(err) {
+		return nil
+	}
+	return err
+}
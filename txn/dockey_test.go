@@ -4,6 +4,8 @@ import (
 	"sort"
 
 	. "gopkg.in/check.v1"
+
+	"github.com/3JoB/mgo/bson"
 )
 
 type DocKeySuite struct{}
@@ -192,6 +194,36 @@ var docKeysTests = [][]docKeys{
 		{C: "c", Id: T13{p: false, q: true, r: false, S: "a"}},
 		{C: "c", Id: T12{S: "b"}},
 		{C: "c", Id: T13{p: false, q: true, r: false, S: "b"}},
+	}}, {{
+		{C: "c", Id: bson.D{{Name: "a", Value: 1}, {Name: "b", Value: "b"}}},
+		{C: "c", Id: bson.D{{Name: "a", Value: 1}, {Name: "b", Value: "a"}}},
+		{C: "c", Id: bson.D{{Name: "a", Value: 0}, {Name: "b", Value: "b"}}},
+		{C: "c", Id: bson.D{{Name: "a", Value: 0}, {Name: "b", Value: "a"}}},
+	}, {
+		{C: "c", Id: bson.D{{Name: "a", Value: 0}, {Name: "b", Value: "a"}}},
+		{C: "c", Id: bson.D{{Name: "a", Value: 0}, {Name: "b", Value: "b"}}},
+		{C: "c", Id: bson.D{{Name: "a", Value: 1}, {Name: "b", Value: "a"}}},
+		{C: "c", Id: bson.D{{Name: "a", Value: 1}, {Name: "b", Value: "b"}}},
+	}}, {{
+		{C: "c", Id: bson.D{{Name: "b", Value: 0}, {Name: "a", Value: 1}}},
+		{C: "c", Id: bson.D{{Name: "a", Value: 1}, {Name: "b", Value: 0}}},
+		{C: "c", Id: bson.D{{Name: "a", Value: 0}}},
+		{C: "c", Id: bson.D{{Name: "a", Value: 0}, {Name: "b", Value: 0}}},
+	}, {
+		{C: "c", Id: bson.D{{Name: "a", Value: 0}}},
+		{C: "c", Id: bson.D{{Name: "a", Value: 0}, {Name: "b", Value: 0}}},
+		{C: "c", Id: bson.D{{Name: "b", Value: 0}, {Name: "a", Value: 1}}},
+		{C: "c", Id: bson.D{{Name: "a", Value: 1}, {Name: "b", Value: 0}}},
+	}}, {{
+		{C: "c", Id: bson.D{{Name: "a", Value: 1}, {Name: "b", Value: "b"}}},
+		{C: "c", Id: T{A: 0, B: "b"}},
+		{C: "c", Id: bson.M{"b": "a", "a": 0}},
+		{C: "c", Id: bson.D{{Name: "a", Value: bson.D{{Name: "x", Value: 2}}}}},
+	}, {
+		{C: "c", Id: bson.M{"b": "a", "a": 0}},
+		{C: "c", Id: T{A: 0, B: "b"}},
+		{C: "c", Id: bson.D{{Name: "a", Value: 1}, {Name: "b", Value: "b"}}},
+		{C: "c", Id: bson.D{{Name: "a", Value: bson.D{{Name: "x", Value: 2}}}}},
 	}},
 }
 
@@ -203,3 +235,53 @@ func (s *DocKeySuite) TestSort(c *C) {
 		c.Check(keys, DeepEquals, expected)
 	}
 }
+
+func (s *DocKeySuite) TestCompoundDocKey(c *C) {
+	type T14 struct {
+		A int    `bson:"a"`
+		B string `bson:"b"`
+	}
+	ids := []any{
+		bson.D{{Name: "a", Value: 1}, {Name: "b", Value: "x"}},
+		bson.M{"b": "x", "a": 1},
+		map[string]any{"a": 1, "b": "x"},
+		T14{A: 1, B: "x"},
+	}
+	seen := make(map[docKey]bool)
+	for _, id := range ids {
+		op := Op{C: "c", Id: id}
+		seen[op.docKey()] = true
+	}
+	c.Assert(seen, HasLen, 1)
+
+	// The order of the fields of a bson.D is significant.
+	op := Op{C: "c", Id: bson.D{{Name: "b", Value: "x"}, {Name: "a", Value: 1}}}
+	c.Assert(seen[op.docKey()], Equals, false)
+
+	// Ids not marshalled as documents are left alone.
+	op = Op{C: "c", Id: bson.ObjectIdHex("4fe9f7a8d4f0d2de5c000001")}
+	c.Assert(op.docKey().Id, Equals, op.Id)
+}
+
+func (s *DocKeySuite) TestTransactionCompoundIds(c *C) {
+	id := bson.D{{Name: "b", Value: 1}, {Name: "a", Value: bson.D{{Name: "y", Value: "z"}, {Name: "x", Value: true}}}}
+	data, err := bson.Marshal(&transaction{
+		Id:  bson.NewObjectId(),
+		Ops: []Op{{C: "c", Id: id}, {C: "c", Id: 42}},
+	})
+	c.Assert(err, IsNil)
+
+	t := transaction{docKeysCached: docKeys{{C: "stale", Id: 1}}}
+	err = bson.Unmarshal(data, &t)
+	c.Assert(err, IsNil)
+	c.Assert(t.Ops[0].Id, DeepEquals, id)
+	c.Assert(t.Ops[1].Id, Equals, 42)
+	c.Assert(t.docKeys(), DeepEquals, docKeys{{C: "c", Id: 42}, {C: "c", Id: keyId(id)}})
+
+	var key docKey
+	data, err = bson.Marshal(docKey{C: "c", Id: keyId(id)})
+	c.Assert(err, IsNil)
+	err = bson.Unmarshal(data, &key)
+	c.Assert(err, IsNil)
+	c.Assert(key, Equals, docKey{C: "c", Id: keyId(id)})
+}
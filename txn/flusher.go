@@ -658,9 +658,8 @@ func (f *flusher) abortOrReload(t *transaction, revnos []int64, pull map[bson.Ob
 			}
 		}
 	}
-	udoc := bson.D{{Name: "$set", Value: bson.D{{Name: "s", Value: taborted}}}}
 	chaos("set-aborted")
-	if err := f.tc.UpdateId(t.Id, udoc); err != nil && err != mgo.ErrNotFound {
+	if err := f.tc.UpdateId(t.Id, f.doneUpdate(taborted)); err != nil && err != mgo.ErrNotFound {
 		return err
 	}
 	t.State = taborted
@@ -905,7 +904,7 @@ func (f *flusher) apply(t *transaction, pull map[bson.ObjectId]*transaction) err
 	// it has been applied and mark it at such.
 	f.debugf("Marking %s as applied", t)
 	chaos("set-applied")
-	f.tc.Update(bson.D{{Name: "_id", Value: t.Id}, {Name: "s", Value: tapplying}}, bson.D{{Name: "$set", Value: bson.D{{Name: "s", Value: tapplied}}}})
+	f.tc.Update(bson.D{{Name: "_id", Value: t.Id}, {Name: "s", Value: tapplying}}, f.doneUpdate(tapplied))
 	return nil
 }
 
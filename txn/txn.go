@@ -15,6 +15,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/3JoB/mgo"
 	"github.com/3JoB/mgo/bson"
@@ -72,6 +73,34 @@ type transaction struct {
 	docKeysCached docKeys
 }
 
+// SetBSON decodes t, keeping the fields of compound document ids in
+// order so that they still match the documents the operations refer to.
+func (t *transaction) SetBSON(raw bson.Raw) error {
+	type plain transaction
+	*t = transaction{}
+	if err := raw.Unmarshal((*plain)(t)); err != nil {
+		return err
+	}
+	var ids struct {
+		Ops []struct {
+			Id bson.Raw `bson:"d"`
+		} `bson:"o"`
+	}
+	if err := raw.Unmarshal(&ids); err != nil {
+		return err
+	}
+	for i, op := range ids.Ops {
+		if op.Id.Kind == bson.ElementDocument && i < len(t.Ops) {
+			var d bson.D
+			if err := op.Id.Unmarshal(&d); err != nil {
+				return err
+			}
+			t.Ops[i].Id = d
+		}
+	}
+	return nil
+}
+
 func (t *transaction) String() string {
 	if t.Nonce == "" {
 		return t.Id.Hex()
@@ -144,6 +173,10 @@ func (tt token) nonce() string { return string(tt[25:]) }
 type Op struct {
 	// C and Id identify the collection and document this operation
 	// refers to. Id is matched against the "_id" document field.
+	// Compound ids may be given as a struct or a bson.D, which keep
+	// their fields in order. Maps such as bson.M have their keys
+	// sorted instead, since the server compares document ids field
+	// by field.
 	C string `bson:"c"`
 
 	Id any `bson:"d"`
@@ -156,6 +189,20 @@ type Op struct {
 	// fails. This is also the only way to prevent a transaction
 	// from being being applied (the transaction continues despite
 	// the outcome of Insert, Update, and Remove).
+	//
+	// The query document may use any of the usual query operators
+	// on the fields of the document, and implies that the document
+	// exists, as with DocExists. The document can't be changed by
+	// other transactions between the time it's tested and the time
+	// the transaction is applied, so assertions may be used for
+	// compare-and-swap changes such as:
+	//
+	//	txn.Op{
+	//	        C:      "accounts",
+	//	        Id:     id,
+	//	        Assert: bson.M{"version": 3},
+	//	        Update: bson.M{"$set": bson.M{"balance": 100, "version": 4}},
+	//	}
 	Assert any `bson:"a,omitempty"`
 
 	// The Insert, Update and Remove fields describe the mutation
@@ -190,7 +237,7 @@ func (op *Op) isChange() bool {
 }
 
 func (op *Op) docKey() docKey {
-	return docKey{C: op.C, Id: op.Id}
+	return docKey{C: op.C, Id: keyId(op.Id)}
 }
 
 func (op *Op) name() string {
@@ -221,6 +268,8 @@ type Runner struct {
 	tc *mgo.Collection // txns
 	sc *mgo.Collection // stash
 	lc *mgo.Collection // log
+
+	stampDone bool // Record when transactions complete, for expiring them.
 }
 
 // NewRunner returns a new transaction runner that uses tc to hold its
@@ -267,11 +316,13 @@ var ErrAborted = errors.New("transaction aborted")
 // runner or many.
 func (r *Runner) Run(ops []Op, id bson.ObjectId, info any) (err error) {
 	const efmt = "error in transaction op %d: %s"
+	ops = append([]Op(nil), ops...) // Ids are normalized below.
 	for i := range ops {
 		op := &ops[i]
 		if op.C == "" || op.Id == nil {
 			return fmt.Errorf(efmt, i, "C or Id missing")
 		}
+		op.Id = normalizeId(op.Id)
 		changes := 0
 		if op.Insert != nil {
 			changes++
@@ -314,11 +365,14 @@ func (r *Runner) Run(ops []Op, id bson.ObjectId, info any) (err error) {
 	return nil
 }
 
-// ResumeAll resumes all pending transactions. All ErrAborted errors
-// from individual transactions are ignored.
+// ResumeAll resumes all pending transactions, driving each of them to
+// completion or abort. All ErrAborted errors from individual transactions
+// are ignored. It may be called when starting up to recover transactions
+// interrupted by a crash, and it's safe to call concurrently from multiple
+// processes and alongside other transactions on the same documents.
 func (r *Runner) ResumeAll() (err error) {
 	debugf("Resuming all unfinished transactions")
-	iter := r.tc.Find(bson.D{{Name: "s", Value: bson.D{{Name: "$in", Value: []state{tpreparing, tprepared, tapplying}}}}}).Iter()
+	iter := r.tc.Find(bson.D{{Name: "s", Value: bson.D{{Name: "$in", Value: []state{tpreparing, tprepared, taborting, tapplying}}}}}).Iter()
 	var t transaction
 	for iter.Next(&t) {
 		if t.State == tapplied || t.State == taborted {
@@ -326,13 +380,14 @@ func (r *Runner) ResumeAll() (err error) {
 		}
 		debugf("Resuming %s from %q", t.Id, t.State)
 		if err := flush(r, &t); err != nil {
+			iter.Close()
 			return err
 		}
 		if !t.done() {
 			panic(fmt.Errorf("invalid state for %s after flush: %q", &t, t.State))
 		}
 	}
-	return nil
+	return iter.Close()
 }
 
 // Resume resumes the transaction with id. It returns mgo.ErrNotFound
@@ -374,6 +429,52 @@ func (r *Runner) ChangeLog(logc *mgo.Collection) {
 	r.lc = logc
 }
 
+// SetStash changes the collection used for implementing the transactional
+// behavior of insert and remove operations, which by default is named after
+// the transaction collection with a ".stash" suffix. All runners handling
+// the same transaction collection must use the same stash collection, and
+// it must not be changed while transactions are pending.
+func (r *Runner) SetStash(sc *mgo.Collection) {
+	r.sc = sc
+}
+
+// ExpireDone has transaction documents removed by the server once they've
+// been applied or aborted for at least the given duration, which must be
+// one second or longer. The runner records the completion time of its
+// transactions in their "f" field, and ensures a TTL index on it exists
+// in the transaction collection. Transactions completed by runners not
+// set up this way are kept.
+//
+// Expired transactions can no longer be resumed or looked up, so the
+// duration should largely exceed the time it may take for a transaction
+// to be resumed and for the documents it touched to be updated again.
+// The change log, if any, is unaffected.
+//
+// Relevant documentation:
+//
+//	https://docs.mongodb.com/manual/core/index-ttl/
+func (r *Runner) ExpireDone(after time.Duration) error {
+	if after < time.Second {
+		return fmt.Errorf("transaction expiry must be at least one second, got %v", after)
+	}
+	err := r.tc.EnsureIndex(mgo.Index{Key: []string{"f"}, ExpireAfter: after})
+	if err != nil {
+		return err
+	}
+	r.stampDone = true
+	return nil
+}
+
+// doneUpdate returns the update document setting a transaction as being
+// in the completed state st.
+func (r *Runner) doneUpdate(st state) bson.D {
+	udoc := bson.D{{Name: "$set", Value: bson.D{{Name: "s", Value: st}}}}
+	if r.stampDone {
+		udoc = append(udoc, bson.DocElem{Name: "$currentDate", Value: bson.D{{Name: "f", Value: true}}})
+	}
+	return udoc
+}
+
 // PurgeMissing removes from collections any state that refers to transaction
 // documents that for whatever reason have been lost from the system (removed
 // by accident or lost in a hard crash, for example).
@@ -476,6 +577,9 @@ const (
 )
 
 func valueNature(v any) (value any, nature typeNature) {
+	if id, ok := v.(docId); ok {
+		return id, natureStruct
+	}
 	rv := reflect.ValueOf(v)
 	switch rv.Kind() {
 	case reflect.String:
@@ -490,15 +594,106 @@ func valueNature(v any) (value any, nature typeNature) {
 		return rv.Bool(), natureBool
 	case reflect.Struct:
 		return v, natureStruct
+	case reflect.Map, reflect.Slice:
+		if id, ok := keyId(v).(docId); ok {
+			return id, natureStruct
+		}
 	}
 	panic("document id type unsupported by txn: " + rv.Kind().String())
 }
 
+// normalizeId returns id with the keys of maps in it sorted, so that
+// they marshal the same way every time.
+func normalizeId(id any) any {
+	switch v := id.(type) {
+	case bson.D:
+		d := make(bson.D, len(v))
+		for i, elem := range v {
+			d[i] = bson.DocElem{Name: elem.Name, Value: normalizeId(elem.Value)}
+		}
+		return d
+	case docId:
+		return id
+	}
+	rv := reflect.ValueOf(id)
+	if rv.Kind() != reflect.Map || rv.Type().Key().Kind() != reflect.String {
+		return id
+	}
+	keys := make([]string, 0, rv.Len())
+	for _, k := range rv.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	d := make(bson.D, len(keys))
+	for i, k := range keys {
+		value := rv.MapIndex(reflect.ValueOf(k).Convert(rv.Type().Key()))
+		d[i] = bson.DocElem{Name: k, Value: normalizeId(value.Interface())}
+	}
+	return d
+}
+
+// docId holds the marshalled form of a compound document id, which
+// unlike bson.D and bson.M may be compared and used as a map key.
+type docId string
+
+// keyId returns id as a docId if it's marshalled as a document, or
+// unchanged otherwise.
+func keyId(id any) any {
+	switch reflect.ValueOf(id).Kind() {
+	case reflect.Struct, reflect.Map, reflect.Slice:
+	default:
+		return id
+	}
+	data, err := bson.Marshal(bson.D{{Name: "d", Value: normalizeId(id)}})
+	if err != nil {
+		return id
+	}
+	var doc struct{ D bson.Raw }
+	if err := bson.Unmarshal(data, &doc); err != nil || doc.D.Kind != bson.ElementDocument {
+		return id
+	}
+	return docId(doc.D.Data)
+}
+
+func (id docId) GetBSON() (any, error) {
+	return bson.Raw{Kind: bson.ElementDocument, Data: []byte(id)}, nil
+}
+
+func (id docId) doc() bson.D {
+	var d bson.D
+	if err := bson.Unmarshal([]byte(id), &d); err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func (id docId) String() string {
+	return fmt.Sprint(id.doc())
+}
+
 type docKey struct {
 	C  string
 	Id any
 }
 
+// SetBSON decodes k, keeping compound document ids as a docId.
+func (k *docKey) SetBSON(raw bson.Raw) error {
+	var key struct {
+		C  string
+		Id bson.Raw
+	}
+	if err := raw.Unmarshal(&key); err != nil {
+		return err
+	}
+	k.C = key.C
+	if key.Id.Kind == bson.ElementDocument {
+		k.Id = docId(key.Id.Data)
+		return nil
+	}
+	k.Id = nil
+	return key.Id.Unmarshal(&k.Id)
+}
+
 type docKeys []docKey
 
 func (ks docKeys) Len() int { return len(ks) }
@@ -537,7 +732,7 @@ func valuecmp(a, b any) int {
 	case natureBool:
 		less = !av.(bool) && bv.(bool)
 	case natureStruct:
-		less = structcmp(av, bv) == -1
+		less = doccmp(av, bv) == -1
 	default:
 		panic("unreachable")
 	}
@@ -547,6 +742,44 @@ func valuecmp(a, b any) int {
 	return 1
 }
 
+// doccmp compares the compound ids a and b, which are either structs or
+// docId values, field by field.
+func doccmp(a, b any) int {
+	_, adoc := a.(docId)
+	_, bdoc := b.(docId)
+	if !adoc && !bdoc {
+		return structcmp(a, b)
+	}
+	ad := asDocId(a).doc()
+	bd := asDocId(b).doc()
+	for i := 0; i < len(ad) && i < len(bd); i++ {
+		if n := valuecmp(ad[i].Value, bd[i].Value); n != 0 {
+			return n
+		}
+		if ad[i].Name < bd[i].Name {
+			return -1
+		}
+		if ad[i].Name > bd[i].Name {
+			return 1
+		}
+	}
+	switch {
+	case len(ad) < len(bd):
+		return -1
+	case len(ad) > len(bd):
+		return 1
+	}
+	return 0
+}
+
+func asDocId(v any) docId {
+	id, ok := keyId(v).(docId)
+	if !ok {
+		panic(fmt.Sprintf("document id unsupported by txn: %#v", v))
+	}
+	return id
+}
+
 func structcmp(a, b any) int {
 	av := reflect.ValueOf(a)
 	bv := reflect.ValueOf(b)
@@ -147,6 +147,63 @@ func (s *S) TestInsertStructID(c *C) {
 	c.Assert(n, Equals, 2)
 }
 
+func (s *S) TestCompoundId(c *C) {
+	john := bson.D{{Name: "last", Value: "Jones"}, {Name: "first", Value: "John"}}
+	sally := bson.D{{Name: "first", Value: "Sally"}, {Name: "last", Value: "Smith"}}
+	ops := []txn.Op{{
+		C:      "accounts",
+		Id:     john,
+		Assert: txn.DocMissing,
+		Insert: M{"balance": 200},
+	}, {
+		C:      "accounts",
+		Id:     sally,
+		Assert: txn.DocMissing,
+		Insert: M{"balance": 800},
+	}}
+	err := s.runner.Run(ops, "", nil)
+	c.Assert(err, IsNil)
+
+	// Transactions touching the same documents in any order, with
+	// maps standing for the ids with sorted keys, serialize correctly.
+	ops1 := []txn.Op{{
+		C:      "accounts",
+		Id:     john,
+		Assert: M{"balance": M{"$gte": 100}},
+		Update: M{"$inc": M{"balance": -100}},
+	}, {
+		C:      "accounts",
+		Id:     M{"first": "Sally", "last": "Smith"},
+		Update: M{"$inc": M{"balance": 100}},
+	}}
+	ops2 := []txn.Op{{
+		C:      "accounts",
+		Id:     sally,
+		Update: M{"$inc": M{"balance": -50}},
+	}, {
+		C:      "accounts",
+		Id:     john,
+		Update: M{"$inc": M{"balance": 50}},
+	}}
+	var wg sync.WaitGroup
+	for _, ops := range [][]txn.Op{ops1, ops2, ops1, ops2} {
+		wg.Add(1)
+		go func(ops []txn.Op) {
+			defer wg.Done()
+			c.Check(s.runner.Run(ops, "", nil), IsNil)
+		}(ops)
+	}
+	wg.Wait()
+
+	var account struct{ Balance int }
+	err = s.accounts.FindId(john).One(&account)
+	c.Assert(err, IsNil)
+	c.Assert(account.Balance, Equals, 100)
+	err = s.accounts.FindId(sally).One(&account)
+	c.Assert(err, IsNil)
+	c.Assert(account.Balance, Equals, 900)
+}
+
 func (s *S) TestRemove(c *C) {
 	err := s.accounts.Insert(M{"_id": 0, "balance": 300})
 	c.Assert(err, IsNil)
@@ -388,6 +445,56 @@ func (s *S) TestAssertNestedOr(c *C) {
 	c.Assert(account.Balance, Equals, 400)
 }
 
+func (s *S) TestAssertCompareAndSwap(c *C) {
+	err := s.accounts.Insert(M{"_id": 0, "balance": 300, "version": 1})
+	c.Assert(err, IsNil)
+
+	// Of the transactions expecting the same version, only one applies.
+	cas := func(balance int) []txn.Op {
+		return []txn.Op{{
+			C:      "accounts",
+			Id:     0,
+			Assert: M{"version": 1, "balance": M{"$gte": 100}},
+			Update: M{"$set": M{"balance": balance}, "$inc": M{"version": 1}},
+		}}
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = s.runner.Run(cas(100*i), "", nil)
+		}(i)
+	}
+	wg.Wait()
+
+	applied := -1
+	for i, err := range errs {
+		if err == nil {
+			c.Assert(applied, Equals, -1)
+			applied = i
+		} else {
+			c.Assert(err, Equals, txn.ErrAborted)
+		}
+	}
+	c.Assert(applied, Not(Equals), -1)
+
+	var account struct{ Balance, Version int }
+	err = s.accounts.FindId(0).One(&account)
+	c.Assert(err, IsNil)
+	c.Assert(account.Balance, Equals, 100*applied)
+	c.Assert(account.Version, Equals, 2)
+
+	// Predicates on missing documents fail.
+	err = s.runner.Run([]txn.Op{{
+		C:      "accounts",
+		Id:     1,
+		Assert: M{"version": M{"$exists": false}},
+	}}, "", nil)
+	c.Assert(err, Equals, txn.ErrAborted)
+}
+
 func (s *S) TestVerifyFieldOrdering(c *C) {
 	// Used to have a map in certain operations, which means
 	// the ordering of fields would be messed up.
@@ -494,6 +601,147 @@ func (s *S) TestChangeLog(c *C) {
 	c.Assert(m["people"], DeepEquals, &Log{Docs: IdList{"joe"}, Revnos: []int64{-3}})
 }
 
+func (s *S) TestSetStash(c *C) {
+	stash := s.db.C("custom.stash")
+	s.runner.SetStash(stash)
+
+	txn.SetChaos(txn.Chaos{
+		KillChance: 1,
+		Breakpoint: "set-applying",
+	})
+	ops := []txn.Op{{
+		C:      "accounts",
+		Id:     0,
+		Insert: M{"balance": 100},
+	}}
+	id := bson.NewObjectId()
+	err := s.runner.Run(ops, id, nil)
+	c.Assert(err, Equals, txn.ErrChaos)
+
+	// The missing document is prepared in the custom stash.
+	n, err := stash.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+	n, err = s.sc.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+
+	txn.SetChaos(txn.Chaos{})
+	err = s.runner.Resume(id)
+	c.Assert(err, IsNil)
+
+	var account Account
+	err = s.accounts.FindId(0).One(&account)
+	c.Assert(err, IsNil)
+	c.Assert(account.Balance, Equals, 100)
+}
+
+func (s *S) TestExpireDone(c *C) {
+	err := s.runner.ExpireDone(500 * time.Millisecond)
+	c.Assert(err, ErrorMatches, "transaction expiry must be at least one second, got 500ms")
+
+	chglog := s.db.C("chglog")
+	s.runner.ChangeLog(chglog)
+	err = s.runner.ExpireDone(time.Hour)
+	c.Assert(err, IsNil)
+
+	indexes, err := s.tc.Indexes()
+	c.Assert(err, IsNil)
+	var found bool
+	for _, index := range indexes {
+		if len(index.Key) == 1 && index.Key[0] == "f" {
+			c.Assert(index.ExpireAfter, Equals, time.Hour)
+			found = true
+		}
+	}
+	c.Assert(found, Equals, true)
+
+	applied := bson.NewObjectId()
+	err = s.runner.Run([]txn.Op{{
+		C:      "accounts",
+		Id:     0,
+		Insert: M{"balance": 100},
+	}}, applied, nil)
+	c.Assert(err, IsNil)
+	aborted := bson.NewObjectId()
+	err = s.runner.Run([]txn.Op{{
+		C:      "accounts",
+		Id:     0,
+		Assert: txn.DocMissing,
+	}}, aborted, nil)
+	c.Assert(err, Equals, txn.ErrAborted)
+
+	// Completed transactions record when they finished.
+	for _, id := range []bson.ObjectId{applied, aborted} {
+		var t struct {
+			F time.Time "f"
+		}
+		err = s.tc.FindId(id).One(&t)
+		c.Assert(err, IsNil)
+		c.Assert(time.Since(t.F) < time.Minute, Equals, true, Commentf("finished at %v", t.F))
+	}
+
+	// The change log is unaffected.
+	n, err := chglog.FindId(applied).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+}
+
+func (s *S) TestResumeAll(c *C) {
+	err := s.accounts.Insert(M{"_id": 0, "balance": 100}, M{"_id": 1, "balance": 100}, M{"_id": 2, "balance": 100}, M{"_id": 3, "balance": 100})
+	c.Assert(err, IsNil)
+
+	// Leave a transaction interrupted at each stage.
+	breakpoints := []string{"set-prepared", "set-applying", "set-applied", "set-aborted"}
+	ids := make([]bson.ObjectId, len(breakpoints))
+	for i, breakpoint := range breakpoints {
+		txn.SetChaos(txn.Chaos{
+			KillChance: 1,
+			Breakpoint: breakpoint,
+		})
+		op := txn.Op{
+			C:      "accounts",
+			Id:     i,
+			Update: M{"$inc": M{"balance": 100}},
+		}
+		if breakpoint == "set-aborted" {
+			op.Assert = M{"balance": 0}
+		}
+		ids[i] = bson.NewObjectId()
+		err = s.runner.Run([]txn.Op{op}, ids[i], nil)
+		c.Assert(err, Equals, txn.ErrChaos)
+	}
+	txn.SetChaos(txn.Chaos{})
+
+	// Recover concurrently, as multiple restarted processes would.
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Check(txn.NewRunner(s.tc).ResumeAll(), IsNil)
+		}()
+	}
+	wg.Wait()
+
+	n, err := s.tc.Find(M{"s": M{"$nin": []int{5, 6}}}).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+
+	for i, id := range ids {
+		err = s.runner.Resume(id)
+		var account Account
+		c.Assert(s.accounts.FindId(i).One(&account), IsNil)
+		if breakpoints[i] == "set-aborted" {
+			c.Assert(err, Equals, txn.ErrAborted)
+			c.Assert(account.Balance, Equals, 100)
+		} else {
+			c.Assert(err, IsNil)
+			c.Assert(account.Balance, Equals, 200)
+		}
+	}
+}
+
 func (s *S) TestPurgeMissing(c *C) {
 	txn.SetChaos(txn.Chaos{
 		KillChance: 1,